@@ -13,23 +13,145 @@ type Config struct {
 		RotationPeriod time.Duration `yaml:"rotation_period"`  // Период ротации ключей
 		TTL            time.Duration `yaml:"ttl"`              // Время жизни токена
 		OldKeysToKeep  int           `yaml:"old_keys_to_keep"` // Сколько старых ключей оставлять
+		MaxSessionAge  time.Duration `yaml:"max_session_age"`  // Сколько можно обновлять токен после входа (auth_time), по умолчанию 24h
+		SigningKeyFile string        `yaml:"signing_key_file"` // PEM с ключом RSA для ID token (RS256)
+
+		Encryption struct {
+			Alg     string `yaml:"alg"`      // dir или RSA-OAEP; пусто - токены только подписываются
+			KeyFile string `yaml:"key_file"` // PEM с ключом RSA для RSA-OAEP
+		} `yaml:"encryption"` // Вложенные токены JWE (A256GCM), claims не читаются без ключа
 	} `yaml:"jwt"`
 
+	Token struct {
+		Extractors []ExtractorConfig `yaml:"extractors"` // Откуда брать токен, по порядку. По умолчанию - Authorization: Bearer
+	} `yaml:"token"`
+
+	APIKeys struct {
+		Header string `yaml:"header"` // Заголовок с ключом, по умолчанию X-API-Key
+		Prefix string `yaml:"prefix"` // Префикс ключей без "_", по умолчанию ak
+		// Какие роли, кроме своей, роль может назначать ключам через MountAPIKeyRoutes
+		AssignableRoles map[string][]string `yaml:"assignable_roles"`
+		// Роли, которые в MountAPIKeyRoutes видят и отзывают ключи всех пользователей, а не только свои
+		AdminRoles []string `yaml:"admin_roles"`
+	} `yaml:"api_keys"`
+
+	Basic struct {
+		Htpasswd    string        `yaml:"htpasswd"`     // Файл htpasswd с bcrypt-хэшами для BasicAuth
+		DefaultRole string        `yaml:"default_role"` // Роль для строк htpasswd без третьего поля
+		CacheTTL    time.Duration `yaml:"cache_ttl"`    // Сколько помнить успешную проверку пароля, по умолчанию 1m
+	} `yaml:"basic"`
+
+	Session struct {
+		Enabled         bool   `yaml:"enabled"`          // Режим сессии в cookie с защитой от CSRF
+		CookieName      string `yaml:"cookie_name"`      // Cookie с токеном (HttpOnly), по умолчанию access_token
+		CSRFCookieName  string `yaml:"csrf_cookie_name"` // Cookie с CSRF-токеном, доступна скриптам, по умолчанию csrf_token
+		CSRFHeader      string `yaml:"csrf_header"`      // Заголовок, в котором клиент возвращает CSRF-токен, по умолчанию X-CSRF-Token
+		CSRFSecret      string `yaml:"csrf_secret"`      // Ключ подписи CSRF-токенов, по умолчанию выводится из jwt.secret
+		Domain          string `yaml:"domain"`
+		Path            string `yaml:"path"`
+		SameSite        string `yaml:"same_site"`        // strict, lax (по умолчанию) или none
+		InsecureCookies bool   `yaml:"insecure_cookies"` // Не ставить флаг Secure, только для локальной разработки
+	} `yaml:"session"`
+
 	Permissions struct {
 		Path string `yaml:"path"` //Путь до файла с мапой ролей и их разрешениями
 	} `yaml:"permissions"`
 
 	Password struct {
-		Cost int `yaml:"cost"` //Сложность хэширования пароля, оптимальное значение - 12. Больше информации в тестах
+		Cost          int           `yaml:"cost"`           //Сложность хэширования пароля, оптимальное значение - 12. Больше информации в тестах
+		AutoCost      bool          `yaml:"auto_cost"`      // Подобрать сложность под железо при старте, cost тогда не используется
+		TargetLatency time.Duration `yaml:"target_latency"` // Целевое время хэширования для auto_cost
+		MinCost       int           `yaml:"min_cost"`       // Нижняя граница сложности для auto_cost
 	} `yaml:"password"`
 
+	MFA struct {
+		TOTP struct {
+			Issuer        string        `yaml:"issuer"`         // Название сервиса в приложении-аутентификаторе
+			Digits        int           `yaml:"digits"`         // Длина кода, по умолчанию 6
+			Period        time.Duration `yaml:"period"`         // Шаг времени, по умолчанию 30s
+			Skew          *int          `yaml:"skew"`           // Допустимое расхождение в шагах, по умолчанию 1
+			Algorithm     string        `yaml:"algorithm"`      // SHA1 (по умолчанию), SHA256 или SHA512
+			MaxAttempts   int           `yaml:"max_attempts"`   // Неудачных попыток до блокировки второго фактора, по умолчанию 5
+			AttemptWindow time.Duration `yaml:"attempt_window"` // Окно подсчёта неудачных попыток, по умолчанию 15m
+		} `yaml:"totp"`
+	} `yaml:"mfa"`
+
+	WebAuthn struct {
+		RPID             string        `yaml:"rp_id"`             // Домен проверяющей стороны
+		RPName           string        `yaml:"rp_name"`           // Название сервиса для пользователя
+		Origins          []string      `yaml:"origins"`           // Разрешённые origin, по умолчанию https://<rp_id>
+		Timeout          time.Duration `yaml:"timeout"`           // Время на церемонию, по умолчанию 5m
+		UserVerification string        `yaml:"user_verification"` // required, preferred (по умолчанию) или discouraged
+		Attestation      string        `yaml:"attestation"`       // none (по умолчанию) или direct
+	} `yaml:"webauthn"`
+
+	OAuth struct {
+		Issuer     string        `yaml:"issuer"`      // claim iss в выдаваемых токенах
+		CodeTTL    time.Duration `yaml:"code_ttl"`    // Время жизни кода авторизации, по умолчанию 1m
+		RefreshTTL time.Duration `yaml:"refresh_ttl"` // Время жизни refresh token, по умолчанию 720h
+		LoginURL   string        `yaml:"login_url"`   // Страница входа для /authorize без сессии
+	} `yaml:"oauth"`
+
+	IdentityProvider struct {
+		Issuer          string        `yaml:"issuer"`           // Внешний OIDC-провайдер, токены которого принимает CheckPermissions
+		Audience        string        `yaml:"audience"`         // Ожидаемый aud, обычно client_id этого сервиса у провайдера
+		JWKSURI         string        `yaml:"jwks_uri"`         // Адрес JWKS, по умолчанию из discovery
+		RefreshInterval time.Duration `yaml:"refresh_interval"` // Как часто перечитывать JWKS, по умолчанию 1h
+	} `yaml:"identity_provider"`
+
+	LDAP struct {
+		URL          string        `yaml:"url"`                // ldaps://host:636 или ldap://host:389; пусто - вход по локальным паролям
+		BindDN       string        `yaml:"bind_dn"`            // Служебная учётка для поиска пользователей, пусто - анонимный поиск
+		BindPassword string        `yaml:"bind_password"`      // Пароль служебной учётки
+		BaseDN       string        `yaml:"base_dn"`            // Где искать пользователей
+		UserFilter   string        `yaml:"user_filter"`        // По умолчанию (uid={username})
+		IDAttr       string        `yaml:"id_attribute"`       // Постоянный атрибут записи для user_id, по умолчанию entryUUID
+		NameAttr     string        `yaml:"username_attribute"` // Атрибут с каноническим именем, по умолчанию uid
+		GroupBaseDN  string        `yaml:"group_base_dn"`      // Где искать группы; пусто - только атрибут memberOf
+		GroupFilter  string        `yaml:"group_filter"`       // По умолчанию (|(member={dn})(uniqueMember={dn}))
+		CAFile       string        `yaml:"ca_file"`            // Корневые сертификаты для ldaps://, по умолчанию системные
+		Timeout      time.Duration `yaml:"timeout"`            // Время на весь вход, по умолчанию 10s
+	} `yaml:"ldap"`
+
 	Cache struct {
 		TokenTTL      time.Duration `yaml:"token_ttl"`
 		PasswordTTL   time.Duration `yaml:"password_ttl"`
 		PermissionTTL time.Duration `yaml:"permission_ttl"`
+
+		// Максимальное число записей в кэшах, 0 - значение по умолчанию
+		TokenMaxEntries      int `yaml:"token_max_entries"`
+		PasswordMaxEntries   int `yaml:"password_max_entries"`
+		PermissionMaxEntries int `yaml:"permission_max_entries"`
+
+		// Ограничение суммарного размера записей в байтах (оценка), 0 - без ограничения
+		TokenMaxBytes      int64 `yaml:"token_max_bytes"`
+		PasswordMaxBytes   int64 `yaml:"password_max_bytes"`
+		PermissionMaxBytes int64 `yaml:"permission_max_bytes"`
+
+		Shards int `yaml:"shards"` // Число шардов кэшей в памяти, 0 - без шардирования
+
+		Backend  string        `yaml:"backend"`   // memory (по умолчанию) или redis
+		Prefix   string        `yaml:"prefix"`    // Префикс ключей в общем хранилище
+		LocalTTL time.Duration `yaml:"local_ttl"` // Сколько держать локальную копию записи из общего хранилища
+
+		Redis struct {
+			Addr     string `yaml:"addr"`
+			Password string `yaml:"password"`
+			DB       int    `yaml:"db"`
+			Channel  string `yaml:"channel"` // Канал для рассылки инвалидаций между репликами
+
+			Timeout  time.Duration `yaml:"timeout"`   // Время на команду, по умолчанию 500ms
+			PoolSize int           `yaml:"pool_size"` // Число соединений для команд, по умолчанию 8
+		} `yaml:"redis"`
 	} `yaml:"cache"`
 }
 
+type ExtractorConfig struct {
+	Type   string `yaml:"type"`   // bearer, header, cookie или query
+	Name   string `yaml:"name"`   // Имя заголовка, cookie или параметра запроса
+	Scheme string `yaml:"scheme"` // Схема для header, например Bearer или Token
+}
+
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
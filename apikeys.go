@@ -0,0 +1,516 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultAPIKeyPrefix = "ak"
+	apiKeyIDSize        = 8
+	apiKeySecretSize    = 32
+)
+
+var (
+	ErrAPIKeyInvalid  = errors.New("api key is invalid")
+	ErrAPIKeyExpired  = errors.New("api key expired")
+	ErrAPIKeyRevoked  = errors.New("api key revoked")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+// APIKey - долгоживущий ключ машинного клиента. Сам ключ не хранится, только его SHA-256:
+// в отличие от пароля он случайный и длинный, перебор по хэшу бесполезен.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	OwnerID   int        `json:"owner_id,omitempty"` // Пользователь, от имени которого работает ключ
+	Sections  []string   `json:"sections,omitempty"` // Имена секций роли; пусто - все секции роли
+	Hash      string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// APIKeyRequest - параметры нового ключа
+type APIKeyRequest struct {
+	Name     string        `json:"name"`
+	Role     string        `json:"role"`
+	OwnerID  int           `json:"owner_id"`
+	Sections []string      `json:"sections"`
+	TTL      time.Duration `json:"ttl"` // 0 - бессрочный. В JSON - секунды числом или строка вида "720h"
+}
+
+func (req *APIKeyRequest) UnmarshalJSON(data []byte) error {
+	type plain APIKeyRequest
+	var raw struct {
+		plain
+		TTL json.RawMessage `json:"ttl"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*req = APIKeyRequest(raw.plain)
+	req.TTL = 0
+	if len(raw.TTL) == 0 || string(raw.TTL) == "null" {
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(raw.TTL, &seconds); err == nil {
+		req.TTL = time.Duration(seconds * float64(time.Second))
+	} else {
+		var s string
+		if err := json.Unmarshal(raw.TTL, &s); err != nil {
+			return errors.New("ttl must be seconds or a duration string")
+		}
+		if req.TTL, err = time.ParseDuration(s); err != nil {
+			return err
+		}
+	}
+	if req.TTL < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	return nil
+}
+
+// APIKeyStore хранит ключи машинных клиентов
+type APIKeyStore interface {
+	SaveAPIKey(ctx context.Context, key *APIKey) error
+	APIKeyByID(ctx context.Context, id string) (*APIKey, error) // ErrAPIKeyNotFound, если нет
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+// CreateAPIKey выпускает ключ вида <prefix>_<id>_<secret>. Открытое значение возвращается
+// только здесь, в хранилище попадает хэш.
+func (a *Authenticator) CreateAPIKey(ctx context.Context, req APIKeyRequest) (string, *APIKey, error) {
+	if a.APIKeys == nil {
+		return "", nil, errors.New("api key store is not configured")
+	}
+	if err := a.validateAPIKeyRole(req.Role, req.Sections); err != nil {
+		return "", nil, err
+	}
+
+	id := make([]byte, apiKeyIDSize)
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	key := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      req.Name,
+		Role:      req.Role,
+		OwnerID:   req.OwnerID,
+		Sections:  req.Sections,
+		CreatedAt: time.Now(),
+	}
+	if req.TTL > 0 {
+		expires := key.CreatedAt.Add(req.TTL)
+		key.ExpiresAt = &expires
+	}
+	plaintext := a.apiKeyPrefix() + "_" + key.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashAPIKey(plaintext)
+
+	if err := a.APIKeys.SaveAPIKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+	return plaintext, key, nil
+}
+
+// ListAPIKeys возвращает ключи без хэшей, отсортированные по времени создания
+func (a *Authenticator) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	if a.APIKeys == nil {
+		return nil, errors.New("api key store is not configured")
+	}
+	keys, err := a.APIKeys.ListAPIKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// RevokeAPIKey отзывает ключ и убирает его из кэша, в том числе на других репликах
+func (a *Authenticator) RevokeAPIKey(ctx context.Context, id string) error {
+	if a.APIKeys == nil {
+		return errors.New("api key store is not configured")
+	}
+	key, err := a.APIKeys.APIKeyByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := a.APIKeys.RevokeAPIKey(ctx, id, time.Now()); err != nil {
+		return err
+	}
+	a.APIKeyCache.Delete(key.Hash)
+	return nil
+}
+
+// ResolveAPIKey проверяет ключ и возвращает claims той же формы, что и у JWT
+func (a *Authenticator) ResolveAPIKey(ctx context.Context, plaintext string) (jwt.MapClaims, error) {
+	prefix, rest, ok := strings.Cut(plaintext, "_")
+	if !ok || prefix != a.apiKeyPrefix() {
+		return nil, ErrAPIKeyInvalid
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok || id == "" {
+		return nil, ErrAPIKeyInvalid
+	}
+	hash := hashAPIKey(plaintext)
+
+	claims, err := GetOrLoad(a.APIKeyCache, hash, func() (jwt.MapClaims, time.Duration, error) {
+		key, err := a.APIKeys.APIKeyByID(ctx, id)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return nil, 0, ErrAPIKeyInvalid
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) != 1 {
+			return nil, 0, ErrAPIKeyInvalid
+		}
+		if key.RevokedAt != nil {
+			return nil, 0, ErrAPIKeyRevoked
+		}
+		if key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt) {
+			return nil, 0, ErrAPIKeyExpired
+		}
+
+		claims := jwt.MapClaims{
+			"user_id":    float64(key.OwnerID),
+			"username":   key.Name,
+			"role":       key.Role,
+			"api_key_id": key.ID,
+		}
+		if len(key.Sections) > 0 {
+			sections := make([]interface{}, len(key.Sections))
+			for i, s := range key.Sections {
+				sections[i] = s
+			}
+			claims["sections"] = sections
+		}
+
+		ttl := a.cfg.Cache.TokenTTL
+		if key.ExpiresAt != nil {
+			claims["exp"] = float64(key.ExpiresAt.Unix())
+			if remaining := time.Until(*key.ExpiresAt); remaining < ttl || ttl <= 0 {
+				ttl = remaining
+			}
+		}
+		return claims, ttl, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Как и для JWT, срок проверяется при каждом попадании в кэш
+	if exp, ok := claims["exp"].(float64); ok && time.Now().Unix() >= int64(exp) {
+		return nil, ErrAPIKeyExpired
+	}
+	return claims, nil
+}
+
+// sectionAllowed ограничивает ключ перечисленными секциями роли, а токен клиента
+// OAuth - секциями, имена которых есть в его scope
+func sectionAllowed(claims jwt.MapClaims, section *Section) bool {
+	if _, delegated := claims["client_id"]; delegated {
+		scope, _ := claims["scope"].(string)
+		return containsString(strings.Fields(scope), section.Name)
+	}
+	sections, ok := claims["sections"].([]interface{})
+	if !ok {
+		return true
+	}
+	for _, name := range sections {
+		if name == section.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) validateAPIKeyRole(role string, sections []string) error {
+	a.configMu.RLock()
+	cfg := a.permissionsConfig
+	a.configMu.RUnlock()
+	if cfg == nil {
+		return nil
+	}
+
+	perms, ok := cfg.Roles[role]
+	if !ok {
+		return errors.New("unknown role " + role)
+	}
+	for _, name := range sections {
+		found := false
+		for _, section := range perms.Sections {
+			found = found || section.Name == name
+		}
+		if !found {
+			return errors.New("role " + role + " has no section " + name)
+		}
+	}
+	return nil
+}
+
+// checkAPIKeyGrant не даёт выпустить ключ шире прав вызывающего: роль ключа - своя
+// или из api_keys.assignable_roles, а ключ с ограниченными секциями создаёт ключи
+// только в пределах этих секций
+func (a *Authenticator) checkAPIKeyGrant(claims jwt.MapClaims, req APIKeyRequest) error {
+	role, _ := claims["role"].(string)
+	if req.Role != role {
+		allowed := false
+		for _, r := range a.cfg.APIKeys.AssignableRoles[role] {
+			allowed = allowed || r == req.Role
+		}
+		if !allowed {
+			return errors.New("role " + role + " cannot assign role " + req.Role)
+		}
+		if scopedClaims(claims) {
+			return errors.New("scoped credentials cannot assign other roles")
+		}
+		return nil
+	}
+
+	if !scopedClaims(claims) {
+		return nil
+	}
+	if len(req.Sections) == 0 {
+		return errors.New("scoped credentials cannot create unscoped keys")
+	}
+	for _, name := range req.Sections {
+		if !sectionAllowed(claims, &Section{Name: name}) {
+			return errors.New("section " + name + " is outside the caller's scope")
+		}
+	}
+	return nil
+}
+
+// apiKeyAdmin - вызывающий управляет ключами всех пользователей. Ключам с секциями и
+// токенам клиентов OAuth это не положено, даже если роль в списке
+func (a *Authenticator) apiKeyAdmin(claims jwt.MapClaims) bool {
+	if scopedClaims(claims) {
+		return false
+	}
+	role, _ := claims["role"].(string)
+	for _, r := range a.cfg.APIKeys.AdminRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedClaims - доступ ограничен не только ролью: ключ с секциями или токен клиента OAuth
+func scopedClaims(claims jwt.MapClaims) bool {
+	_, sections := claims["sections"]
+	_, delegated := claims["client_id"]
+	return sections || delegated
+}
+
+func (a *Authenticator) apiKeyFromRequest(r *http.Request) string {
+	if a.APIKeys == nil {
+		return ""
+	}
+	header := a.cfg.APIKeys.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+	return strings.TrimSpace(r.Header.Get(header))
+}
+
+func (a *Authenticator) apiKeyPrefix() string {
+	if a.cfg.APIKeys.Prefix != "" {
+		return a.cfg.APIKeys.Prefix
+	}
+	return defaultAPIKeyPrefix
+}
+
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyError(err error) *AuthError {
+	switch {
+	case errors.Is(err, ErrAPIKeyExpired):
+		return &AuthError{Code: ReasonTokenExpired, Status: http.StatusUnauthorized, Detail: "The API key expired", Err: err}
+	case errors.Is(err, ErrAPIKeyRevoked):
+		return &AuthError{Code: ReasonTokenRevoked, Status: http.StatusUnauthorized, Detail: "The API key was revoked", Err: err}
+	case errors.Is(err, ErrAPIKeyInvalid):
+		return &AuthError{Code: ReasonTokenInvalid, Status: http.StatusUnauthorized, Detail: "The API key is invalid", Err: err}
+	}
+	return &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "API key lookup failed", Err: err}
+}
+
+// MountAPIKeyRoutes подключает управление ключами: POST / (создать), GET / (список),
+// DELETE /{id} (отозвать). Доступ к маршрутам нужно закрыть через CheckPermissions.
+// Список и отзыв касаются только ключей вызывающего, кроме ролей из api_keys.admin_roles.
+func (a *Authenticator) MountAPIKeyRoutes(r chi.Router) {
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserClaimsKey).(jwt.MapClaims)
+		if !ok {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authentication required"})
+			return
+		}
+		role, _ := claims["role"].(string)
+
+		var req APIKeyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Name == "" || req.Role == "" {
+			a.reject(w, r, role, &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Expected JSON with name and role", Err: err})
+			return
+		}
+		if err := a.checkAPIKeyGrant(claims, req); err != nil {
+			a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Cannot create an API key with more access than the caller", Err: err})
+			return
+		}
+		// Ключ работает от имени того, кто его создал
+		userID, _ := claims["user_id"].(float64)
+		req.OwnerID = int(userID)
+
+		plaintext, key, err := a.CreateAPIKey(r.Context(), req)
+		if err != nil {
+			a.reject(w, r, role, &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Failed to create API key", Err: err})
+			return
+		}
+		writeJSON(w, http.StatusCreated, struct {
+			*APIKey
+			Key string `json:"key"`
+		}{key, plaintext})
+	})
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserClaimsKey).(jwt.MapClaims)
+		if !ok {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authentication required"})
+			return
+		}
+		role, _ := claims["role"].(string)
+
+		keys, err := a.ListAPIKeys(r.Context())
+		if err != nil {
+			a.reject(w, r, role, &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Failed to list API keys", Err: err})
+			return
+		}
+		admin := a.apiKeyAdmin(claims)
+		visible := []APIKey{}
+		for _, key := range keys {
+			if admin || ownKey(claims, &key) {
+				visible = append(visible, key)
+			}
+		}
+		writeJSON(w, http.StatusOK, visible)
+	})
+	r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserClaimsKey).(jwt.MapClaims)
+		if !ok {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authentication required"})
+			return
+		}
+		role, _ := claims["role"].(string)
+
+		// Чужой ключ для вызывающего не существует: 404, а не 403, чтобы не раскрывать id
+		key, err := a.apiKeyByID(r.Context(), chi.URLParam(r, "id"))
+		if err == nil && !a.apiKeyAdmin(claims) && !ownKey(claims, key) {
+			err = ErrAPIKeyNotFound
+		}
+		if err == nil {
+			err = a.RevokeAPIKey(r.Context(), key.ID)
+		}
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			a.reject(w, r, role, &AuthError{Code: ReasonBadRequest, Status: http.StatusNotFound, Detail: "API key not found", Err: err})
+			return
+		}
+		if err != nil {
+			a.reject(w, r, role, &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Failed to revoke API key", Err: err})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ownKey - ключ выпущен от имени вызывающего
+func ownKey(claims jwt.MapClaims, key *APIKey) bool {
+	userID, ok := claims["user_id"].(float64)
+	return ok && int(userID) == key.OwnerID
+}
+
+func (a *Authenticator) apiKeyByID(ctx context.Context, id string) (*APIKey, error) {
+	if a.APIKeys == nil {
+		return nil, errors.New("api key store is not configured")
+	}
+	return a.APIKeys.APIKeyByID(ctx, id)
+}
+
+// MemoryAPIKeyStore - APIKeyStore в памяти процесса
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*APIKey
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[string]*APIKey)}
+}
+
+func (s *MemoryAPIKeyStore) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *key
+	s.keys[key.ID] = &copied
+	return nil
+}
+
+func (s *MemoryAPIKeyStore) APIKeyByID(ctx context.Context, id string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (s *MemoryAPIKeyStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+func (s *MemoryAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.RevokedAt = &at
+	return nil
+}
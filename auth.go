@@ -1,21 +1,119 @@
 package access
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	defaultTokenCacheEntries      = 100000
+	defaultPasswordCacheEntries   = 10000
+	defaultPermissionCacheEntries = 10000
+	defaultAPIKeyCacheEntries     = 10000
+	defaultCachePrefix            = "access:"
+	cacheSweepInterval            = time.Minute
+	defaultBasicCacheTTL          = time.Minute
 )
 
 type Authenticator struct {
 	JwtService        *JWTService
 	PasswordHasher    *PasswordHasher
+	dummyHashOnce     sync.Once
+	dummyHashValue    string
 	permissionsConfig *PermissionsConfig
 	configMu          sync.RWMutex
 	cfg               *Config
 
-	// Кэши
-	TokenCache      *memoryCache
-	passwordCache   *memoryCache
-	permissionCache *memoryCache
+	// Кэши, можно заменить собственными реализациями Cache
+	TokenCache      Cache[string, jwt.MapClaims]
+	PasswordCache   Cache[string, bool]
+	PermissionCache Cache[string, bool]
+	RevokedTokens   Cache[string, bool] // jti отозванных токенов, без ограничения размера, с фоновой очисткой
+	// Claims проверенных API-ключей по хэшу ключа. Отдельно от TokenCache, чьи ключи -
+	// сами bearer-токены: иначе Bearer с хэшем из хранилища заменял бы ключ
+	APIKeyCache Cache[string, jwt.MapClaims]
+	// Проверенные claims внешнего провайдера, до правил claim_roles. По той же причине не в TokenCache
+	IdentityCache Cache[string, jwt.MapClaims]
+	cacheBackend  CacheBackend
+	stopSweepers  []func()
+
+	Metrics *Metrics
+
+	// Цепочка извлечения токена из запроса, пробуется по порядку
+	TokenExtractors []TokenExtractor
+
+	// Ответ клиенту при отказе, по умолчанию ProblemErrorHandler
+	ErrorHandler ErrorHandler
+
+	// Поиск пользователей и хуки для обработчиков входа
+	UserLookup UserLookup
+	Hooks      AuthHooks
+
+	// Второй фактор
+	TOTP      *TOTP
+	TOTPStore TOTPStore
+
+	// Вход по ключам WebAuthn
+	WebAuthn            *WebAuthn
+	WebAuthnCredentials WebAuthnCredentialStore
+
+	// Ключи машинных клиентов, принимаются CheckPermissions из заголовка
+	APIKeys APIKeyStore
+
+	// Пользователи для BasicAuth, по умолчанию те же, что и для входа (LDAP или UserLookup)
+	BasicLookup UserLookup
+	// Недавно проверенные пары логин/пароль BasicAuth: bcrypt или bind к LDAP
+	// не выполняются на каждый запрос. Ключ - HMAC пары, пароли в памяти не лежат
+	basicVerified *memoryCache[string, User]
+	basicKeyMAC   []byte
+
+	// Сервер авторизации OAuth 2.0 и реестр его клиентов
+	OAuth        *OAuthServer
+	OAuthClients OAuthClientStore
+
+	// Внешний OIDC-провайдер, чьи токены принимает CheckPermissions
+	IdentityProvider *IdentityProvider
+
+	// Каталог LDAP; если задан, пароли проверяются bind вместо UserLookup
+	LDAP *LDAPDirectory
+
+	logger       atomic.Pointer[slog.Logger]
+	ldapWarnOnce sync.Once
+}
+
+// logFunc - куда компонент пишет сообщения. nil - никуда: библиотека не пишет в
+// глобальный log, сообщения получает только логгер из SetLogger
+type logFunc func(level slog.Level, msg string, args ...any)
+
+func (f logFunc) log(level slog.Level, msg string, args ...any) {
+	if f != nil {
+		f(level, msg, args...)
+	}
+}
+
+// SetLogger задаёт логгер для предупреждений о конфигурации и сбоях внешних систем:
+// общего кэша, JWKS провайдера, каталога LDAP. По умолчанию сообщения не выводятся.
+// Можно вызывать в любой момент, в том числе во время работы
+func (a *Authenticator) SetLogger(logger *slog.Logger) {
+	a.logger.Store(logger)
+}
+
+func (a *Authenticator) log(level slog.Level, msg string, args ...any) {
+	if logger := a.logger.Load(); logger != nil {
+		logger.Log(context.Background(), level, msg, args...)
+	}
 }
 
 func NewAuthenticator(configPath string) (*Authenticator, error) {
@@ -23,19 +121,124 @@ func NewAuthenticator(configPath string) (*Authenticator, error) {
 	if err != nil {
 		return nil, err
 	}
+	// ID token и JWKS подписываются RS256: со случайным ключом на каждой реплике
+	// клиенты не смогли бы проверить токены других реплик
+	if cfg.OAuth.Issuer != "" && cfg.JWT.SigningKeyFile == "" {
+		return nil, errors.New("oauth.issuer requires jwt.signing_key_file")
+	}
 
 	auth := &Authenticator{
 		cfg: cfg,
 	}
+	auth.Metrics = NewMetrics(auth)
+	auth.ErrorHandler = ProblemErrorHandler
+
+	// Вытеснение отзыва по размеру вернуло бы токену силу, поэтому кэш не ограничен.
+	// Отозванные jti обычно больше не читаются, поэтому истёкшие записи убирает фоновая очистка
+	revoked := NewLRUCache[string, bool](0, 0)
+	auth.RevokedTokens = revoked
+	auth.stopSweepers = append(auth.stopSweepers, revoked.StartSweeper(cacheSweepInterval))
+
+	auth.TokenExtractors = []TokenExtractor{BearerExtractor()}
+	if len(cfg.Token.Extractors) > 0 {
+		auth.TokenExtractors = auth.TokenExtractors[:0]
+		for _, ec := range cfg.Token.Extractors {
+			extractor, err := NewTokenExtractor(ec)
+			if err != nil {
+				return nil, err
+			}
+			auth.TokenExtractors = append(auth.TokenExtractors, extractor)
+		}
+	}
+	if cfg.Session.Enabled {
+		auth.TokenExtractors = append(auth.TokenExtractors, CookieExtractor(auth.sessionCookieName()))
+	}
 
 	// Инициализируем кэши из конфига
-	auth.TokenCache = NewCache(cfg.Cache.TokenTTL)
-	auth.passwordCache = NewCache(cfg.Cache.PasswordTTL)
-	auth.permissionCache = NewCache(cfg.Cache.PermissionTTL)
+	if cfg.Cache.Shards > 0 {
+		tokenCache := NewShardedCache[jwt.MapClaims](cfg.Cache.TokenTTL, orDefault(cfg.Cache.TokenMaxEntries, defaultTokenCacheEntries), cfg.Cache.Shards).LimitBytes(cfg.Cache.TokenMaxBytes, claimsEntrySize)
+		passwordCache := NewShardedCache[bool](cfg.Cache.PasswordTTL, orDefault(cfg.Cache.PasswordMaxEntries, defaultPasswordCacheEntries), cfg.Cache.Shards).LimitBytes(cfg.Cache.PasswordMaxBytes, nil)
+		permissionCache := NewShardedCache[bool](cfg.Cache.PermissionTTL, orDefault(cfg.Cache.PermissionMaxEntries, defaultPermissionCacheEntries), cfg.Cache.Shards).LimitBytes(cfg.Cache.PermissionMaxBytes, nil)
+		apiKeyCache := NewShardedCache[jwt.MapClaims](cfg.Cache.TokenTTL, defaultAPIKeyCacheEntries, cfg.Cache.Shards)
+		identityCache := NewShardedCache[jwt.MapClaims](cfg.Cache.TokenTTL, orDefault(cfg.Cache.TokenMaxEntries, defaultTokenCacheEntries), cfg.Cache.Shards)
+		auth.TokenCache, auth.PasswordCache, auth.PermissionCache = tokenCache, passwordCache, permissionCache
+		auth.APIKeyCache, auth.IdentityCache = apiKeyCache, identityCache
+		auth.stopSweepers = append(auth.stopSweepers,
+			tokenCache.StartSweeper(cacheSweepInterval),
+			passwordCache.StartSweeper(cacheSweepInterval),
+			permissionCache.StartSweeper(cacheSweepInterval),
+			apiKeyCache.StartSweeper(cacheSweepInterval),
+			identityCache.StartSweeper(cacheSweepInterval),
+		)
+	} else {
+		auth.TokenCache = NewLRUCache[string, jwt.MapClaims](cfg.Cache.TokenTTL, orDefault(cfg.Cache.TokenMaxEntries, defaultTokenCacheEntries)).LimitBytes(cfg.Cache.TokenMaxBytes, claimsEntrySize)
+		auth.PasswordCache = NewLRUCache[string, bool](cfg.Cache.PasswordTTL, orDefault(cfg.Cache.PasswordMaxEntries, defaultPasswordCacheEntries)).LimitBytes(cfg.Cache.PasswordMaxBytes, nil)
+		auth.PermissionCache = NewLRUCache[string, bool](cfg.Cache.PermissionTTL, orDefault(cfg.Cache.PermissionMaxEntries, defaultPermissionCacheEntries)).LimitBytes(cfg.Cache.PermissionMaxBytes, nil)
+		auth.APIKeyCache = NewLRUCache[string, jwt.MapClaims](cfg.Cache.TokenTTL, defaultAPIKeyCacheEntries)
+		auth.IdentityCache = NewLRUCache[string, jwt.MapClaims](cfg.Cache.TokenTTL, orDefault(cfg.Cache.TokenMaxEntries, defaultTokenCacheEntries))
+	}
+
+	auth.WebAuthn = NewWebAuthn(cfg)
+	auth.OAuth = NewOAuthServer(cfg)
+	if refresh, ok := auth.OAuth.RefreshTokens.(*memoryCache[string, OAuthGrant]); ok {
+		auth.stopSweepers = append(auth.stopSweepers, refresh.StartSweeper(cacheSweepInterval))
+	}
+	if auth.IdentityProvider, err = NewIdentityProvider(cfg); err != nil {
+		return nil, err
+	}
+	if auth.IdentityProvider != nil {
+		auth.IdentityProvider.logger = auth.log
+	}
+	if auth.LDAP, err = NewLDAPDirectory(cfg); err != nil {
+		return nil, err
+	}
+
+	basicTTL := cfg.Basic.CacheTTL
+	if basicTTL <= 0 {
+		basicTTL = defaultBasicCacheTTL
+	}
+	auth.basicVerified = NewLRUCache[string, User](basicTTL, defaultPasswordCacheEntries)
+	auth.basicKeyMAC = auth.cacheKeySecret()
+
+	if cfg.Basic.Htpasswd != "" {
+		if auth.BasicLookup, err = HtpasswdLookup(cfg.Basic.Htpasswd, cfg.Basic.DefaultRole); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Cache.Backend {
+	case "", "memory":
+	case "redis":
+		redis := NewRedisBackend(cfg.Cache.Redis.Addr, cfg.Cache.Redis.Password, cfg.Cache.Redis.DB, cfg.Cache.Redis.Channel)
+		if cfg.Cache.Redis.Timeout > 0 {
+			redis.Timeout = cfg.Cache.Redis.Timeout
+		}
+		if cfg.Cache.Redis.PoolSize > 0 {
+			redis.PoolSize = cfg.Cache.Redis.PoolSize
+		}
+		auth.UseCacheBackend(redis)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Cache.Backend)
+	}
 
 	// Инициализация сервисов с передачей auth
 	auth.JwtService = NewJWTService(cfg.JWT.Secret, cfg, auth)
-	auth.PasswordHasher = NewPasswordHasher(cfg.Password.Cost, auth)
+	if cfg.JWT.SigningKeyFile != "" {
+		key, err := LoadSigningKey(cfg.JWT.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.JwtService.RotateSigningKey(key)
+	}
+	if err := auth.loadEncryptionKey(); err != nil {
+		return nil, err
+	}
+	cost := cfg.Password.Cost
+	if cfg.Password.AutoCost {
+		cost = AutoCost
+	}
+	auth.PasswordHasher = NewPasswordHasher(cost, auth)
+	auth.TOTP = NewTOTP(cfg, auth.PasswordHasher)
 
 	if err := auth.LoadPermissions(cfg.Permissions.Path); err != nil {
 		return nil, err
@@ -58,6 +261,95 @@ func (a *Authenticator) startKeyRotation() {
 	}
 }
 
+// UseCacheBackend переводит кэши токенов и прав на общее хранилище backend.
+// Ключи кэша прав включают хэш файла прав, поэтому реплики с разными файлами его не делят.
+// Кэш паролей остаётся в памяти процесса: в его ключах есть сами пароли,
+// а также коды восстановления и секреты клиентов OAuth
+func (a *Authenticator) UseCacheBackend(backend CacheBackend) {
+	prefix := a.cfg.Cache.Prefix
+	if prefix == "" {
+		prefix = defaultCachePrefix
+	}
+	c := a.cfg.Cache
+
+	for _, stop := range a.stopSweepers {
+		stop()
+	}
+	a.stopSweepers = nil
+	if sweeper, ok := a.PasswordCache.(interface{ StartSweeper(time.Duration) func() }); ok {
+		a.stopSweepers = append(a.stopSweepers, sweeper.StartSweeper(cacheSweepInterval))
+	}
+	a.cacheBackend = backend
+	if redis, ok := backend.(*RedisBackend); ok {
+		redis.setLogger(a.log)
+	}
+	// Ключи кэша токенов - сами bearer-токены, в хранилище они попадают только в виде HMAC
+	a.TokenCache = newBackendCache[jwt.MapClaims](backend, prefix+"token:", c.TokenTTL, c.LocalTTL, orDefault(c.TokenMaxEntries, defaultTokenCacheEntries), a.log).HashKeys(a.cacheKeySecret())
+	a.IdentityCache = newBackendCache[jwt.MapClaims](backend, prefix+"idp:", c.TokenTTL, c.LocalTTL, orDefault(c.TokenMaxEntries, defaultTokenCacheEntries), a.log).HashKeys(a.cacheKeySecret())
+	a.PermissionCache = newBackendCache[bool](backend, prefix+"permission:", c.PermissionTTL, c.LocalTTL, orDefault(c.PermissionMaxEntries, defaultPermissionCacheEntries), a.log)
+	a.RevokedTokens = newBackendCache[bool](backend, prefix+"revoked:", 0, c.LocalTTL, defaultTokenCacheEntries, a.log)
+	// Отзыв ключа должен убрать его из кэша всех реплик
+	a.APIKeyCache = newBackendCache[jwt.MapClaims](backend, prefix+"apikey:", c.TokenTTL, c.LocalTTL, defaultAPIKeyCacheEntries, a.log).HashKeys(a.cacheKeySecret())
+	if a.WebAuthn != nil {
+		// Церемония может начаться и закончиться на разных репликах
+		a.WebAuthn.Sessions = newBackendCache[WebAuthnSession](backend, prefix+"webauthn:", a.WebAuthn.Timeout, 0, defaultWebAuthnSessions, a.log)
+	}
+	if a.OAuth != nil {
+		a.OAuth.Codes = newBackendCache[OAuthGrant](backend, prefix+"oauth_code:", a.OAuth.CodeTTL, 0, defaultOAuthCodes, a.log)
+		a.OAuth.RefreshTokens = newBackendCache[OAuthGrant](backend, prefix+"oauth_refresh:", a.OAuth.RefreshTTL, 0, 0, a.log)
+		a.OAuth.UsedCodes = newBackendCache[string](backend, prefix+"oauth_used:", a.OAuth.RefreshTTL, 0, defaultOAuthCodes, a.log)
+	}
+}
+
+// cacheKeySecret выводит ключ HMAC для ключей общего хранилища из секрета JWT из конфига,
+// одинакового на всех репликах; без него ключ случайный и записи не разделяются
+func (a *Authenticator) cacheKeySecret() []byte {
+	secret := []byte(a.cfg.JWT.Secret)
+	if len(secret) == 0 {
+		secret = []byte(generateRandomSecret())
+	}
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("access cache keys")), key)
+	return key
+}
+
+// basicCacheKey - HMAC-SHA256 пары логин/пароль для кэша проверок BasicAuth
+func (a *Authenticator) basicCacheKey(username, password string) string {
+	mac := hmac.New(sha256.New, a.basicKeyMAC)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close останавливает фоновую очистку кэшей и освобождает соединения с общим хранилищем
+func (a *Authenticator) Close() error {
+	for _, stop := range a.stopSweepers {
+		stop()
+	}
+	if a.cacheBackend != nil {
+		return a.cacheBackend.Close()
+	}
+	return nil
+}
+
+// permissions возвращает текущие права, загружая их при первом обращении
+func (a *Authenticator) permissions() (*PermissionsConfig, error) {
+	a.configMu.RLock()
+	cfg := a.permissionsConfig
+	a.configMu.RUnlock()
+	if cfg != nil {
+		return cfg, nil
+	}
+
+	if err := a.LoadPermissions(a.cfg.Permissions.Path); err != nil {
+		return nil, err
+	}
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.permissionsConfig, nil
+}
+
 func (a *Authenticator) LoadPermissions(path string) error {
 	cfg, err := GetPermissions(path)
 	if err != nil {
@@ -65,7 +357,25 @@ func (a *Authenticator) LoadPermissions(path string) error {
 	}
 
 	a.configMu.Lock()
-	defer a.configMu.Unlock()
 	a.permissionsConfig = cfg
+	a.configMu.Unlock()
+
+	// Решения по старым правам больше не действительны, в том числе на других репликах
+	if a.PermissionCache != nil {
+		a.PermissionCache.Clear()
+	}
 	return nil
 }
+
+// claimsEntrySize - размер записи кэша токенов для token_max_bytes: claims оцениваются
+// как обычная map, EstimateSize о типах jwt не знает
+func claimsEntrySize(token string, claims jwt.MapClaims) int64 {
+	return cacheEntryOverhead + EstimateSize(token) + EstimateSize(map[string]interface{}(claims))
+}
+
+func orDefault(value, def int) int {
+	if value > 0 {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,141 @@
+package access
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// BasicAuth - middleware для клиентов, которые умеют только Authorization: Basic.
+// Пароль проверяется через CheckPasswordHash, дальше работает та же проверка
+// роли и секций, что и в CheckPermissions. Успешная проверка запоминается на
+// basic.cache_ttl; в аудит попадают отказы и новые проверки, а не каждый запрос.
+func (a *Authenticator) BasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := a.permissions()
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Failed to load permissions configuration", Err: err})
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required", Scheme: "Basic"})
+			return
+		}
+
+		event := AuthEvent{Action: "basic", Username: username}
+		cacheKey := a.basicCacheKey(username, password)
+		cached, ok := a.basicVerified.Get(cacheKey)
+		user := &cached
+		// Попытка резервируется только перед настоящей проверкой пароля: успех из кэша
+		// не попадает в аудит и не освободил бы резерв
+		if a.locked(username, !ok) {
+			a.audit(r, event, ReasonAccountLocked)
+			a.reject(w, r, "", &AuthError{Code: ReasonAccountLocked, Status: http.StatusTooManyRequests, Detail: "Too many failed attempts, try again later"})
+			return
+		}
+		if !ok {
+			if a.BasicLookup != nil {
+				user, err = a.authenticateWith(r.Context(), a.BasicLookup, username, password)
+			} else {
+				user, err = a.authenticate(r.Context(), username, password)
+			}
+			if err != nil {
+				authErr := &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: "Invalid username or password", Err: err, Scheme: "Basic"}
+				if !errors.Is(err, errBadCredentials) {
+					authErr = &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "User lookup failed", Err: err}
+				}
+				a.audit(r, event, authErr.Code)
+				a.reject(w, r, "", authErr)
+				return
+			}
+			a.basicVerified.Set(cacheKey, *user)
+			event.UserID = user.ID
+			a.audit(r, event, "")
+		}
+
+		a.authorize(w, r, next, cfg, jwt.MapClaims{
+			"user_id":   float64(user.ID),
+			"username":  user.Username,
+			"role":      user.Role,
+			"amr":       []interface{}{AMRPassword},
+			"auth_time": float64(time.Now().Unix()),
+		})
+	})
+}
+
+// HtpasswdLookup читает файл в формате htpasswd с bcrypt-хэшами. Строка - user:hash,
+// user:hash:role или user:hash:role:id; без роли пользователь получает defaultRole,
+// без id - постоянный идентификатор, выведенный из имени (StableUserID).
+func HtpasswdLookup(path, defaultRole string) (UserLookup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]*User)
+	owners := make(map[int]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 4)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, lineNo)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return nil, fmt.Errorf("%s:%d: only bcrypt entries are supported", path, lineNo)
+		}
+		role := defaultRole
+		if len(parts) >= 3 && parts[2] != "" {
+			role = parts[2]
+		}
+		id := StableUserID(parts[0])
+		if len(parts) == 4 {
+			if id, err = strconv.Atoi(parts[3]); err != nil || id <= 0 {
+				return nil, fmt.Errorf("%s:%d: id must be a positive integer", path, lineNo)
+			}
+		}
+		if owner, taken := owners[id]; taken && owner != parts[0] {
+			return nil, fmt.Errorf("%s:%d: id %d is already used by %s", path, lineNo, id, owner)
+		}
+		owners[id] = parts[0]
+		users[parts[0]] = &User{ID: id, Username: parts[0], Role: role, PasswordHash: hash}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, username string) (*User, error) {
+		user, ok := users[username]
+		if !ok {
+			return nil, nil
+		}
+		copied := *user
+		return &copied, nil
+	}, nil
+}
+
+// StableUserID выводит из строки (имени пользователя, entryUUID) постоянный
+// положительный идентификатор для claim user_id. Значение умещается в 52 бита,
+// чтобы пережить float64 в JSON, и не меняется при перестановке строк в файле.
+func StableUserID(name string) int {
+	sum := sha256.Sum256([]byte(name))
+	return int(binary.BigEndian.Uint64(sum[:8])>>12) + 1
+}
@@ -0,0 +1,208 @@
+package access
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Минимальный кодек BER (X.690) для сообщений LDAPv3 (RFC 4511).
+// Поддерживаются только определённые длины и номера тегов меньше 31 - других LDAP не использует.
+
+const (
+	berClassUniversal   = 0x00
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berConstructed      = 0x20
+
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x10 | berConstructed
+	berTagSet         = 0x11 | berConstructed
+
+	berMaxDepth   = 16
+	berMaxMessage = 16 << 20
+)
+
+var errBERTruncated = errors.New("ber: unexpected end of data")
+
+// berElement - разобранный элемент; у составных заполнен children
+type berElement struct {
+	tag      byte // Класс, флаг составного типа и номер тега, как в первом байте
+	value    []byte
+	children []berElement
+}
+
+func (e berElement) String() string { return string(e.value) }
+
+// Int разбирает INTEGER или ENUMERATED
+func (e berElement) Int() (int64, error) {
+	if len(e.value) == 0 || len(e.value) > 8 {
+		return 0, errors.New("ber: invalid integer")
+	}
+	v := int64(int8(e.value[0]))
+	for _, b := range e.value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+// readBER читает из потока один элемент верхнего уровня
+func readBER(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	if tag&0x1f == 0x1f {
+		return berElement{}, errors.New("ber: high tag numbers are not supported")
+	}
+	length, err := readBERLength(r)
+	if err != nil {
+		return berElement{}, err
+	}
+	if length > berMaxMessage {
+		return berElement{}, fmt.Errorf("ber: message of %d bytes is too large", length)
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return berElement{}, errBERTruncated
+	}
+	return parseBERValue(tag, value, 0)
+}
+
+func readBERLength(r io.ByteReader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, errBERTruncated
+	}
+	if first < 0x80 {
+		return int(first), nil
+	}
+	n := int(first & 0x7f)
+	if n == 0 {
+		return 0, errors.New("ber: indefinite length is not allowed in LDAP")
+	}
+	if n > 4 {
+		return 0, errors.New("ber: length is too large")
+	}
+	length := 0
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errBERTruncated
+		}
+		length = length<<8 | int(b)
+	}
+	return length, nil
+}
+
+// parseBER разбирает элемент из буфера и возвращает число прочитанных байт
+func parseBER(data []byte, depth int) (berElement, int, error) {
+	if len(data) < 2 {
+		return berElement{}, 0, errBERTruncated
+	}
+	tag := data[0]
+	if tag&0x1f == 0x1f {
+		return berElement{}, 0, errors.New("ber: high tag numbers are not supported")
+	}
+	r := &byteReader{data: data[1:]}
+	length, err := readBERLength(r)
+	if err != nil {
+		return berElement{}, 0, err
+	}
+	start := 1 + r.pos
+	if length > len(data)-start {
+		return berElement{}, 0, errBERTruncated
+	}
+	e, err := parseBERValue(tag, data[start:start+length], depth)
+	return e, start + length, err
+}
+
+func parseBERValue(tag byte, value []byte, depth int) (berElement, error) {
+	e := berElement{tag: tag, value: value}
+	if tag&berConstructed == 0 {
+		return e, nil
+	}
+	if depth >= berMaxDepth {
+		return berElement{}, errors.New("ber: nesting too deep")
+	}
+	for pos := 0; pos < len(value); {
+		child, n, err := parseBER(value[pos:], depth+1)
+		if err != nil {
+			return berElement{}, err
+		}
+		e.children = append(e.children, child)
+		pos += n
+	}
+	return e, nil
+}
+
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// berTLV кодирует элемент с готовым содержимым
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func berConstruct(tag byte, children ...[]byte) []byte {
+	var content []byte
+	for _, child := range children {
+		content = append(content, child...)
+	}
+	return berTLV(tag|berConstructed, content)
+}
+
+func berSequence(children ...[]byte) []byte {
+	return berConstruct(berTagSequence, children...)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berInt(tag byte, v int64) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(v)}, content...)
+		// Минимальная запись в дополнительном коде: старший бит байта совпадает со знаком
+		if (v >= -0x80 && v < 0x80) || len(content) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berTLV(tag, content)
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(berTagBoolean, []byte{0xff})
+	}
+	return berTLV(berTagBoolean, []byte{0x00})
+}
@@ -1,67 +1,472 @@
 package access
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
 
-type cacheItem struct {
-	value  interface{}
+// Cache - типизированный кэш с TTL. Authenticator работает с кэшами только
+// через этот интерфейс, поэтому можно подставить собственную реализацию.
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Set(key K, value V)                           // Запись с TTL кэша по умолчанию
+	SetWithTTL(key K, value V, ttl time.Duration) // Запись с собственным TTL
+	Delete(key K)
+	Len() int
+	Range(fn func(key K, value V) bool) // Обход живых записей, false прерывает обход
+	Clear()
+}
+
+// Loader - необязательное расширение Cache. GetOrLoad возвращает значение из кэша,
+// а при промахе вызывает loader один раз на все конкурентные запросы того же ключа.
+// loader возвращает значение и TTL записи, при ttl <= 0 или ошибке значение не кэшируется.
+type Loader[K comparable, V any] interface {
+	GetOrLoad(key K, loader func() (V, time.Duration, error)) (V, error)
+}
+
+// GetOrLoad загружает значение через Loader кэша, а если кэш его не реализует -
+// через Get и SetWithTTL, без схлопывания конкурентных загрузок
+func GetOrLoad[K comparable, V any](cache Cache[K, V], key K, loader func() (V, time.Duration, error)) (V, error) {
+	if l, ok := cache.(Loader[K, V]); ok {
+		return l.GetOrLoad(key, loader)
+	}
+	if value, ok := cache.Get(key); ok {
+		return value, nil
+	}
+	value, ttl, err := loader()
+	if err == nil && ttl > 0 {
+		cache.SetWithTTL(key, value, ttl)
+	}
+	return value, err
+}
+
+// Adder - необязательное расширение Cache. Add атомарно записывает значение,
+// только если живой записи с этим ключом нет, и сообщает, записано ли оно.
+// Ошибка - запись не удалось ни сделать, ни исключить (хранилище недоступно)
+type Adder[K comparable, V any] interface {
+	Add(key K, value V, ttl time.Duration) (bool, error)
+}
+
+// AddIfAbsent записывает значение через Adder кэша, а если кэш его не реализует -
+// через Get и SetWithTTL, без атомарности
+func AddIfAbsent[K comparable, V any](cache Cache[K, V], key K, value V, ttl time.Duration) (bool, error) {
+	if adder, ok := cache.(Adder[K, V]); ok {
+		return adder.Add(key, value, ttl)
+	}
+	if _, ok := cache.Get(key); ok {
+		return false, nil
+	}
+	cache.SetWithTTL(key, value, ttl)
+	return true, nil
+}
+
+// Taker - необязательное расширение Cache. Take атомарно читает и удаляет запись:
+// из конкурентных вызовов с одним ключом значение получает только один
+type Taker[K comparable, V any] interface {
+	Take(key K) (V, bool)
+}
+
+// Take забирает значение через Taker кэша, а если кэш его не реализует -
+// через Get и Delete, без атомарности
+func Take[K comparable, V any](cache Cache[K, V], key K) (V, bool) {
+	if t, ok := cache.(Taker[K, V]); ok {
+		return t.Take(key)
+	}
+	value, ok := cache.Get(key)
+	if ok {
+		cache.Delete(key)
+	}
+	return value, ok
+}
+
+type cacheItem[K comparable, V any] struct {
+	key    K
+	value  V
 	expire time.Time
+	size   int64
+}
+
+// memoryCache - кэш с TTL и вытеснением давно не использованных записей (LRU).
+// maxEntries <= 0 означает отсутствие ограничения на число записей,
+// maxBytes <= 0 - на их суммарный размер.
+type memoryCache[K comparable, V any] struct {
+	mu         sync.Mutex
+	store      map[K]*list.Element
+	order      *list.List // Начало списка - самые свежие записи
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	sizeOf     func(key K, value V) int64
+	counters   cacheCounters
+	flight     flightGroup[K, V]
+
+	sweepMu     sync.Mutex    // Один обход за раз
+	sweepCursor *list.Element // Следующая запись обхода; removeElement и touch сдвигают её
 }
 
-type memoryCache struct {
-	mu    sync.RWMutex
-	store map[string]cacheItem
-	ttl   time.Duration
+var (
+	_ Cache[string, any]  = (*memoryCache[string, any])(nil)
+	_ Loader[string, any] = (*memoryCache[string, any])(nil)
+	_ Adder[string, any]  = (*memoryCache[string, any])(nil)
+	_ StatsProvider       = (*memoryCache[string, any])(nil)
+)
+
+// NewCache создаёт неограниченный кэш с произвольными значениями
+func NewCache(ttl time.Duration) *memoryCache[string, interface{}] {
+	return NewLRUCache[string, interface{}](ttl, 0)
 }
 
-func NewCache(ttl time.Duration) *memoryCache {
-	return &memoryCache{
-		store: make(map[string]cacheItem),
-		ttl:   ttl,
+func NewLRUCache[K comparable, V any](ttl time.Duration, maxEntries int) *memoryCache[K, V] {
+	return &memoryCache[K, V]{
+		store:      make(map[K]*list.Element),
+		order:      list.New(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
 	}
 }
 
-func (c *memoryCache) Get(key string) (interface{}, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// LimitBytes ограничивает суммарный размер записей. sizeOf оценивает размер записи,
+// nil - приблизительная оценка по ключу и значению (EstimateSize).
+// Вызывается до начала работы с кэшем.
+func (c *memoryCache[K, V]) LimitBytes(maxBytes int64, sizeOf func(key K, value V) int64) *memoryCache[K, V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	c.sizeOf = sizeOf
+	return c
+}
+
+func (c *memoryCache[K, V]) Get(key K) (V, bool) {
+	value, ok := c.get(key)
+	if ok {
+		c.counters.hits.Add(1)
+	} else {
+		c.counters.misses.Add(1)
+	}
+	return value, ok
+}
 
-	item, exists := c.store[key]
-	if !exists || time.Now().After(item.expire) {
-		return nil, false
+func (c *memoryCache[K, V]) GetOrLoad(key K, loader func() (V, time.Duration, error)) (V, error) {
+	if value, ok := c.Get(key); ok {
+		return value, nil
 	}
+
+	return c.flight.do(key, func() (V, error) {
+		// Значение могла положить только что завершившаяся загрузка
+		if value, ok := c.get(key); ok {
+			return value, nil
+		}
+
+		value, ttl, err := loader()
+		if err == nil && ttl > 0 {
+			c.SetWithTTL(key, value, ttl)
+		}
+		return value, err
+	})
+}
+
+// get - поиск без учёта в статистике попаданий
+func (c *memoryCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, exists := c.store[key]
+	if !exists {
+		return zero, false
+	}
+	item := el.Value.(*cacheItem[K, V])
+	if time.Now().After(item.expire) {
+		c.removeElement(el)
+		c.counters.expirations.Add(1)
+		return zero, false
+	}
+	c.touch(el)
 	return item.value, true
 }
 
-func (c *memoryCache) Set(key string, value interface{}) {
+func (c *memoryCache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+func (c *memoryCache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.setLocked(key, value, ttl)
+}
 
-	c.store[key] = cacheItem{
-		value:  value,
-		expire: time.Now().Add(c.ttl),
+func (c *memoryCache[K, V]) Add(key K, value V, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, exists := c.store[key]; exists && !time.Now().After(el.Value.(*cacheItem[K, V]).expire) {
+		return false, nil
 	}
+	c.setLocked(key, value, ttl)
+	return true, nil
 }
 
-func (c *memoryCache) Cleanup() {
+func (c *memoryCache[K, V]) Take(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, exists := c.store[key]
+	if !exists {
+		c.counters.misses.Add(1)
+		return zero, false
+	}
+	item := el.Value.(*cacheItem[K, V])
+	c.removeElement(el)
+	if time.Now().After(item.expire) {
+		c.counters.expirations.Add(1)
+		c.counters.misses.Add(1)
+		return zero, false
+	}
+	c.counters.hits.Add(1)
+	return item.value, true
+}
+
+func (c *memoryCache[K, V]) setLocked(key K, value V, ttl time.Duration) {
+	expire := time.Now().Add(ttl)
+	size := c.entrySize(key, value)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		// Запись больше всего кэша вытеснила бы остальные и сама не поместилась
+		if el, exists := c.store[key]; exists {
+			c.removeElement(el)
+		}
+		c.counters.evictions.Add(1)
+		return
+	}
+
+	if el, exists := c.store[key]; exists {
+		item := el.Value.(*cacheItem[K, V])
+		c.bytes += size - item.size
+		item.value = value
+		item.expire = expire
+		item.size = size
+		c.touch(el)
+	} else {
+		c.store[key] = c.order.PushFront(&cacheItem[K, V]{
+			key:    key,
+			value:  value,
+			expire: expire,
+			size:   size,
+		})
+		c.bytes += size
+	}
+
+	// Вытесняем самые давно использованные записи
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		el := c.order.Back()
+		if time.Now().After(el.Value.(*cacheItem[K, V]).expire) {
+			c.counters.expirations.Add(1)
+		} else {
+			c.counters.evictions.Add(1)
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *memoryCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, exists := c.store[key]; exists {
+		c.removeElement(el)
+	}
+}
+
+func (c *memoryCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *memoryCache[K, V]) Stats() CacheStats {
+	c.mu.Lock()
+	size, bytes := c.order.Len(), c.bytes
+	c.mu.Unlock()
+
+	stats := c.counters.snapshot(size)
+	stats.Bytes = bytes
+	return stats
+}
+
+func (c *memoryCache[K, V]) Range(fn func(key K, value V) bool) {
+	// Копируем записи, чтобы не держать блокировку во время вызова fn
+	c.mu.Lock()
+	now := time.Now()
+	items := make([]cacheItem[K, V], 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		item := el.Value.(*cacheItem[K, V])
+		if !now.After(item.expire) {
+			items = append(items, *item)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, item := range items {
+		if !fn(item.key, item.value) {
+			return
+		}
+	}
+}
+
+// StartSweeper раз в interval удаляет истёкшие записи. Нужен кэшам, чьи записи
+// могут больше не читаться (отозванные jti). Возвращает функцию остановки.
+func (c *memoryCache[K, V]) StartSweeper(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.sweep(defaultSweepBatch)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (c *memoryCache[K, V]) Cleanup() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		c.mu.Lock()
 		now := time.Now()
-		for k, v := range c.store {
-			if now.After(v.expire) {
-				delete(c.store, k)
+		for _, el := range c.store {
+			if now.After(el.Value.(*cacheItem[K, V]).expire) {
+				c.removeElement(el)
+				c.counters.expirations.Add(1)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// sweep удаляет истёкшие записи, проверяя не больше batch записей за одно взятие
+// блокировки. Обход идёт от старых записей к новым; между пачками позиция хранится
+// в sweepCursor, который сдвигается, если запись под ним удалили или подняли в начало.
+// Записей проверяется не больше, чем было в кэше на старте, остальные - на следующем обходе.
+func (c *memoryCache[K, V]) sweep(batch int) int {
+	if batch <= 0 {
+		batch = defaultSweepBatch
+	}
+	c.sweepMu.Lock()
+	defer c.sweepMu.Unlock()
+
+	c.mu.Lock()
+	c.sweepCursor = c.order.Back()
+	budget := c.order.Len()
+	c.mu.Unlock()
+
+	removed := 0
+	for budget > 0 {
+		c.mu.Lock()
+		now := time.Now()
+		for n := 0; n < batch && budget > 0 && c.sweepCursor != nil; n, budget = n+1, budget-1 {
+			el := c.sweepCursor
+			c.sweepCursor = el.Prev()
+			if now.After(el.Value.(*cacheItem[K, V]).expire) {
+				c.removeElement(el)
+				c.counters.expirations.Add(1)
+				removed++
 			}
 		}
+		if c.sweepCursor == nil {
+			budget = 0
+		}
 		c.mu.Unlock()
 	}
+
+	c.mu.Lock()
+	c.sweepCursor = nil
+	c.mu.Unlock()
+	return removed
 }
 
-func (c *memoryCache) Clear() {
+// touch поднимает запись в начало списка, не теряя позицию обхода
+func (c *memoryCache[K, V]) touch(el *list.Element) {
+	if el == c.sweepCursor {
+		c.sweepCursor = el.Prev()
+	}
+	c.order.MoveToFront(el)
+}
+
+func (c *memoryCache[K, V]) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.store = make(map[string]cacheItem)
+	c.store = make(map[K]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+	c.sweepCursor = nil
+}
+
+func (c *memoryCache[K, V]) removeElement(el *list.Element) {
+	if el == c.sweepCursor {
+		c.sweepCursor = el.Prev()
+	}
+	item := el.Value.(*cacheItem[K, V])
+	c.order.Remove(el)
+	delete(c.store, item.key)
+	c.bytes -= item.size
+}
+
+// entrySize учитывается только при заданном maxBytes, иначе размер не считается вовсе
+func (c *memoryCache[K, V]) entrySize(key K, value V) int64 {
+	if c.maxBytes <= 0 {
+		return 0
+	}
+	if c.sizeOf != nil {
+		return c.sizeOf(key, value)
+	}
+	return cacheEntryOverhead + EstimateSize(key) + EstimateSize(value)
+}
+
+// cacheEntryOverhead - служебная память записи: элемент списка, cacheItem и ячейка map
+const cacheEntryOverhead = 128
+
+// EstimateSize приблизительно оценивает занимаемую значением память: строки и срезы
+// байт - по длине, map[string]interface{} и списки - рекурсивно, прочие значения - по 16 байт.
+// Для собственных типов значений в LimitBytes передаётся свой sizeOf
+func EstimateSize(v any) int64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 16 + int64(len(v))
+	case []byte:
+		return 24 + int64(len(v))
+	case bool, int8, uint8:
+		return 1
+	case map[string]interface{}:
+		size := int64(48)
+		for key, value := range v {
+			size += EstimateSize(key) + EstimateSize(value)
+		}
+		return size
+	case []interface{}:
+		size := int64(24)
+		for _, item := range v {
+			size += 16 + EstimateSize(item)
+		}
+		return size
+	case []string:
+		size := int64(24)
+		for _, item := range v {
+			size += EstimateSize(item)
+		}
+		return size
+	default:
+		return 16
+	}
 }
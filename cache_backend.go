@@ -0,0 +1,415 @@
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheBackend - байтовое хранилище для кэшей Authenticator. Реализация может
+// быть общей для нескольких реплик; Publish/Subscribe используются для рассылки
+// инвалидаций, чтобы реплики сбрасывали локальные копии записей.
+type CacheBackend interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(keys ...string) error
+	Keys(prefix string) ([]string, error)
+	Publish(message string) error
+	Subscribe(handler func(message string)) error
+	Close() error
+}
+
+// BackendAdder - необязательное расширение CacheBackend: атомарная запись,
+// только если ключа нет (SET NX). Без него backendCache.Add не атомарен между репликами
+type BackendAdder interface {
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// BackendTaker - необязательное расширение CacheBackend: атомарное чтение с удалением
+// (GETDEL). Без него backendCache.Take не атомарен между репликами
+type BackendTaker interface {
+	GetDel(key string) ([]byte, bool, error)
+}
+
+// ErrCacheUnavailable - общее хранилище не ответило, и результат операции неизвестен
+var ErrCacheUnavailable = errors.New("cache backend is unavailable")
+
+const (
+	invalidateDelete = "del "
+	invalidateClear  = "clear "
+)
+
+// MemoryBackend - CacheBackend в памяти процесса, рассылка работает только внутри процесса
+type MemoryBackend struct {
+	store *memoryCache[string, []byte]
+
+	mu       sync.RWMutex
+	handlers []func(string)
+}
+
+func NewMemoryBackend(maxEntries int) *MemoryBackend {
+	return &MemoryBackend{
+		store: NewLRUCache[string, []byte](0, maxEntries),
+	}
+}
+
+func (m *MemoryBackend) Get(key string) ([]byte, bool, error) {
+	value, ok := m.store.Get(key)
+	return value, ok, nil
+}
+
+func (m *MemoryBackend) Set(key string, value []byte, ttl time.Duration) error {
+	m.store.SetWithTTL(key, value, ttl)
+	return nil
+}
+
+func (m *MemoryBackend) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	return m.store.Add(key, value, ttl)
+}
+
+func (m *MemoryBackend) GetDel(key string) ([]byte, bool, error) {
+	value, ok := m.store.Take(key)
+	return value, ok, nil
+}
+
+func (m *MemoryBackend) Delete(keys ...string) error {
+	for _, key := range keys {
+		m.store.Delete(key)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Keys(prefix string) ([]string, error) {
+	var keys []string
+	m.store.Range(func(key string, _ []byte) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, nil
+}
+
+func (m *MemoryBackend) Publish(message string) error {
+	m.mu.RLock()
+	handlers := append([]func(string){}, m.handlers...)
+	m.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Subscribe(handler func(message string)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, handler)
+	return nil
+}
+
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+// backendCache - типизированный Cache поверх CacheBackend. Значения хранятся в JSON,
+// недавно прочитанные записи дополнительно держатся в локальном кэше на localTTL.
+// Если хранилище недоступно, записи остаются только в локальном кэше.
+type backendCache[V any] struct {
+	backend  CacheBackend
+	prefix   string
+	ttl      time.Duration
+	localTTL time.Duration
+	local    *memoryCache[string, V]
+	keyMAC   []byte
+	counters cacheCounters
+	flight   flightGroup[string, V]
+	logger   logFunc // Куда сообщать о сбоях хранилища, задаёт Authenticator
+}
+
+var (
+	_ Cache[string, bool]  = (*backendCache[bool])(nil)
+	_ Loader[string, bool] = (*backendCache[bool])(nil)
+	_ Adder[string, bool]  = (*backendCache[bool])(nil)
+	_ Taker[string, bool]  = (*backendCache[bool])(nil)
+	_ StatsProvider        = (*backendCache[bool])(nil)
+)
+
+func NewBackendCache[V any](backend CacheBackend, prefix string, ttl, localTTL time.Duration, maxLocalEntries int) *backendCache[V] {
+	return newBackendCache[V](backend, prefix, ttl, localTTL, maxLocalEntries, nil)
+}
+
+func newBackendCache[V any](backend CacheBackend, prefix string, ttl, localTTL time.Duration, maxLocalEntries int, logger logFunc) *backendCache[V] {
+	c := &backendCache[V]{
+		backend:  backend,
+		prefix:   prefix,
+		ttl:      ttl,
+		localTTL: localTTL,
+		logger:   logger,
+	}
+	if localTTL > 0 {
+		c.local = NewLRUCache[string, V](localTTL, maxLocalEntries)
+		if err := backend.Subscribe(c.handleInvalidation); err != nil {
+			c.logError(err)
+		}
+	}
+	return c
+}
+
+// HashKeys заменяет ключи на HMAC-SHA256(secret, key), чтобы секреты в ключах
+// (токены) не попадали в общее хранилище. Range тогда возвращает хэши ключей.
+// Вызывается до начала работы с кэшем.
+func (c *backendCache[V]) HashKeys(secret []byte) *backendCache[V] {
+	c.keyMAC = secret
+	return c
+}
+
+func (c *backendCache[V]) storeKey(key string) string {
+	if c.keyMAC == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, c.keyMAC)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *backendCache[V]) Get(key string) (V, bool) {
+	key = c.storeKey(key)
+	var value V
+	if c.local != nil {
+		if value, ok := c.local.Get(key); ok {
+			c.counters.hits.Add(1)
+			return value, true
+		}
+	}
+
+	data, ok, err := c.backend.Get(c.prefix + key)
+	if err != nil {
+		c.logError(err)
+		c.counters.misses.Add(1)
+		return value, false
+	}
+	if !ok {
+		c.counters.misses.Add(1)
+		return value, false
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		c.logError(err)
+		c.counters.misses.Add(1)
+		return value, false
+	}
+	c.counters.hits.Add(1)
+
+	if c.local != nil {
+		c.local.Set(key, value)
+	}
+	return value, true
+}
+
+// GetOrLoad схлопывает загрузки только в пределах реплики
+func (c *backendCache[V]) GetOrLoad(key string, loader func() (V, time.Duration, error)) (V, error) {
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	return c.flight.do(c.storeKey(key), func() (V, error) {
+		value, ttl, err := loader()
+		if err == nil && ttl > 0 {
+			c.SetWithTTL(key, value, ttl)
+		}
+		return value, err
+	})
+}
+
+func (c *backendCache[V]) Set(key string, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+func (c *backendCache[V]) SetWithTTL(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	key = c.storeKey(key)
+
+	// Локальная копия пишется и при ошибке хранилища: без него реплика
+	// работает как с обычным кэшем в памяти
+	if c.local != nil {
+		c.local.SetWithTTL(key, value, min(ttl, c.localTTL))
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		c.logError(err)
+		return
+	}
+	if err := c.backend.Set(c.prefix+key, data, ttl); err != nil {
+		c.logError(err)
+	}
+}
+
+// Add атомарен между репликами, если хранилище реализует BackendAdder. Add служит
+// для отзыва, поэтому при недоступном хранилище не делает вид, что запись сделана:
+// возвращается ErrCacheUnavailable, локальная копия пишется только для этой реплики
+func (c *backendCache[V]) Add(key string, value V, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	storeKey := c.storeKey(key)
+
+	var added bool
+	if adder, ok := c.backend.(BackendAdder); ok {
+		added, err = adder.SetNX(c.prefix+storeKey, data, ttl)
+	} else {
+		var found bool
+		if _, found, err = c.backend.Get(c.prefix + storeKey); err == nil && !found {
+			added, err = true, c.backend.Set(c.prefix+storeKey, data, ttl)
+		}
+	}
+	if err != nil {
+		c.logError(err)
+		if c.local != nil {
+			c.local.SetWithTTL(storeKey, value, min(ttl, c.localTTL))
+		}
+		return false, fmt.Errorf("%w: %v", ErrCacheUnavailable, err)
+	}
+	if added && c.local != nil {
+		c.local.SetWithTTL(storeKey, value, min(ttl, c.localTTL))
+	}
+	return added, nil
+}
+
+// Take атомарен между репликами, если хранилище реализует BackendTaker. Пока хранилище
+// недоступно, записи нет: одноразовые значения не должны приниматься дважды
+func (c *backendCache[V]) Take(key string) (V, bool) {
+	taker, ok := c.backend.(BackendTaker)
+	if !ok {
+		value, found := c.Get(key)
+		if found {
+			c.Delete(key)
+		}
+		return value, found
+	}
+
+	storeKey := c.storeKey(key)
+	var value V
+	if c.local != nil {
+		c.local.Delete(storeKey)
+	}
+	data, found, err := taker.GetDel(c.prefix + storeKey)
+	if err != nil {
+		c.logError(err)
+		c.counters.misses.Add(1)
+		return value, false
+	}
+	if !found {
+		c.counters.misses.Add(1)
+		return value, false
+	}
+	c.publish(invalidateDelete + c.prefix + storeKey)
+	if err := json.Unmarshal(data, &value); err != nil {
+		c.logError(err)
+		c.counters.misses.Add(1)
+		return value, false
+	}
+	c.counters.hits.Add(1)
+	return value, true
+}
+
+func (c *backendCache[V]) Delete(key string) {
+	key = c.storeKey(key)
+	if c.local != nil {
+		c.local.Delete(key)
+	}
+	if err := c.backend.Delete(c.prefix + key); err != nil {
+		c.logError(err)
+	}
+	c.publish(invalidateDelete + c.prefix + key)
+}
+
+func (c *backendCache[V]) Len() int {
+	keys, err := c.backend.Keys(c.prefix)
+	if err != nil {
+		c.logError(err)
+		return 0
+	}
+	return len(keys)
+}
+
+// Stats считает попадания этой реплики; вытеснения и истечения ведёт само хранилище
+func (c *backendCache[V]) Stats() CacheStats {
+	return c.counters.snapshot(c.Len())
+}
+
+func (c *backendCache[V]) Range(fn func(key string, value V) bool) {
+	keys, err := c.backend.Keys(c.prefix)
+	if err != nil {
+		c.logError(err)
+		return
+	}
+
+	for _, key := range keys {
+		data, ok, err := c.backend.Get(key)
+		if err != nil || !ok {
+			continue
+		}
+		var value V
+		if err := json.Unmarshal(data, &value); err != nil {
+			continue
+		}
+		if !fn(strings.TrimPrefix(key, c.prefix), value) {
+			return
+		}
+	}
+}
+
+func (c *backendCache[V]) Clear() {
+	if c.local != nil {
+		c.local.Clear()
+	}
+
+	keys, err := c.backend.Keys(c.prefix)
+	if err != nil {
+		c.logError(err)
+	} else if len(keys) > 0 {
+		if err := c.backend.Delete(keys...); err != nil {
+			c.logError(err)
+		}
+	}
+	c.publish(invalidateClear + c.prefix)
+}
+
+func (c *backendCache[V]) publish(message string) {
+	if err := c.backend.Publish(message); err != nil {
+		c.logError(err)
+	}
+}
+
+// handleInvalidation сбрасывает локальные копии по сообщениям других реплик
+func (c *backendCache[V]) handleInvalidation(message string) {
+	switch {
+	case strings.HasPrefix(message, invalidateDelete):
+		key := strings.TrimPrefix(message, invalidateDelete)
+		if strings.HasPrefix(key, c.prefix) {
+			c.local.Delete(strings.TrimPrefix(key, c.prefix))
+		}
+	case strings.HasPrefix(message, invalidateClear):
+		if strings.TrimPrefix(message, invalidateClear) == c.prefix {
+			c.local.Clear()
+		}
+	}
+}
+
+func (c *backendCache[V]) logError(err error) {
+	c.logger.log(slog.LevelError, "access: cache backend failed", "prefix", c.prefix, "error", err)
+}
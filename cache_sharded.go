@@ -0,0 +1,175 @@
+package access
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShards     = 16
+	defaultSweepBatch = 256 // Сколько записей шарда проверяется за одно взятие блокировки
+)
+
+// shardedCache делит ключи по N независимым memoryCache, чтобы снизить
+// конкуренцию за блокировку. Ограничение размера действует на каждый шард:
+// maxEntries / shards.
+type shardedCache[V any] struct {
+	seed   maphash.Seed
+	shards []*memoryCache[string, V]
+
+	sweepMu   sync.Mutex
+	nextSweep int
+}
+
+var (
+	_ Cache[string, bool]  = (*shardedCache[bool])(nil)
+	_ Loader[string, bool] = (*shardedCache[bool])(nil)
+	_ Adder[string, bool]  = (*shardedCache[bool])(nil)
+	_ Taker[string, bool]  = (*shardedCache[bool])(nil)
+	_ StatsProvider        = (*shardedCache[bool])(nil)
+)
+
+func NewShardedCache[V any](ttl time.Duration, maxEntries, shards int) *shardedCache[V] {
+	if shards <= 0 {
+		shards = defaultShards
+	}
+	perShard := 0
+	if maxEntries > 0 {
+		perShard = (maxEntries + shards - 1) / shards
+	}
+
+	c := &shardedCache[V]{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*memoryCache[string, V], shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewLRUCache[string, V](ttl, perShard)
+	}
+	return c
+}
+
+// LimitBytes делит ограничение суммарного размера поровну между шардами
+func (c *shardedCache[V]) LimitBytes(maxBytes int64, sizeOf func(key string, value V) int64) *shardedCache[V] {
+	perShard := int64(0)
+	if maxBytes > 0 {
+		perShard = (maxBytes + int64(len(c.shards)) - 1) / int64(len(c.shards))
+	}
+	for _, shard := range c.shards {
+		shard.LimitBytes(perShard, sizeOf)
+	}
+	return c
+}
+
+func (c *shardedCache[V]) shard(key string) *memoryCache[string, V] {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+func (c *shardedCache[V]) Get(key string) (V, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *shardedCache[V]) Set(key string, value V) {
+	c.shard(key).Set(key, value)
+}
+
+func (c *shardedCache[V]) SetWithTTL(key string, value V, ttl time.Duration) {
+	c.shard(key).SetWithTTL(key, value, ttl)
+}
+
+func (c *shardedCache[V]) Add(key string, value V, ttl time.Duration) (bool, error) {
+	return c.shard(key).Add(key, value, ttl)
+}
+
+func (c *shardedCache[V]) Take(key string) (V, bool) {
+	return c.shard(key).Take(key)
+}
+
+func (c *shardedCache[V]) GetOrLoad(key string, loader func() (V, time.Duration, error)) (V, error) {
+	return c.shard(key).GetOrLoad(key, loader)
+}
+
+func (c *shardedCache[V]) Delete(key string) {
+	c.shard(key).Delete(key)
+}
+
+func (c *shardedCache[V]) Len() int {
+	n := 0
+	for _, shard := range c.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (c *shardedCache[V]) Range(fn func(key string, value V) bool) {
+	for _, shard := range c.shards {
+		stopped := false
+		shard.Range(func(key string, value V) bool {
+			if !fn(key, value) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+func (c *shardedCache[V]) Clear() {
+	for _, shard := range c.shards {
+		shard.Clear()
+	}
+}
+
+func (c *shardedCache[V]) Stats() CacheStats {
+	var total CacheStats
+	for _, shard := range c.shards {
+		s := shard.Stats()
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.Evictions += s.Evictions
+		total.Expirations += s.Expirations
+		total.Size += s.Size
+		total.Bytes += s.Bytes
+	}
+	return total
+}
+
+// SweepNext удаляет истёкшие записи из очередного шарда, отпуская блокировку
+// каждые defaultSweepBatch записей. Возвращает число удалённых записей.
+func (c *shardedCache[V]) SweepNext() int {
+	c.sweepMu.Lock()
+	shard := c.shards[c.nextSweep]
+	c.nextSweep = (c.nextSweep + 1) % len(c.shards)
+	c.sweepMu.Unlock()
+
+	return shard.sweep(defaultSweepBatch)
+}
+
+// StartSweeper обходит все шарды за interval, по одному шарду за тик.
+// Возвращает функцию остановки.
+func (c *shardedCache[V]) StartSweeper(interval time.Duration) func() {
+	tick := interval / time.Duration(len(c.shards))
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.SweepNext()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
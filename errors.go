@@ -0,0 +1,100 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const defaultRealm = "access"
+
+// AuthError - отказ в аутентификации или авторизации. Code - стабильный машиночитаемый
+// код (совпадает с причиной в метриках), Detail - безопасный для клиента текст,
+// Err - внутренняя причина, клиенту не передаётся.
+type AuthError struct {
+	Code   string
+	Status int
+	Detail string
+	Err    error
+
+	StepUp *StepUpChallenge // Требования повторной аутентификации для step_up_required
+	Scheme string           // Схема WWW-Authenticate для 401: Bearer (по умолчанию), Basic или TLS (без заголовка)
+}
+
+func (e *AuthError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Detail, e.Err)
+	}
+	return e.Code + ": " + e.Detail
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler формирует ответ на отказ; заменяется через Authenticator.ErrorHandler
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err *AuthError)
+
+// Problem - тело ответа application/problem+json (RFC 7807)
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+
+	StepUp *StepUpChallenge `json:"step_up,omitempty"`
+}
+
+// ProblemErrorHandler - обработчик по умолчанию: problem+json и WWW-Authenticate для 401 (RFC 6750)
+func ProblemErrorHandler(w http.ResponseWriter, r *http.Request, err *AuthError) {
+	if err.Status == http.StatusUnauthorized {
+		switch err.Scheme {
+		case "", "Bearer":
+			w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		case "Basic":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, defaultRealm))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:     "urn:access:error:" + err.Code,
+		Title:    http.StatusText(err.Status),
+		Status:   err.Status,
+		Detail:   err.Detail,
+		Instance: r.URL.Path,
+		Code:     err.Code,
+		StepUp:   err.StepUp,
+	})
+}
+
+// bearerChallenge: без токена - только realm, с негодным токеном - error="invalid_token",
+// при step-up - error="insufficient_user_authentication" (RFC 9470)
+func bearerChallenge(err *AuthError) string {
+	if err.Code == ReasonTokenMissing {
+		return fmt.Sprintf(`Bearer realm=%q`, defaultRealm)
+	}
+	if err.StepUp != nil {
+		challenge := fmt.Sprintf(`Bearer realm=%q, error="insufficient_user_authentication", error_description=%q`, defaultRealm, err.Detail)
+		if err.StepUp.MaxAge > 0 {
+			challenge += fmt.Sprintf(", max_age=%d", err.StepUp.MaxAge)
+		}
+		return challenge
+	}
+	return fmt.Sprintf(`Bearer realm=%q, error="invalid_token", error_description=%q`, defaultRealm, err.Detail)
+}
+
+// reject учитывает отказ в метриках и передаёт его в ErrorHandler
+func (a *Authenticator) reject(w http.ResponseWriter, r *http.Request, role string, err *AuthError) {
+	a.Metrics.RecordDecision(role, false, err.Code)
+
+	handler := a.ErrorHandler
+	if handler == nil {
+		handler = ProblemErrorHandler
+	}
+	handler(w, r, err)
+}
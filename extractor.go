@@ -0,0 +1,94 @@
+package access
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenExtractor достаёт токен из запроса; пустая строка означает, что токена нет
+type TokenExtractor interface {
+	ExtractToken(r *http.Request) string
+}
+
+type TokenExtractorFunc func(r *http.Request) string
+
+func (f TokenExtractorFunc) ExtractToken(r *http.Request) string {
+	return f(r)
+}
+
+// HeaderExtractor читает токен из заголовка вида "<scheme> <token>".
+// Схема сравнивается без учёта регистра; при пустой scheme берётся всё значение заголовка.
+func HeaderExtractor(header, scheme string) TokenExtractor {
+	return TokenExtractorFunc(func(r *http.Request) string {
+		value := strings.TrimSpace(r.Header.Get(header))
+		if value == "" || scheme == "" {
+			return value
+		}
+
+		gotScheme, token, ok := strings.Cut(value, " ")
+		if !ok || !strings.EqualFold(gotScheme, scheme) {
+			return ""
+		}
+		token = strings.TrimSpace(token)
+		if strings.ContainsAny(token, " \t") {
+			return ""
+		}
+		return token
+	})
+}
+
+func BearerExtractor() TokenExtractor {
+	return HeaderExtractor("Authorization", "Bearer")
+}
+
+func CookieExtractor(name string) TokenExtractor {
+	return TokenExtractorFunc(func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	})
+}
+
+func QueryExtractor(param string) TokenExtractor {
+	return TokenExtractorFunc(func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	})
+}
+
+// NewTokenExtractor собирает извлекатель по описанию из конфига
+func NewTokenExtractor(cfg ExtractorConfig) (TokenExtractor, error) {
+	switch cfg.Type {
+	case "bearer":
+		return BearerExtractor(), nil
+	case "header":
+		name := cfg.Name
+		if name == "" {
+			name = "Authorization"
+		}
+		return HeaderExtractor(name, cfg.Scheme), nil
+	case "cookie":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("cookie token extractor requires name")
+		}
+		return CookieExtractor(cfg.Name), nil
+	case "query":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("query token extractor requires name")
+		}
+		return QueryExtractor(cfg.Name), nil
+	}
+	return nil, fmt.Errorf("unknown token extractor type %q", cfg.Type)
+}
+
+// extractToken перебирает TokenExtractors по порядку и возвращает первый найденный токен
+func (a *Authenticator) extractToken(r *http.Request) string {
+	for _, extractor := range a.TokenExtractors {
+		if token := extractor.ExtractToken(r); token != "" {
+			return token
+		}
+	}
+	return ""
+}
@@ -0,0 +1,387 @@
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User - учётная запись, по которой выпускается токен
+type User struct {
+	ID           int
+	Username     string
+	Role         string
+	PasswordHash string
+	Disabled     bool
+}
+
+// UserLookup ищет пользователя по имени; (nil, nil) - пользователь не найден
+type UserLookup func(ctx context.Context, username string) (*User, error)
+
+// AuthEvent - запись для аудита входа, обновления токена и выхода
+type AuthEvent struct {
+	Action     string // login, refresh, logout, mfa, webauthn или basic
+	Username   string
+	UserID     int
+	Success    bool
+	Reason     string // Код отказа, пусто при успехе
+	RemoteAddr string
+	Time       time.Time
+}
+
+// AuthHooks - точки расширения обработчиков входа
+type AuthHooks struct {
+	Audit  func(r *http.Request, event AuthEvent) // Вызывается после каждой попытки
+	Locked func(username string) bool             // true - вход временно запрещён
+	// Attempt, если задан, вызывается вместо Locked перед проверкой пароля или кода и
+	// атомарно резервирует попытку: параллельные запросы не проходят проверку сверх
+	// лимита. false - вход временно запрещён. Чем закончилась попытка, сообщает Audit
+	Attempt func(username string) bool
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// dummyHash - хэш для сравнения, когда пользователь не найден: время ответа не выдаёт
+// существование логина. Считается со стоимостью своего PasswordHasher
+func (a *Authenticator) dummyHash() string {
+	a.dummyHashOnce.Do(func() {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("dummy-password"), a.PasswordHasher.Cost())
+		a.dummyHashValue = string(hash)
+	})
+	return a.dummyHashValue
+}
+
+// Lockout - простая блокировка входа после maxFailures неудач подряд за window.
+// Подключается как Hooks.Locked = l.Locked, Hooks.Attempt = l.Attempt и Hooks.Audit = l.Audit.
+type Lockout struct {
+	maxFailures int
+
+	mu       sync.Mutex
+	attempts *memoryCache[string, lockoutState]
+}
+
+type lockoutState struct {
+	Failures int
+	Pending  int // Попытки, зарезервированные Attempt и ещё не завершённые
+}
+
+func NewLockout(maxFailures int, window time.Duration) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		attempts:    NewLRUCache[string, lockoutState](window, defaultPasswordCacheEntries),
+	}
+}
+
+func (l *Lockout) Locked(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, _ := l.attempts.Get(username)
+	return state.Failures >= l.maxFailures
+}
+
+// Attempt резервирует попытку, если неудач вместе с незавершёнными попытками меньше maxFailures
+func (l *Lockout) Attempt(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, _ := l.attempts.Get(username)
+	if state.Failures+state.Pending >= l.maxFailures {
+		return false
+	}
+	state.Pending++
+	l.attempts.Set(username, state)
+	return true
+}
+
+func (l *Lockout) Audit(r *http.Request, event AuthEvent) {
+	if event.Action != "login" && event.Action != "basic" && event.Action != "mfa" {
+		return
+	}
+	if event.Reason == ReasonAccountLocked {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if event.Success {
+		l.attempts.Delete(event.Username)
+		return
+	}
+	state, _ := l.attempts.Get(event.Username)
+	if state.Pending > 0 {
+		state.Pending--
+	}
+	if event.Reason == ReasonBadCredentials {
+		state.Failures++
+	}
+	l.attempts.Set(event.Username, state)
+}
+
+// MountAuthRoutes подключает /login, /refresh, /logout, второй фактор и WebAuthn к роутеру chi
+func (a *Authenticator) MountAuthRoutes(r chi.Router) {
+	r.Post("/login", a.LoginHandler().ServeHTTP)
+	r.Post("/refresh", a.RefreshHandler().ServeHTTP)
+	r.Post("/logout", a.LogoutHandler().ServeHTTP)
+	r.Post("/mfa/totp", a.TOTPHandler().ServeHTTP)
+	r.Post("/webauthn/register/begin", a.WebAuthnRegisterBeginHandler().ServeHTTP)
+	r.Post("/webauthn/register/finish", a.WebAuthnRegisterFinishHandler().ServeHTTP)
+	r.Post("/webauthn/login/begin", a.WebAuthnLoginBeginHandler().ServeHTTP)
+	r.Post("/webauthn/login/finish", a.WebAuthnLoginFinishHandler().ServeHTTP)
+}
+
+// LoginHandler принимает JSON {"username", "password"} и выдаёт токен
+func (a *Authenticator) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req loginRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Username == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Expected JSON with username and password", Err: err})
+			return
+		}
+
+		event := AuthEvent{Action: "login", Username: req.Username}
+		if a.locked(req.Username, true) {
+			a.audit(r, event, ReasonAccountLocked)
+			a.reject(w, r, "", &AuthError{Code: ReasonAccountLocked, Status: http.StatusTooManyRequests, Detail: "Too many failed attempts, try again later"})
+			return
+		}
+
+		user, err := a.authenticate(r.Context(), req.Username, req.Password)
+		if err != nil {
+			authErr := &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: "Invalid username or password", Err: err}
+			if !errors.Is(err, errBadCredentials) {
+				authErr = &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "User lookup failed", Err: err}
+			}
+			a.audit(r, event, authErr.Code)
+			a.reject(w, r, "", authErr)
+			return
+		}
+
+		event.UserID = user.ID
+		a.issueToken(w, r, event, user.ID, user.Username, user.Role, jwt.MapClaims{
+			"amr":       []string{AMRPassword},
+			"auth_time": time.Now().Unix(),
+		})
+	})
+}
+
+const defaultMaxSessionAge = 24 * time.Hour
+
+// RefreshHandler обменивает действующий токен на новый, старый при этом отзывается.
+// Пользователь перечитывается через UserLookup, чтобы отключение или смена роли
+// действовали сразу, а цепочка обновлений ограничена jwt.max_session_age от входа
+func (a *Authenticator) RefreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := a.extractToken(r)
+		if tokenString == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required"})
+			return
+		}
+		claims, err := a.JwtService.ParseJWT(tokenString)
+		if err != nil {
+			a.audit(r, AuthEvent{Action: "refresh"}, tokenError(err).Code)
+			a.reject(w, r, "", tokenError(err))
+			return
+		}
+		if a.cfg.Session.Enabled {
+			if err := a.checkCSRF(r, tokenString, claims); err != nil {
+				a.reject(w, r, "", &AuthError{Code: ReasonCSRFFailed, Status: http.StatusForbidden, Detail: "Invalid CSRF token", Err: err})
+				return
+			}
+		}
+
+		userID, _ := claims["user_id"].(float64)
+		username, _ := claims["username"].(string)
+		role, _ := claims["role"].(string)
+		event := AuthEvent{Action: "refresh", Username: username, UserID: int(userID)}
+
+		// Токен клиента OAuth обновляется через /token, а здесь стал бы сессией пользователя
+		if _, delegated := claims["client_id"]; delegated {
+			a.audit(r, event, ReasonAccessDenied)
+			a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Delegated tokens cannot be refreshed here"})
+			return
+		}
+
+		// У токенов без auth_time началом сессии считается выпуск самого токена
+		authTime, ok := claimTime(claims, "auth_time")
+		if !ok {
+			authTime, _ = claimTime(claims, "iat")
+		}
+		maxAge := a.cfg.JWT.MaxSessionAge
+		if maxAge <= 0 {
+			maxAge = defaultMaxSessionAge
+		}
+		if time.Since(authTime) > maxAge {
+			a.audit(r, event, ReasonTokenExpired)
+			a.reject(w, r, role, &AuthError{Code: ReasonTokenExpired, Status: http.StatusUnauthorized, Detail: "The session expired, sign in again"})
+			return
+		}
+
+		user, err := a.refreshUser(r.Context(), int(userID), username, role)
+		if err != nil {
+			authErr := &AuthError{Code: ReasonAccountDisabled, Status: http.StatusUnauthorized, Detail: "The account is no longer active", Err: err}
+			if !errors.Is(err, errBadCredentials) {
+				authErr = &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "User lookup failed", Err: err}
+			}
+			a.audit(r, event, authErr.Code)
+			a.reject(w, r, role, authErr)
+			return
+		}
+
+		// Отзыв атомарен: из двух одновременных обновлений одного токена проходит одно
+		if err := a.JwtService.RevokeJWT(tokenString); err != nil {
+			a.audit(r, event, tokenError(err).Code)
+			a.reject(w, r, role, tokenError(err))
+			return
+		}
+		// Обновление не считается повторной аутентификацией: сохраняем amr и auth_time
+		extra := jwt.MapClaims{"auth_time": authTime.Unix()}
+		for _, claim := range []string{"amr", "mfa"} {
+			if v, ok := claims[claim]; ok {
+				extra[claim] = v
+			}
+		}
+		a.issueToken(w, r, event, user.ID, user.Username, user.Role, extra)
+	})
+}
+
+// LogoutHandler отзывает текущий токен и удаляет cookie сессии
+func (a *Authenticator) LogoutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := AuthEvent{Action: "logout"}
+		if tokenString := a.extractToken(r); tokenString != "" {
+			if claims, err := a.JwtService.ParseJWT(tokenString); err == nil {
+				if a.cfg.Session.Enabled {
+					if err := a.checkCSRF(r, tokenString, claims); err != nil {
+						a.reject(w, r, "", &AuthError{Code: ReasonCSRFFailed, Status: http.StatusForbidden, Detail: "Invalid CSRF token", Err: err})
+						return
+					}
+				}
+				userID, _ := claims["user_id"].(float64)
+				event.UserID = int(userID)
+				event.Username, _ = claims["username"].(string)
+				// Повторный выход - не ошибка, а вот несохранённый отзыв оставил бы токен в силе
+				if err := a.JwtService.RevokeJWT(tokenString); errors.Is(err, ErrCacheUnavailable) {
+					a.audit(r, event, tokenError(err).Code)
+					a.reject(w, r, "", tokenError(err))
+					return
+				}
+			}
+		}
+
+		if a.cfg.Session.Enabled {
+			a.ClearSessionCookies(w)
+		}
+		a.audit(r, event, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+var errBadCredentials = errors.New("invalid username or password")
+
+// refreshUser перечитывает пользователя токена. Без UserLookup проверить нечего,
+// и используются данные из claims
+func (a *Authenticator) refreshUser(ctx context.Context, userID int, username, role string) (*User, error) {
+	if a.UserLookup == nil {
+		return &User{ID: userID, Username: username, Role: role}, nil
+	}
+	user, err := a.UserLookup(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	// Имя могли отдать другому пользователю после удаления прежнего
+	if user == nil || user.Disabled || user.ID != userID {
+		return nil, errBadCredentials
+	}
+	return user, nil
+}
+
+// authenticate проверяет пароль bind в LDAP, если каталог настроен, иначе через UserLookup и PasswordHasher
+func (a *Authenticator) authenticate(ctx context.Context, username, password string) (*User, error) {
+	if a.LDAP != nil {
+		return a.authenticateLDAP(ctx, username, password)
+	}
+	return a.authenticateWith(ctx, a.UserLookup, username, password)
+}
+
+func (a *Authenticator) authenticateWith(ctx context.Context, lookup UserLookup, username, password string) (*User, error) {
+	if lookup == nil {
+		return nil, errors.New("user lookup is not configured")
+	}
+	user, err := lookup(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := a.dummyHash()
+	if user != nil && !user.Disabled {
+		hash = user.PasswordHash
+	}
+	if !a.PasswordHasher.CheckPasswordHash(password, hash) || user == nil || user.Disabled {
+		return nil, errBadCredentials
+	}
+	return user, nil
+}
+
+func (a *Authenticator) issueToken(w http.ResponseWriter, r *http.Request, event AuthEvent, userID int, username, role string, extra jwt.MapClaims) {
+	token, err := a.JwtService.GenerateJWTWithClaims(userID, username, role, extra)
+	if err == nil && a.cfg.Session.Enabled {
+		var claims jwt.MapClaims
+		if claims, err = a.JwtService.ParseJWT(token); err == nil {
+			a.SetSessionCookies(w, token, claims)
+		}
+	}
+	if err != nil {
+		a.audit(r, event, ReasonConfigError)
+		a.reject(w, r, role, &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Failed to issue token", Err: err})
+		return
+	}
+
+	a.audit(r, event, "")
+	writeJSON(w, http.StatusOK, TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(a.cfg.JWT.TTL / time.Second),
+	})
+}
+
+// locked спрашивает хуки, разрешён ли вход. attempt - перед проверкой пароля или кода:
+// тогда попытку резервирует Hooks.Attempt, если он задан
+func (a *Authenticator) locked(username string, attempt bool) bool {
+	if attempt && a.Hooks.Attempt != nil {
+		return !a.Hooks.Attempt(username)
+	}
+	return a.Hooks.Locked != nil && a.Hooks.Locked(username)
+}
+
+func (a *Authenticator) audit(r *http.Request, event AuthEvent, reason string) {
+	if a.Hooks.Audit == nil {
+		return
+	}
+	event.Success = reason == ""
+	event.Reason = reason
+	event.RemoteAddr = r.RemoteAddr
+	event.Time = time.Now()
+	a.Hooks.Audit(r, event)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
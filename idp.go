@@ -0,0 +1,291 @@
+package access
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultJWKSRefresh       = time.Hour
+	defaultUnknownKeyRefetch = time.Minute
+	defaultRoleClaim         = "groups"
+)
+
+var (
+	ErrProviderUnavailable = errors.New("identity provider is unavailable")
+	ErrUnknownSigningKey   = errors.New("token is signed with an unknown key")
+)
+
+// ClaimRoleRule назначает роль токенам внешнего провайдера по значению claim.
+// Value - шаблон path.Match, для claim-списков достаточно совпадения одного элемента.
+type ClaimRoleRule struct {
+	Claim string `yaml:"claim"` // Claim провайдера, по умолчанию groups
+	Value string `yaml:"value"`
+	Role  string `yaml:"role"`
+}
+
+// IdentityProvider проверяет токены внешнего OIDC-провайдера (режим relying party)
+// по ключам из его JWKS
+type IdentityProvider struct {
+	Issuer            string
+	Audience          string
+	JWKSURI           string        // Пусто - адрес берётся из discovery провайдера
+	RefreshInterval   time.Duration // Как часто перечитывать JWKS
+	UnknownKeyRefetch time.Duration // Не чаще перечитывать JWKS из-за неизвестного kid
+	Client            *http.Client
+
+	mu      sync.RWMutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	loads   flightGroup[string, map[string]*rsa.PublicKey]
+	logger  logFunc // Куда сообщать о сбоях обновления JWKS, задаёт Authenticator
+}
+
+// NewIdentityProvider возвращает nil, если внешний провайдер не настроен
+func NewIdentityProvider(cfg *Config) (*IdentityProvider, error) {
+	c := cfg.IdentityProvider
+	if c.Issuer == "" {
+		return nil, nil
+	}
+	if c.Audience == "" {
+		return nil, errors.New("identity_provider: audience is required")
+	}
+
+	p := &IdentityProvider{
+		Issuer:            strings.TrimSuffix(c.Issuer, "/"),
+		Audience:          c.Audience,
+		JWKSURI:           c.JWKSURI,
+		RefreshInterval:   c.RefreshInterval,
+		UnknownKeyRefetch: defaultUnknownKeyRefetch,
+		Client:            &http.Client{Timeout: 10 * time.Second},
+	}
+	if p.RefreshInterval <= 0 {
+		p.RefreshInterval = defaultJWKSRefresh
+	}
+	return p, nil
+}
+
+// Issued сообщает, выпущен ли токен этим провайдером. Подпись не проверяется -
+// только выбор, чем проверять токен дальше
+func (p *IdentityProvider) Issued(tokenString string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return false
+	}
+	iss, _ := claims["iss"].(string)
+	return iss != "" && strings.TrimSuffix(iss, "/") == p.Issuer
+}
+
+// Verify проверяет подпись RS256, iss, aud и exp токена провайдера
+func (p *IdentityProvider) Verify(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		var ve *jwt.ValidationError
+		switch {
+		case errors.Is(err, ErrProviderUnavailable):
+			return nil, err
+		case errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired:
+			return nil, ErrTokenExpired
+		}
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrTokenInvalid
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrTokenInvalid)
+	}
+	if !claims.VerifyAudience(p.Audience, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrTokenInvalid)
+	}
+	if _, ok := claimsExpiry(claims); !ok {
+		return nil, fmt.Errorf("%w: exp is required", ErrTokenInvalid)
+	}
+	return claims, nil
+}
+
+// key ищет ключ по kid; неизвестный kid означает, что провайдер мог сменить ключ
+func (p *IdentityProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.RLock()
+	keys, fetched := p.keys, p.fetched
+	p.mu.RUnlock()
+
+	age := time.Since(fetched)
+	if key := lookupKey(keys, kid); key != nil && age < p.RefreshInterval {
+		return key, nil
+	}
+	// Подделанные kid не должны превращаться в запросы к провайдеру на каждый вызов
+	if keys != nil && age < p.RefreshInterval && age < p.UnknownKeyRefetch {
+		return nil, ErrUnknownSigningKey
+	}
+
+	fresh, err := p.loads.do("jwks", p.fetchKeys)
+	if err != nil {
+		// Пока провайдер недоступен, устаревший JWKS лучше, чем отказ всем пользователям
+		if key := lookupKey(keys, kid); key != nil {
+			p.logger.log(slog.LevelWarn, "access: refreshing JWKS failed, using cached keys", "issuer", p.Issuer, "error", err)
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	if key := lookupKey(fresh, kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// lookupKey допускает токены без kid, если у провайдера единственный ключ
+func lookupKey(keys map[string]*rsa.PublicKey, kid string) *rsa.PublicKey {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+func (p *IdentityProvider) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	uri := p.JWKSURI
+	if uri == "" {
+		var doc OIDCDiscovery
+		if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+			return nil, err
+		}
+		// OpenID Connect Discovery 1.0, §4.3: issuer документа обязан совпадать
+		if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer || doc.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document of %s does not match the issuer", p.Issuer)
+		}
+		uri = doc.JWKSURI
+	}
+
+	var set JSONWebKeySet
+	if err := p.getJSON(uri, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		key, err := jwk.RSAPublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS at %s has no RS256 signing keys", uri)
+	}
+
+	p.mu.Lock()
+	p.keys, p.fetched = keys, time.Now()
+	p.mu.Unlock()
+	return keys, nil
+}
+
+func (p *IdentityProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// parseIdentityToken - ParseJWT для токенов внешнего провайдера: claims кэшируются
+// не дольше срока действия токена
+func (a *Authenticator) parseIdentityToken(tokenString string) (jwt.MapClaims, error) {
+	claims, err := GetOrLoad(a.IdentityCache, tokenString, func() (jwt.MapClaims, time.Duration, error) {
+		claims, err := a.IdentityProvider.Verify(tokenString)
+		if err != nil {
+			return nil, 0, err
+		}
+		return claims, a.JwtService.claimsTTL(claims), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		a.IdentityCache.Delete(tokenString)
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// identityClaims переводит claims провайдера в claims той же формы, что и у своих JWT.
+// Роль назначают только правила claim_roles, собственный claim role провайдера не учитывается
+func identityClaims(rules []ClaimRoleRule, idp jwt.MapClaims) (jwt.MapClaims, bool) {
+	rule := matchClaimRoleRule(rules, idp)
+	if rule == nil {
+		return nil, false
+	}
+
+	claims := jwt.MapClaims{
+		"user_id":  float64(0),
+		"username": idp["sub"],
+		"role":     rule.Role,
+	}
+	for _, name := range []string{"preferred_username", "email"} {
+		if v, _ := idp[name].(string); v != "" {
+			claims["username"] = v
+			break
+		}
+	}
+	for _, name := range []string{"iss", "sub", "aud", "exp", "iat", "jti", "auth_time", "amr", "acr", "email"} {
+		if v, ok := idp[name]; ok {
+			claims[name] = v
+		}
+	}
+	return claims, true
+}
+
+func matchClaimRoleRule(rules []ClaimRoleRule, claims jwt.MapClaims) *ClaimRoleRule {
+	for i, rule := range rules {
+		if rule.Role == "" || rule.Value == "" {
+			continue
+		}
+		name := rule.Claim
+		if name == "" {
+			name = defaultRoleClaim
+		}
+
+		var values []string
+		switch v := claims[name].(type) {
+		case string:
+			values = []string{v}
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					values = append(values, s)
+				}
+			}
+		}
+		for _, value := range values {
+			if ok, _ := path.Match(rule.Value, value); ok {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
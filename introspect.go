@@ -0,0 +1,129 @@
+package access
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// IntrospectionResponse - ответ конечной точки интроспекции (RFC 7662, §2.2).
+// Для недействительного токена заполнено только active=false
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// OAuthIntrospectHandler проверяет токен по запросу другого сервиса (RFC 7662): access token -
+// подпись, срок и отзыв, как в CheckPermissions; refresh token - только для клиента, которому он выдан.
+// Вызывать могут только конфиденциальные клиенты с флагом ResourceServer: иначе любой клиент
+// узнавал бы роль и имя владельца чужих токенов, а публичный ещё и перебирал бы их
+func (a *Authenticator) OAuthIntrospectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			(&oauthError{Code: "invalid_request", Description: "malformed form body"}).write(w)
+			return
+		}
+		client, oerr := a.authenticateClient(r)
+		if oerr != nil {
+			oerr.write(w)
+			return
+		}
+		if client.Public || !client.ResourceServer {
+			(&oauthError{Code: "invalid_client", Description: "only resource servers can introspect tokens", status: http.StatusUnauthorized}).write(w)
+			return
+		}
+
+		token := r.PostForm.Get("token")
+		if token == "" {
+			(&oauthError{Code: "invalid_request", Description: "token is required"}).write(w)
+			return
+		}
+
+		// token_type_hint лишь задаёт порядок поиска (RFC 7662, §2.1)
+		lookups := []func(string, *OAuthClient) (IntrospectionResponse, bool){a.introspectAccessToken, a.introspectRefreshToken}
+		if r.PostForm.Get("token_type_hint") == "refresh_token" {
+			lookups[0], lookups[1] = lookups[1], lookups[0]
+		}
+		for _, lookup := range lookups {
+			if resp, ok := lookup(token, client); ok {
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, IntrospectionResponse{Active: false})
+	})
+}
+
+func (a *Authenticator) introspectAccessToken(token string, _ *OAuthClient) (IntrospectionResponse, bool) {
+	start := time.Now()
+	claims, err := a.JwtService.ParseJWT(token)
+	a.Metrics.ObserveTokenValidation(time.Since(start), err == nil)
+	if err != nil {
+		return IntrospectionResponse{}, false
+	}
+
+	resp := IntrospectionResponse{
+		Active:    true,
+		Scope:     stringClaim(claims, "scope"),
+		ClientID:  stringClaim(claims, "client_id"),
+		Username:  stringClaim(claims, "username"),
+		TokenType: "Bearer",
+		Iss:       stringClaim(claims, "iss"),
+		Jti:       stringClaim(claims, "jti"),
+		Role:      stringClaim(claims, "role"),
+		Sub:       claimsSubject(claims),
+	}
+	if exp, ok := claimsExpiry(claims); ok {
+		resp.Exp = exp.Unix()
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		resp.Iat = int64(iat)
+	}
+	return resp, true
+}
+
+func (a *Authenticator) introspectRefreshToken(token string, client *OAuthClient) (IntrospectionResponse, bool) {
+	grant, ok := a.OAuth.RefreshTokens.Get(hashOpaqueToken(token))
+	if !ok || grant.ClientID != client.ID {
+		return IntrospectionResponse{}, false
+	}
+	if grant.ExpiresAt != 0 && time.Now().Unix() >= grant.ExpiresAt {
+		return IntrospectionResponse{}, false
+	}
+	// Цепочка отозвана (повторное использование refresh token), хотя сам токен ещё в кэше
+	if a.grantRevoked(grant.GrantID) {
+		return IntrospectionResponse{}, false
+	}
+	return IntrospectionResponse{
+		Active:   true,
+		Scope:    grant.Scope,
+		ClientID: grant.ClientID,
+		Username: grant.Username,
+		Exp:      grant.ExpiresAt,
+		Sub:      strconv.Itoa(grant.UserID),
+		Iss:      a.OAuth.Issuer,
+		Role:     grant.Role,
+	}, true
+}
+
+// claimsSubject - sub как в ID token; у токенов client_credentials субъект - сам клиент
+func claimsSubject(claims jwt.MapClaims) string {
+	if userID, _ := claims["user_id"].(float64); userID > 0 {
+		return strconv.Itoa(int(userID))
+	}
+	if clientID := stringClaim(claims, "client_id"); clientID != "" {
+		return clientID
+	}
+	return stringClaim(claims, "username")
+}
@@ -0,0 +1,224 @@
+package access
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Вложенные токены JWE (RFC 7516): подписанный JWT шифруется целиком, поэтому claims
+// не видны никому, кроме сервиса с ключом. Содержимое - A256GCM, ключ содержимого - dir
+// (выводится из HMAC-секретов и меняется вместе с ними) или RSA-OAEP.
+
+const (
+	JWEAlgDir     = "dir"
+	JWEAlgRSAOAEP = "RSA-OAEP"
+	jweEncA256GCM = "A256GCM"
+	jweKeySize    = 32
+)
+
+var errJWEMalformed = errors.New("jwe: malformed token")
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// encryptionKey - ключ RSA-OAEP; в отличие от ключей подписи не публикуется в JWKS
+type encryptionKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// RotateEncryptionKey делает key текущим ключом RSA-OAEP; прежние расшифровывают
+// уже выданные токены, пока их не вытеснит old_keys_to_keep
+func (j *JWTService) RotateEncryptionKey(key *rsa.PrivateKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	keep := j.cfg.JWT.OldKeysToKeep
+	if len(j.encryptionKeys) > keep {
+		j.encryptionKeys = j.encryptionKeys[:keep]
+	}
+	j.encryptionKeys = append([]encryptionKey{{kid: keyID(&key.PublicKey), key: key}}, j.encryptionKeys...)
+}
+
+// loadEncryptionKey проверяет jwt.encryption и загружает ключ RSA-OAEP; без key_file
+// ключ создаётся на время жизни процесса
+func (a *Authenticator) loadEncryptionKey() error {
+	enc := a.cfg.JWT.Encryption
+	switch enc.Alg {
+	case "", JWEAlgDir:
+		return nil
+	case JWEAlgRSAOAEP:
+	default:
+		return fmt.Errorf("jwt.encryption: unsupported alg %q", enc.Alg)
+	}
+
+	// Случайный ключ на каждой реплике сделал бы токены нечитаемыми для остальных
+	// и после перезапуска, поэтому ключ обязателен
+	if enc.KeyFile == "" {
+		return errors.New("jwt.encryption: RSA-OAEP requires key_file")
+	}
+	key, err := LoadSigningKey(enc.KeyFile)
+	if err != nil {
+		return err
+	}
+	a.JwtService.RotateEncryptionKey(key)
+	return nil
+}
+
+// isJWE - компактная сериализация JWE состоит из пяти частей, JWS - из трёх
+func isJWE(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// encryptLocked шифрует подписанный токен; вызывается под j.mu
+func (j *JWTService) encryptLocked(signed string) (string, error) {
+	header := jweHeader{Alg: j.cfg.JWT.Encryption.Alg, Enc: jweEncA256GCM, Cty: "JWT"}
+
+	var cek, encryptedKey []byte
+	switch header.Alg {
+	case JWEAlgDir:
+		cek = jweDirKey(j.CurrentSecret)
+	case JWEAlgRSAOAEP:
+		if len(j.encryptionKeys) == 0 {
+			return "", errors.New("jwe: no RSA-OAEP encryption key")
+		}
+		current := j.encryptionKeys[0]
+		header.Kid = current.kid
+		cek = make([]byte, jweKeySize)
+		if _, err := rand.Read(cek); err != nil {
+			return "", err
+		}
+		var err error
+		// RSA-OAEP по RFC 7518, §4.3 - SHA-1 и MGF1 с SHA-1
+		if encryptedKey, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, &current.key.PublicKey, cek, nil); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("jwe: unsupported alg %q", header.Alg)
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerJSON)
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	// Защищённый заголовок входит в AAD, поэтому подменить alg или kid нельзя
+	sealed := gcm.Seal(nil, iv, []byte(signed), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decryptLocked возвращает вложенный подписанный токен; вызывается под j.mu
+func (j *JWTService) decryptLocked(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", errJWEMalformed
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errJWEMalformed
+	}
+	var header jweHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", errJWEMalformed
+	}
+	if header.Enc != jweEncA256GCM || header.Cty != "JWT" {
+		return "", fmt.Errorf("jwe: unsupported enc %q or cty %q", header.Enc, header.Cty)
+	}
+
+	var decoded [4][]byte
+	for i := range decoded {
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(parts[i+1]); err != nil {
+			return "", errJWEMalformed
+		}
+	}
+	encryptedKey, iv, ciphertext, tag := decoded[0], decoded[1], decoded[2], decoded[3]
+
+	// Кандидаты на ключ содержимого: для dir - производные всех действующих секретов
+	var keys [][]byte
+	switch header.Alg {
+	case JWEAlgDir:
+		if len(encryptedKey) != 0 {
+			return "", errJWEMalformed
+		}
+		for _, secret := range append([][]byte{j.CurrentSecret}, j.OldSecrets...) {
+			keys = append(keys, jweDirKey(secret))
+		}
+	case JWEAlgRSAOAEP:
+		for _, k := range j.encryptionKeys {
+			if k.kid != header.Kid {
+				continue
+			}
+			cek, err := rsa.DecryptOAEP(sha1.New(), nil, k.key, encryptedKey, nil)
+			if err != nil {
+				return "", errors.New("jwe: cannot decrypt content key")
+			}
+			keys = append(keys, cek)
+		}
+	default:
+		return "", fmt.Errorf("jwe: unsupported alg %q", header.Alg)
+	}
+
+	sealed := append(append([]byte(nil), ciphertext...), tag...)
+	for _, key := range keys {
+		gcm, err := newGCM(key)
+		if err != nil || len(iv) != gcm.NonceSize() {
+			continue
+		}
+		if plaintext, err := gcm.Open(nil, iv, sealed, []byte(parts[0])); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", errors.New("jwe: no key decrypts the token")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != jweKeySize {
+		return nil, errors.New("jwe: A256GCM requires a 256-bit key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// jweDirKey выводит ключ шифрования из HMAC-секрета, чтобы один и тот же секрет
+// не использовался и для подписи, и для шифрования
+func jweDirKey(secret []byte) []byte {
+	key := make([]byte, jweKeySize)
+	io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("access jwe dir A256GCM")), key)
+	return key
+}
@@ -0,0 +1,161 @@
+package access
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const generatedSigningKeyBits = 2048
+
+// signingKey - ключ RS256 для токенов, которые проверяют сторонние клиенты (ID token).
+// Свои access token по-прежнему подписываются HMAC-секретом.
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// JSONWebKey - открытый ключ в формате JWK (RFC 7517)
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// LoadSigningKey читает закрытый ключ RSA из PEM (PKCS#1 или PKCS#8)
+func LoadSigningKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key: no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key: only RSA keys are supported")
+	}
+	return key, nil
+}
+
+// RotateSigningKey делает key текущим ключом подписи; прежний остаётся в JWKS,
+// пока не вытеснен, по тому же правилу old_keys_to_keep, что и HMAC-секреты
+func (j *JWTService) RotateSigningKey(key *rsa.PrivateKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rotateSigningKeyLocked(key)
+}
+
+func (j *JWTService) rotateSigningKeyLocked(key *rsa.PrivateKey) {
+	keep := j.cfg.JWT.OldKeysToKeep
+	if len(j.signingKeys) > keep {
+		j.signingKeys = j.signingKeys[:keep]
+	}
+	j.signingKeys = append([]signingKey{{kid: keyID(&key.PublicKey), key: key}}, j.signingKeys...)
+}
+
+// SignRS256 подписывает claims текущим ключом RS256 с kid в заголовке
+func (j *JWTService) SignRS256(claims jwt.MapClaims) (string, error) {
+	current, err := j.currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = current.kid
+	return token.SignedString(current.key)
+}
+
+// JWKS - открытые ключи RS256 для /jwks
+func (j *JWTService) JWKS() JSONWebKeySet {
+	if _, err := j.currentSigningKey(); err != nil {
+		return JSONWebKeySet{Keys: []JSONWebKey{}}
+	}
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(j.signingKeys))}
+	for _, k := range j.signingKeys {
+		set.Keys = append(set.Keys, JSONWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: k.kid,
+			N:   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+		})
+	}
+	return set
+}
+
+// currentSigningKey без signing_key_file создаёт ключ при первом обращении: генерация RSA
+// небыстрая, а сервисам без OIDC он не нужен
+func (j *JWTService) currentSigningKey() (signingKey, error) {
+	j.mu.RLock()
+	if len(j.signingKeys) > 0 {
+		current := j.signingKeys[0]
+		j.mu.RUnlock()
+		return current, nil
+	}
+	j.mu.RUnlock()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.signingKeys) == 0 {
+		key, err := rsa.GenerateKey(rand.Reader, generatedSigningKeyBits)
+		if err != nil {
+			return signingKey{}, err
+		}
+		if j.auth != nil {
+			j.auth.log(slog.LevelWarn, "access: generated ephemeral RS256 signing key, set jwt.signing_key_file to share it between replicas")
+		}
+		j.rotateSigningKeyLocked(key)
+	}
+	return j.signingKeys[0], nil
+}
+
+// keyID - kid по отпечатку открытого ключа, одинаковый на всех репликах с общим ключом
+func keyID(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// RSAPublicKey восстанавливает открытый ключ из JWK с kty RSA
+func (k JSONWebKey) RSAPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.New("jwk: unsupported key type " + k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("jwk: invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("jwk: invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
@@ -3,7 +3,9 @@ package access
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -16,6 +18,11 @@ type JWTService struct {
 	mu            sync.RWMutex
 	cfg           *Config
 	auth          *Authenticator
+
+	// Ключи RS256, текущий первым
+	signingKeys []signingKey
+	// Ключи RSA-OAEP для шифрования токенов, текущий первым
+	encryptionKeys []encryptionKey
 }
 
 func NewJWTService(secret string, cfg *Config, auth *Authenticator) *JWTService {
@@ -45,18 +52,33 @@ func (j *JWTService) RotateSecret(newSecret string) {
 }
 
 func (j *JWTService) GenerateJWT(userID int, username, role string) (string, error) {
+	return j.GenerateJWTWithClaims(userID, username, role, nil)
+}
+
+// GenerateJWTWithClaims - GenerateJWT с дополнительными claims (amr, auth_time и т.п.).
+// Основные claims из extra не переопределяются.
+func (j *JWTService) GenerateJWTWithClaims(userID int, username, role string, extra jwt.MapClaims) (string, error) {
 	j.mu.RLock()
 	defer j.mu.RUnlock()
 
-	claims := jwt.MapClaims{
-		"user_id":  userID,
-		"username": username,
-		"role":     role,
-		"exp":      time.Now().Add(j.cfg.JWT.TTL).Unix(),
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for k, v := range extra {
+		claims[k] = v
 	}
+	claims["user_id"] = userID
+	claims["username"] = username
+	claims["role"] = role
+	claims["jti"] = newTokenID()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(j.cfg.JWT.TTL).Unix()
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(j.CurrentSecret)
+	signed, err := token.SignedString(j.CurrentSecret)
+	if err != nil || j.cfg.JWT.Encryption.Alg == "" {
+		return signed, err
+	}
+	return j.encryptLocked(signed)
 }
 
 func generateRandomSecret() string {
@@ -67,29 +89,137 @@ func generateRandomSecret() string {
 	return base64.StdEncoding.EncodeToString(b)
 }
 
+// newTokenID - случайный идентификатор токена для claim jti
+func newTokenID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate token id: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var (
+	ErrTokenExpired = errors.New("token is expired")
+	ErrTokenInvalid = errors.New("no valid secret found for token")
+	ErrTokenRevoked = errors.New("token is revoked")
+)
+
 func (j *JWTService) ParseJWT(tokenString string) (jwt.MapClaims, error) {
-	if claims, ok := j.auth.TokenCache.Get(tokenString); ok {
-		return claims.(jwt.MapClaims), nil
+	// Одновременные запросы с одним новым токеном проверяют подпись один раз
+	claims, err := GetOrLoad(j.auth.TokenCache, tokenString, func() (jwt.MapClaims, time.Duration, error) {
+		claims, err := j.verify(tokenString)
+		if err != nil {
+			return nil, 0, err
+		}
+		return claims, j.claimsTTL(claims), nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	claims, err := j.parseWithSecret(tokenString, j.CurrentSecret)
-	if err == nil {
-		j.auth.TokenCache.Set(tokenString, claims)
-		return claims, nil
+	// Запись могла пережить срок действия токена - проверяем exp на каждом попадании
+	if !claims.VerifyExpiresAt(time.Now().Unix(), false) {
+		j.auth.TokenCache.Delete(tokenString)
+		return nil, ErrTokenExpired
+	}
+	if jti, _ := claims["jti"].(string); jti != "" {
+		if _, revoked := j.auth.RevokedTokens.Get(jti); revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	// Токены клиентов OAuth отзываются и всей цепочкой разрешения
+	if grantID, _ := claims["grant_id"].(string); j.auth.grantRevoked(grantID) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// RevokeJWT отзывает токен до истечения его срока действия. Отзыв атомарен:
+// из конкурентных вызовов для одного токена успешен только один, остальные получают ErrTokenRevoked.
+// Если отзыв не удалось сохранить в общем хранилище, возвращается ErrCacheUnavailable
+func (j *JWTService) RevokeJWT(tokenString string) error {
+	claims, err := j.ParseJWT(tokenString)
+	if err != nil {
+		return err
 	}
 
+	jti, _ := claims["jti"].(string)
+	exp, ok := claimsExpiry(claims)
+	if jti == "" || !ok {
+		return errors.New("token without jti or exp cannot be revoked")
+	}
+
+	revoked, err := AddIfAbsent(j.auth.RevokedTokens, jti, true, time.Until(exp)+time.Second)
+	j.auth.TokenCache.Delete(tokenString)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+func (j *JWTService) verify(tokenString string) (jwt.MapClaims, error) {
 	j.mu.RLock()
 	defer j.mu.RUnlock()
 
-	for _, secret := range j.OldSecrets {
+	// У JWE проверяется подпись вложенного JWT. Токены без шифрования по-прежнему
+	// принимаются, чтобы включение шифрования не разлогинило всех пользователей
+	if isJWE(tokenString) {
+		inner, err := j.decryptLocked(tokenString)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+		}
+		tokenString = inner
+	}
+
+	expired := false
+	for _, secret := range append([][]byte{j.CurrentSecret}, j.OldSecrets...) {
 		claims, err := j.parseWithSecret(tokenString, secret)
 		if err == nil {
-			j.auth.TokenCache.Set(tokenString, claims)
 			return claims, nil
 		}
+		// Подпись верна, но срок действия истёк
+		var ve *jwt.ValidationError
+		if errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired {
+			expired = true
+		}
 	}
 
-	return nil, errors.New("no valid secret found for token")
+	if expired {
+		return nil, ErrTokenExpired
+	}
+	return nil, ErrTokenInvalid
+}
+
+// claimsTTL - срок кэширования claims не дольше, чем живёт сам токен: min(TokenTTL, exp - now)
+func (j *JWTService) claimsTTL(claims jwt.MapClaims) time.Duration {
+	ttl := j.cfg.Cache.TokenTTL
+	if exp, ok := claimsExpiry(claims); ok {
+		if left := time.Until(exp); left < ttl {
+			ttl = left
+		}
+	}
+	return ttl
+}
+
+func claimsExpiry(claims jwt.MapClaims) (time.Time, bool) {
+	return claimTime(claims, "exp")
+}
+
+// claimTime читает claim с временем в секундах Unix (exp, iat, auth_time)
+func claimTime(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0), err == nil
+	}
+	return time.Time{}, false
 }
 
 func (j *JWTService) parseWithSecret(tokenString string, secret []byte) (jwt.MapClaims, error) {
@@ -0,0 +1,636 @@
+package access
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Операции и коды LDAPv3 (RFC 4511), которые нужны для входа
+const (
+	ldapBindRequest     = berClassApplication | berConstructed | 0
+	ldapBindResponse    = berClassApplication | berConstructed | 1
+	ldapUnbindRequest   = berClassApplication | 2
+	ldapSearchRequest   = berClassApplication | berConstructed | 3
+	ldapSearchEntry     = berClassApplication | berConstructed | 4
+	ldapSearchDone      = berClassApplication | berConstructed | 5
+	ldapSearchReference = berClassApplication | berConstructed | 19
+
+	ldapResultSuccess            = 0
+	ldapResultSizeLimitExceeded  = 4
+	ldapResultInvalidCredentials = 49
+
+	defaultLDAPTimeout     = 10 * time.Second
+	defaultLDAPUserFilter  = "(uid={username})"
+	defaultLDAPGroupFilter = "(|(member={dn})(uniqueMember={dn}))"
+	defaultLDAPIDAttribute = "entryUUID"
+	defaultLDAPUsername    = "uid"
+	ldapMemberOfAttribute  = "memberOf"
+)
+
+// GroupRoleRule назначает роль участникам группы каталога
+type GroupRoleRule struct {
+	Group string `yaml:"group"` // DN группы или шаблон path.Match, регистр не учитывается
+	Role  string `yaml:"role"`
+}
+
+// LDAPError - ответ сервера LDAP с ненулевым кодом результата
+type LDAPError struct {
+	Code    int64
+	Message string
+}
+
+func (e *LDAPError) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// LDAPIdentity - пользователь каталога после успешного bind
+type LDAPIdentity struct {
+	DN       string
+	ID       int      // StableUserID от IDAttr: не меняется при переименовании
+	Username string   // Значение NameAttr из записи, а не введённое имя
+	Groups   []string // DN групп из memberOf и поиска групп
+}
+
+// LDAPDirectory проверяет пароли простым bind (LDAPv3, ldaps:// или ldap://)
+// и находит группы пользователя
+type LDAPDirectory struct {
+	URL          string
+	BindDN       string // Служебная учётка для поиска, пусто - анонимный поиск
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // {username} заменяется экранированным именем
+	GroupBaseDN  string // Пусто - группы берутся только из memberOf
+	GroupFilter  string // {dn} заменяется экранированным DN пользователя
+	IDAttr       string // Постоянный атрибут записи, из него выводится ID
+	NameAttr     string // Атрибут с каноническим именем пользователя
+	TLSConfig    *tls.Config
+	Timeout      time.Duration
+}
+
+// NewLDAPDirectory возвращает nil, если LDAP не настроен
+func NewLDAPDirectory(cfg *Config) (*LDAPDirectory, error) {
+	c := cfg.LDAP
+	if c.URL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("ldap: invalid url %q", c.URL)
+	}
+	if c.BaseDN == "" {
+		return nil, errors.New("ldap: base_dn is required")
+	}
+
+	d := &LDAPDirectory{
+		URL:          c.URL,
+		BindDN:       c.BindDN,
+		BindPassword: c.BindPassword,
+		BaseDN:       c.BaseDN,
+		UserFilter:   c.UserFilter,
+		GroupBaseDN:  c.GroupBaseDN,
+		GroupFilter:  c.GroupFilter,
+		IDAttr:       c.IDAttr,
+		NameAttr:     c.NameAttr,
+		Timeout:      c.Timeout,
+	}
+	if d.IDAttr == "" {
+		d.IDAttr = defaultLDAPIDAttribute
+	}
+	if d.NameAttr == "" {
+		d.NameAttr = defaultLDAPUsername
+	}
+	if d.UserFilter == "" {
+		d.UserFilter = defaultLDAPUserFilter
+	}
+	if d.GroupFilter == "" {
+		d.GroupFilter = defaultLDAPGroupFilter
+	}
+	if d.Timeout <= 0 {
+		d.Timeout = defaultLDAPTimeout
+	}
+	// Шаблоны проверяются сразу, а не при первом входе
+	for _, filter := range []string{d.UserFilter, d.GroupFilter} {
+		if _, err := compileLDAPFilter(expandLDAPFilter(filter, "x", "x")); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.Scheme == "ldaps" {
+		d.TLSConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if c.CAFile != "" {
+			pem, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			d.TLSConfig.RootCAs = x509.NewCertPool()
+			if !d.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("ldap: no certificates in %s", c.CAFile)
+			}
+		}
+	}
+	return d, nil
+}
+
+// Authenticate находит пользователя, проверяет пароль bind от его имени и собирает группы.
+// Неверное имя или пароль - errBadCredentials
+func (d *LDAPDirectory) Authenticate(ctx context.Context, username, password string) (*LDAPIdentity, error) {
+	// Пустой пароль - unauthenticated bind (RFC 4513, §5.1.2), многие серверы считают его успешным
+	if username == "" || password == "" {
+		return nil, errBadCredentials
+	}
+
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if err := d.bindService(conn); err != nil {
+		return nil, err
+	}
+	// entryUUID - операционный атрибут, сервер отдаёт его только по явному запросу
+	attributes := []string{ldapMemberOfAttribute, d.IDAttr, d.NameAttr}
+	users, err := conn.search(d.BaseDN, expandLDAPFilter(d.UserFilter, username, ""), attributes, 2)
+	if err != nil {
+		return nil, err
+	}
+	// Неоднозначный фильтр не должен пускать под первой попавшейся записью
+	if len(users) != 1 {
+		return nil, errBadCredentials
+	}
+	user := users[0]
+
+	if err := conn.bind(user.dn, password); err != nil {
+		var ldapErr *LDAPError
+		if errors.As(err, &ldapErr) && ldapErr.Code == ldapResultInvalidCredentials {
+			return nil, errBadCredentials
+		}
+		return nil, err
+	}
+
+	ids := user.attributes[strings.ToLower(d.IDAttr)]
+	if len(ids) == 0 || ids[0] == "" {
+		return nil, fmt.Errorf("ldap: entry %s has no %s attribute", user.dn, d.IDAttr)
+	}
+	canonical := ldapCanonicalName(user.attributes[strings.ToLower(d.NameAttr)], username)
+	if canonical == "" {
+		return nil, fmt.Errorf("ldap: entry %s has no %s attribute", user.dn, d.NameAttr)
+	}
+
+	identity := &LDAPIdentity{DN: user.dn, ID: StableUserID(ids[0]), Username: canonical}
+	seen := make(map[string]bool)
+	addGroup := func(dn string) {
+		if key := strings.ToLower(dn); dn != "" && !seen[key] {
+			seen[key] = true
+			identity.Groups = append(identity.Groups, dn)
+		}
+	}
+	for _, dn := range user.attributes[strings.ToLower(ldapMemberOfAttribute)] {
+		addGroup(dn)
+	}
+
+	if d.GroupBaseDN != "" {
+		// У самого пользователя может не быть прав на поиск групп
+		if err := d.bindService(conn); err != nil {
+			return nil, err
+		}
+		groups, err := conn.search(d.GroupBaseDN, expandLDAPFilter(d.GroupFilter, username, user.dn), []string{"1.1"}, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			addGroup(group.dn)
+		}
+	}
+	return identity, nil
+}
+
+// ldapCanonicalName выбирает имя из значений атрибута записи. Атрибут может быть
+// многозначным: предпочтение отдаётся значению, совпадающему с введённым без учёта регистра
+func ldapCanonicalName(values []string, typed string) string {
+	for _, v := range values {
+		if strings.EqualFold(v, typed) {
+			return v
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (d *LDAPDirectory) bindService(conn *ldapConn) error {
+	if d.BindDN == "" {
+		return nil
+	}
+	if err := conn.bind(d.BindDN, d.BindPassword); err != nil {
+		return fmt.Errorf("ldap: service bind failed: %w", err)
+	}
+	return nil
+}
+
+func (d *LDAPDirectory) dial(ctx context.Context) (*ldapConn, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	deadline := time.Now().Add(d.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var conn net.Conn
+	if u.Scheme == "ldaps" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: d.TLSConfig}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// LDAPRole назначает роль по группам: побеждает первое правило, под которое попала хоть одна группа
+func LDAPRole(rules []GroupRoleRule, groups []string) (string, bool) {
+	for _, rule := range rules {
+		if rule.Group == "" || rule.Role == "" {
+			continue
+		}
+		pattern := strings.ToLower(rule.Group)
+		for _, group := range groups {
+			if ok, _ := path.Match(pattern, strings.ToLower(group)); ok {
+				return rule.Role, true
+			}
+		}
+	}
+	return "", false
+}
+
+// authenticateLDAP - authenticate для пользователей каталога: ID выводится из постоянного
+// атрибута записи, хэша пароля нет, роль определяют правила ldap_groups
+func (a *Authenticator) authenticateLDAP(ctx context.Context, username, password string) (*User, error) {
+	a.ldapWarnOnce.Do(func() {
+		if !strings.HasPrefix(a.LDAP.URL, "ldaps://") {
+			a.log(slog.LevelWarn, "access: ldap url is not ldaps://, passwords are sent in clear text", "url", a.LDAP.URL)
+		}
+	})
+	identity, err := a.LDAP.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := a.permissions()
+	if err != nil {
+		return nil, err
+	}
+	role, ok := LDAPRole(cfg.LDAPGroups, identity.Groups)
+	if !ok {
+		return nil, fmt.Errorf("%w: directory groups of %s are not mapped to a role", errBadCredentials, identity.DN)
+	}
+	return &User{ID: identity.ID, Username: identity.Username, Role: role}, nil
+}
+
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string // Имена атрибутов в нижнем регистре
+}
+
+type ldapConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	lastID int64
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.lastID++
+	_, err := c.conn.Write(berSequence(berInt(berTagInteger, c.lastID), op))
+	return c.lastID, err
+}
+
+// receive читает следующий ответ на запрос id
+func (c *ldapConn) receive(id int64) (berElement, error) {
+	msg, err := readBER(c.r)
+	if err != nil {
+		return berElement{}, err
+	}
+	if msg.tag != berTagSequence || len(msg.children) < 2 {
+		return berElement{}, errors.New("ldap: malformed message")
+	}
+	got, err := msg.children[0].Int()
+	if err != nil {
+		return berElement{}, err
+	}
+	if got != id {
+		// messageID 0 - уведомление сервера, обычно о разрыве соединения (RFC 4511, §4.4)
+		return berElement{}, fmt.Errorf("ldap: unexpected message id %d", got)
+	}
+	return msg.children[1], nil
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berConstruct(ldapBindRequest,
+		berInt(berTagInteger, 3),
+		berString(berTagOctetString, dn),
+		berString(berClassContext|0, password),
+	))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return errors.New("ldap: unexpected response to bind")
+	}
+	return ldapResult(op)
+}
+
+func (c *ldapConn) search(base, filter string, attributes []string, sizeLimit int64) ([]ldapEntry, error) {
+	compiled, err := compileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, attr := range attributes {
+		attrs = append(attrs, berString(berTagOctetString, attr))
+	}
+	id, err := c.send(berConstruct(ldapSearchRequest,
+		berString(berTagOctetString, base),
+		berInt(berTagEnumerated, 2), // wholeSubtree
+		berInt(berTagEnumerated, 0), // neverDerefAliases
+		berInt(berTagInteger, sizeLimit),
+		berInt(berTagInteger, 0),
+		berBool(false),
+		compiled,
+		berSequence(attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// Ссылки на другие серверы не обходим
+		case ldapSearchDone:
+			err := ldapResult(op)
+			var ldapErr *LDAPError
+			if errors.As(err, &ldapErr) && ldapErr.Code == ldapResultSizeLimitExceeded {
+				return entries, nil
+			}
+			return entries, err
+		default:
+			return nil, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
+
+func (c *ldapConn) close() {
+	c.send(berTLV(ldapUnbindRequest, nil))
+	c.conn.Close()
+}
+
+func ldapResult(op berElement) error {
+	if len(op.children) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	code, err := op.children[0].Int()
+	if err != nil {
+		return err
+	}
+	if code != ldapResultSuccess {
+		return &LDAPError{Code: code, Message: op.children[2].String()}
+	}
+	return nil
+}
+
+func parseLDAPEntry(op berElement) (ldapEntry, error) {
+	if len(op.children) < 2 {
+		return ldapEntry{}, errors.New("ldap: malformed search entry")
+	}
+	entry := ldapEntry{dn: op.children[0].String(), attributes: make(map[string][]string)}
+	for _, attr := range op.children[1].children {
+		if len(attr.children) < 2 {
+			return ldapEntry{}, errors.New("ldap: malformed attribute")
+		}
+		name := strings.ToLower(attr.children[0].String())
+		for _, v := range attr.children[1].children {
+			entry.attributes[name] = append(entry.attributes[name], v.String())
+		}
+	}
+	return entry, nil
+}
+
+// expandLDAPFilter подставляет значения в шаблон фильтра с экранированием по RFC 4515
+func expandLDAPFilter(template, username, dn string) string {
+	return strings.NewReplacer("{username}", escapeLDAPFilter(username), "{dn}", escapeLDAPFilter(dn)).Replace(template)
+}
+
+func escapeLDAPFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileLDAPFilter переводит строковый фильтр (RFC 4515) в BER: &, |, !, =, =*, ~=, >=, <=
+// и подстроки с *. Расширяемые сравнения (:=) не поддерживаются
+func compileLDAPFilter(filter string) ([]byte, error) {
+	p := &ldapFilterParser{s: filter}
+	out, err := p.filter(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("ldap: unexpected %q after filter", p.s[p.pos:])
+	}
+	return out, nil
+}
+
+type ldapFilterParser struct {
+	s   string
+	pos int
+}
+
+func (p *ldapFilterParser) filter(depth int) ([]byte, error) {
+	if depth > berMaxDepth {
+		return nil, errors.New("ldap: filter nesting too deep")
+	}
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return nil, fmt.Errorf("ldap: expected ( at %d in filter %q", p.pos, p.s)
+	}
+	p.pos++
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("ldap: unterminated filter %q", p.s)
+	}
+
+	var out []byte
+	var err error
+	switch p.s[p.pos] {
+	case '&', '|':
+		tag := byte(berClassContext | berConstructed | 0)
+		if p.s[p.pos] == '|' {
+			tag |= 1
+		}
+		p.pos++
+		var list [][]byte
+		for p.pos < len(p.s) && p.s[p.pos] == '(' {
+			item, err := p.filter(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		out = berConstruct(tag, list...)
+	case '!':
+		p.pos++
+		item, err := p.filter(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out = berConstruct(berClassContext|berConstructed|2, item)
+	default:
+		out, err = p.item()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+		return nil, fmt.Errorf("ldap: expected ) at %d in filter %q", p.pos, p.s)
+	}
+	p.pos++
+	return out, nil
+}
+
+func (p *ldapFilterParser) item() ([]byte, error) {
+	end := strings.IndexByte(p.s[p.pos:], ')')
+	if end < 0 {
+		return nil, fmt.Errorf("ldap: unterminated filter %q", p.s)
+	}
+	raw := p.s[p.pos : p.pos+end]
+	p.pos += end
+
+	eq := strings.IndexByte(raw, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("ldap: invalid filter item %q", raw)
+	}
+	attr, value := raw[:eq], raw[eq+1:]
+
+	var tag byte
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = 8
+	case '>':
+		tag = 5
+	case '<':
+		tag = 6
+	case ':':
+		return nil, fmt.Errorf("ldap: extensible match is not supported in %q", raw)
+	}
+	if tag != 0 {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("ldap: invalid filter item %q", raw)
+	}
+
+	if tag == 0 && value == "*" {
+		return berString(berClassContext|7, attr), nil
+	}
+	if tag == 0 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs [][]byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			decoded, err := unescapeLDAPFilter(part)
+			if err != nil {
+				return nil, err
+			}
+			subTag := byte(berClassContext | 1) // any
+			switch i {
+			case 0:
+				subTag = berClassContext | 0 // initial
+			case len(parts) - 1:
+				subTag = berClassContext | 2 // final
+			}
+			subs = append(subs, berString(subTag, decoded))
+		}
+		if len(subs) == 0 {
+			return nil, fmt.Errorf("ldap: invalid substring filter %q", raw)
+		}
+		return berConstruct(berClassContext|berConstructed|4, berString(berTagOctetString, attr), berSequence(subs...)), nil
+	}
+
+	decoded, err := unescapeLDAPFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	if tag == 0 {
+		tag = 3
+	}
+	return berConstruct(berClassContext|berConstructed|tag, berString(berTagOctetString, attr), berString(berTagOctetString, decoded)), nil
+}
+
+func unescapeLDAPFilter(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("ldap: invalid escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("ldap: invalid escape in %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
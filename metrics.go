@@ -0,0 +1,293 @@
+package access
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Причины решений об авторизации: метка reason в метриках и код ошибки в ответе клиенту
+const (
+	ReasonGranted             = "granted"
+	ReasonConfigError         = "config_error"
+	ReasonBadRequest          = "bad_request"
+	ReasonTokenMissing        = "token_missing"
+	ReasonTokenInvalid        = "token_invalid"
+	ReasonTokenExpired        = "token_expired"
+	ReasonTokenRevoked        = "token_revoked"
+	ReasonBadCredentials      = "invalid_credentials"
+	ReasonAccountLocked       = "account_locked"
+	ReasonAccountDisabled     = "account_disabled"
+	ReasonMFANotConfigured    = "mfa_not_configured"
+	ReasonCSRFFailed          = "csrf_failed"
+	ReasonCertificateMissing  = "certificate_missing"
+	ReasonRoleInvalid         = "role_invalid"
+	ReasonClaimsInvalid       = "claims_invalid"
+	ReasonRoleUnknown         = "role_unknown"
+	ReasonAccessDenied        = "access_denied"
+	ReasonStepUpRequired      = "step_up_required"
+	ReasonOwnershipViolation  = "ownership_violation"
+	ReasonProviderUnavailable = "provider_unavailable"
+)
+
+// Границы корзин гистограммы времени проверки токена, в секундах
+var tokenValidationBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// CacheStats - счётчики одного кэша
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64 // Вытеснено из-за ограничения размера
+	Expirations uint64 // Удалено по истечении TTL
+	Size        int
+	Bytes       int64 // Оценка размера записей, если у кэша задан max_bytes
+}
+
+// StatsProvider реализуют кэши, которые ведут собственную статистику
+type StatsProvider interface {
+	Stats() CacheStats
+}
+
+type cacheCounters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+}
+
+func (c *cacheCounters) snapshot(size int) CacheStats {
+	return CacheStats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Size:        size,
+	}
+}
+
+type DecisionKey struct {
+	Role    string
+	Allowed bool
+	Reason  string
+}
+
+type HistogramSnapshot struct {
+	Buckets []float64 // Верхние границы корзин
+	Counts  []uint64  // Накопленное число наблюдений в каждой корзине
+	Sum     float64
+	Count   uint64
+}
+
+// histogram обновляется без блокировок: наблюдения идут на каждом запросе
+type histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	sumBits atomic.Uint64 // math.Float64bits суммы
+	count   atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	// count увеличивается раньше корзин, а snapshot читает его позже, поэтому
+	// в снимке +Inf не меньше любой корзины
+	h.count.Add(1)
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i].Add(1)
+		}
+	}
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Sum:     math.Float64frombits(h.sumBits.Load()),
+	}
+	for i := range h.counts {
+		snap.Counts[i] = h.counts[i].Load()
+	}
+	snap.Count = h.count.Load()
+	return snap
+}
+
+// Metrics - счётчики решений об авторизации и время проверки токенов.
+// Запись идёт на каждом запросе, поэтому обходится без общей блокировки
+type Metrics struct {
+	auth *Authenticator
+
+	decisions       sync.Map            // DecisionKey -> *atomic.Uint64
+	tokenValidation map[bool]*histogram // Ключ - успешна ли проверка, после создания не меняется
+}
+
+type MetricsSnapshot struct {
+	PasswordCost    int // Сложность bcrypt для новых хэшей, в том числе подобранная auto_cost
+	Caches          map[string]CacheStats
+	Decisions       map[DecisionKey]uint64
+	TokenValidation map[bool]HistogramSnapshot
+}
+
+func NewMetrics(auth *Authenticator) *Metrics {
+	return &Metrics{
+		auth: auth,
+		tokenValidation: map[bool]*histogram{
+			true:  newHistogram(tokenValidationBuckets),
+			false: newHistogram(tokenValidationBuckets),
+		},
+	}
+}
+
+func (m *Metrics) RecordDecision(role string, allowed bool, reason string) {
+	key := DecisionKey{Role: role, Allowed: allowed, Reason: reason}
+	counter, ok := m.decisions.Load(key)
+	if !ok {
+		counter, _ = m.decisions.LoadOrStore(key, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+func (m *Metrics) ObserveTokenValidation(d time.Duration, valid bool) {
+	m.tokenValidation[valid].observe(d.Seconds())
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snap := MetricsSnapshot{
+		Caches:          make(map[string]CacheStats),
+		Decisions:       make(map[DecisionKey]uint64),
+		TokenValidation: make(map[bool]HistogramSnapshot),
+	}
+
+	// Кэши берём с Authenticator в момент снимка - их могли заменить
+	if m.auth != nil {
+		if m.auth.PasswordHasher != nil {
+			snap.PasswordCost = m.auth.PasswordHasher.Cost()
+		}
+		caches := map[string]interface{}{
+			"token":      m.auth.TokenCache,
+			"password":   m.auth.PasswordCache,
+			"permission": m.auth.PermissionCache,
+			"api_key":    m.auth.APIKeyCache,
+			"identity":   m.auth.IdentityCache,
+		}
+		for name, cache := range caches {
+			if provider, ok := cache.(StatsProvider); ok {
+				snap.Caches[name] = provider.Stats()
+			}
+		}
+	}
+
+	m.decisions.Range(func(key, counter any) bool {
+		snap.Decisions[key.(DecisionKey)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	for valid, h := range m.tokenValidation {
+		snap.TokenValidation[valid] = h.snapshot()
+	}
+	return snap
+}
+
+// Handler отдаёт метрики в текстовом формате Prometheus
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteText(w)
+	})
+}
+
+func (m *Metrics) WriteText(w io.Writer) {
+	snap := m.Snapshot()
+	var b strings.Builder
+
+	cacheNames := make([]string, 0, len(snap.Caches))
+	for name := range snap.Caches {
+		cacheNames = append(cacheNames, name)
+	}
+	sort.Strings(cacheNames)
+
+	cacheMetrics := []struct {
+		name, help, kind string
+		value            func(CacheStats) string
+	}{
+		{"access_cache_hits_total", "Cache hits.", "counter", func(s CacheStats) string { return fmt.Sprint(s.Hits) }},
+		{"access_cache_misses_total", "Cache misses.", "counter", func(s CacheStats) string { return fmt.Sprint(s.Misses) }},
+		{"access_cache_evictions_total", "Entries evicted by the size limit.", "counter", func(s CacheStats) string { return fmt.Sprint(s.Evictions) }},
+		{"access_cache_expirations_total", "Entries removed after TTL expiry.", "counter", func(s CacheStats) string { return fmt.Sprint(s.Expirations) }},
+		{"access_cache_size", "Current number of cache entries.", "gauge", func(s CacheStats) string { return fmt.Sprint(s.Size) }},
+		{"access_cache_bytes", "Estimated size of cache entries in bytes, 0 without max_bytes.", "gauge", func(s CacheStats) string { return fmt.Sprint(s.Bytes) }},
+	}
+	for _, cm := range cacheMetrics {
+		writeHeader(&b, cm.name, cm.help, cm.kind)
+		for _, name := range cacheNames {
+			fmt.Fprintf(&b, "%s{cache=\"%s\"} %s\n", cm.name, escapeLabel(name), cm.value(snap.Caches[name]))
+		}
+	}
+
+	if snap.PasswordCost > 0 {
+		writeHeader(&b, "access_password_hash_cost", "Bcrypt cost of new password hashes.", "gauge")
+		fmt.Fprintf(&b, "access_password_hash_cost %d\n", snap.PasswordCost)
+	}
+
+	keys := make([]DecisionKey, 0, len(snap.Decisions))
+	for key := range snap.Decisions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Role != keys[j].Role {
+			return keys[i].Role < keys[j].Role
+		}
+		if keys[i].Allowed != keys[j].Allowed {
+			return keys[i].Allowed
+		}
+		return keys[i].Reason < keys[j].Reason
+	})
+
+	writeHeader(&b, "access_authz_decisions_total", "Authorization decisions by role and reason.", "counter")
+	for _, key := range keys {
+		decision := "denied"
+		if key.Allowed {
+			decision = "allowed"
+		}
+		fmt.Fprintf(&b, "access_authz_decisions_total{role=\"%s\",decision=\"%s\",reason=\"%s\"} %d\n",
+			escapeLabel(key.Role), decision, escapeLabel(key.Reason), snap.Decisions[key])
+	}
+
+	writeHeader(&b, "access_token_validation_duration_seconds", "Token validation latency.", "histogram")
+	for _, valid := range []bool{true, false} {
+		result := "invalid"
+		if valid {
+			result = "valid"
+		}
+		h := snap.TokenValidation[valid]
+		for i, le := range h.Buckets {
+			fmt.Fprintf(&b, "access_token_validation_duration_seconds_bucket{result=\"%s\",le=\"%g\"} %d\n", result, le, h.Counts[i])
+		}
+		fmt.Fprintf(&b, "access_token_validation_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.Count)
+		fmt.Fprintf(&b, "access_token_validation_duration_seconds_sum{result=\"%s\"} %g\n", result, h.Sum)
+		fmt.Fprintf(&b, "access_token_validation_duration_seconds_count{result=\"%s\"} %d\n", result, h.Count)
+	}
+
+	w.Write([]byte(b.String()))
+}
+
+func writeHeader(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,113 @@
+package access
+
+import (
+	"crypto/x509"
+	"net/http"
+	"path"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// CertificateRule сопоставляет клиентский сертификат роли. Заданные поля должны
+// совпасть все; значения - шаблоны path.Match, "*" не захватывает "/".
+type CertificateRule struct {
+	CommonName string `yaml:"cn"`        // Subject CN
+	DNS        string `yaml:"dns"`       // Любое DNS-имя из SAN
+	URI        string `yaml:"uri"`       // Любой URI из SAN
+	SPIFFEID   string `yaml:"spiffe_id"` // URI из SAN со схемой spiffe
+	Role       string `yaml:"role"`
+}
+
+// ClientCertAuth - middleware для service-to-service запросов по взаимному TLS.
+// Личность берётся из проверенного сервером клиентского сертификата и через правила
+// certificates из файла прав превращается в роль; дальше - обычная проверка секций.
+func (a *Authenticator) ClientCertAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := a.permissions()
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Failed to load permissions configuration", Err: err})
+			return
+		}
+
+		// Сертификат без проверенной цепочки (RequestClientCert) не подтверждает личность
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			a.reject(w, r, "", &AuthError{Code: ReasonCertificateMissing, Status: http.StatusUnauthorized, Detail: "Verified client certificate required", Scheme: "TLS"})
+			return
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+
+		claims := certificateClaims(cert)
+		rule := matchCertificateRule(cfg.Certificates, cert)
+		if rule == nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonRoleUnknown, Status: http.StatusForbidden, Detail: "Access denied: certificate is not mapped to a role"})
+			return
+		}
+		claims["role"] = rule.Role
+
+		a.authorize(w, r, next, cfg, claims)
+	})
+}
+
+// certificateClaims - claims той же формы, что и у JWT; username - SPIFFE ID или CN
+func certificateClaims(cert *x509.Certificate) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"user_id":      float64(0),
+		"username":     cert.Subject.CommonName,
+		"cert_subject": cert.Subject.String(),
+	}
+	if id := spiffeID(cert); id != "" {
+		claims["spiffe_id"] = id
+		claims["username"] = id
+	} else if cert.Subject.CommonName == "" && len(cert.DNSNames) > 0 {
+		claims["username"] = cert.DNSNames[0]
+	}
+	return claims
+}
+
+func matchCertificateRule(rules []CertificateRule, cert *x509.Certificate) *CertificateRule {
+	var uris []string
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	var spiffe []string
+	if id := spiffeID(cert); id != "" {
+		spiffe = []string{id}
+	}
+
+	for i, rule := range rules {
+		if rule.Role == "" || (rule.CommonName == "" && rule.DNS == "" && rule.URI == "" && rule.SPIFFEID == "") {
+			continue
+		}
+		if rule.CommonName != "" && !matchAny(rule.CommonName, []string{cert.Subject.CommonName}) {
+			continue
+		}
+		if rule.DNS != "" && !matchAny(rule.DNS, cert.DNSNames) {
+			continue
+		}
+		if rule.URI != "" && !matchAny(rule.URI, uris) {
+			continue
+		}
+		if rule.SPIFFEID != "" && !matchAny(rule.SPIFFEID, spiffe) {
+			continue
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// spiffeID возвращает SPIFFE ID; по спецификации X.509-SVID он единственный URI в SAN
+func spiffeID(cert *x509.Certificate) string {
+	if len(cert.URIs) == 1 && cert.URIs[0].Scheme == "spiffe" {
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+func matchAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok && v != "" {
+			return true
+		}
+	}
+	return false
+}
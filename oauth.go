@@ -0,0 +1,322 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Типы разрешений (grant_type) OAuth 2.0
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+const (
+	defaultOAuthCodeTTL    = time.Minute
+	defaultOAuthRefreshTTL = 30 * 24 * time.Hour
+	defaultOAuthCodes      = 10000
+	oauthTokenSize         = 32
+)
+
+var ErrClientNotFound = errors.New("oauth client not found")
+
+// OAuthClient - зарегистрированное приложение
+type OAuthClient struct {
+	ID           string
+	Name         string
+	SecretHash   string   // bcrypt; пусто у публичных клиентов
+	Public       bool     // SPA и мобильные приложения без секрета
+	RedirectURIs []string // Точное совпадение redirect_uri
+	GrantTypes   []string
+	Scopes       []string // Разрешённые scope
+	Role         string   // Роль для client_credentials
+	// Сервис, который принимает токены и проверяет их через интроспекцию.
+	// Обычным клиентам интроспекция не нужна: свои токены они и так знают
+	ResourceServer bool
+}
+
+func (c *OAuthClient) allowsGrant(grant string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OAuthClient) allowsRedirect(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthClientStore - реестр клиентов
+type OAuthClientStore interface {
+	Client(ctx context.Context, id string) (*OAuthClient, error) // ErrClientNotFound, если нет
+	SaveClient(ctx context.Context, client *OAuthClient) error
+}
+
+// AuthorizeRequest - проверенный запрос к /authorize, передаётся в ConsentHook
+type AuthorizeRequest struct {
+	Client              *OAuthClient
+	User                jwt.MapClaims
+	RedirectURI         string
+	Scopes              []string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+type ConsentDecision int
+
+const (
+	ConsentGranted ConsentDecision = iota
+	ConsentDenied
+	ConsentPending // Хук сам ответил клиенту, например показал страницу согласия
+)
+
+// ConsentHook спрашивает согласие пользователя на доступ клиента к scopes
+type ConsentHook func(w http.ResponseWriter, r *http.Request, req *AuthorizeRequest) ConsentDecision
+
+// OAuthGrant - разрешение, выданное клиенту: основа кода авторизации и refresh token
+type OAuthGrant struct {
+	ClientID      string
+	RedirectURI   string
+	RedirectSent  bool // redirect_uri был в запросе авторизации, тогда при обмене кода он обязателен
+	Scope         string
+	UserID        int
+	Username      string
+	Role          string
+	AuthTime      int64
+	AMR           []string
+	Nonce         string
+	CodeChallenge string
+	ExpiresAt     int64  // Срок refresh token, для интроспекции; не продлевается при ротации
+	GrantID       string // Общий для кода и всех токенов, выпущенных по нему, для отзыва цепочки
+}
+
+// OAuthServer - сервер авторизации OAuth 2.0 (RFC 6749) поверх JWTService
+type OAuthServer struct {
+	Issuer     string
+	CodeTTL    time.Duration
+	RefreshTTL time.Duration
+	LoginURL   string // Куда отправлять пользователя без сессии; пусто - ответ 401
+
+	// Без хука согласие считается данным (собственные приложения)
+	Consent ConsentHook
+
+	// Коды авторизации и refresh token по SHA-256 от значения
+	Codes         Cache[string, OAuthGrant]
+	RefreshTokens Cache[string, OAuthGrant]
+	// Уже обменянные коды и GrantID выданных по ним токенов, чтобы отозвать их при повторе кода
+	UsedCodes Cache[string, string]
+}
+
+func NewOAuthServer(cfg *Config) *OAuthServer {
+	s := &OAuthServer{
+		Issuer:     cfg.OAuth.Issuer,
+		CodeTTL:    cfg.OAuth.CodeTTL,
+		RefreshTTL: cfg.OAuth.RefreshTTL,
+		LoginURL:   cfg.OAuth.LoginURL,
+	}
+	if s.CodeTTL <= 0 {
+		s.CodeTTL = defaultOAuthCodeTTL
+	}
+	if s.RefreshTTL <= 0 {
+		s.RefreshTTL = defaultOAuthRefreshTTL
+	}
+	s.Codes = NewLRUCache[string, OAuthGrant](s.CodeTTL, defaultOAuthCodes)
+	// Вытеснение по размеру молча разлогинило бы клиентов, поэтому без ограничения;
+	// истёкшие записи убирает фоновая очистка, которую запускает NewAuthenticator
+	s.RefreshTokens = NewLRUCache[string, OAuthGrant](s.RefreshTTL, 0)
+	s.UsedCodes = NewLRUCache[string, string](s.RefreshTTL, defaultOAuthCodes)
+	return s
+}
+
+// revokeGrant отзывает все access token с этим grant_id и refresh token цепочки
+func (a *Authenticator) revokeGrant(grantID string) {
+	if grantID != "" {
+		a.RevokedTokens.SetWithTTL(grantRevocationKey(grantID), true, a.OAuth.RefreshTTL)
+	}
+}
+
+func (a *Authenticator) grantRevoked(grantID string) bool {
+	if grantID == "" {
+		return false
+	}
+	_, revoked := a.RevokedTokens.Get(grantRevocationKey(grantID))
+	return revoked
+}
+
+// grantRevocationKey - ключ отзыва цепочки в RevokedTokens рядом с jti токенов
+func grantRevocationKey(grantID string) string {
+	return "grant:" + grantID
+}
+
+// RegisterOAuthClient сохраняет клиента и для конфиденциальных клиентов возвращает
+// сгенерированный секрет; в хранилище попадает только его хэш
+func (a *Authenticator) RegisterOAuthClient(ctx context.Context, client *OAuthClient) (string, error) {
+	if a.OAuthClients == nil {
+		return "", errors.New("oauth client store is not configured")
+	}
+	if client.Public && client.ResourceServer {
+		return "", errors.New("oauth: public client cannot be a resource server")
+	}
+	if client.ID == "" {
+		client.ID = newTokenID()
+	}
+
+	var secret string
+	if !client.Public {
+		secret = newOpaqueToken()
+		hash, err := a.PasswordHasher.HashPassword(secret)
+		if err != nil {
+			return "", err
+		}
+		client.SecretHash = hash
+	}
+	return secret, a.OAuthClients.SaveClient(ctx, client)
+}
+
+// issueOAuthTokens выпускает access token (JWT). Для разрешений от имени пользователя (forUser)
+// добавляются refresh token, если он разрешён клиенту, и ID token при scope openid.
+func (a *Authenticator) issueOAuthTokens(client *OAuthClient, grant OAuthGrant, forUser bool) (*OAuthTokenResponse, error) {
+	extra := jwt.MapClaims{
+		"client_id": client.ID,
+		"scope":     grant.Scope,
+	}
+	if a.OAuth.Issuer != "" {
+		extra["iss"] = a.OAuth.Issuer
+	}
+	if grant.AuthTime != 0 {
+		extra["auth_time"] = grant.AuthTime
+	}
+	if len(grant.AMR) > 0 {
+		extra["amr"] = grant.AMR
+	}
+	if grant.GrantID != "" {
+		extra["grant_id"] = grant.GrantID
+	}
+
+	token, err := a.JwtService.GenerateJWTWithClaims(grant.UserID, grant.Username, grant.Role, extra)
+	if err != nil {
+		return nil, err
+	}
+	resp := &OAuthTokenResponse{
+		TokenResponse: TokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresIn: int64(a.cfg.JWT.TTL / time.Second)},
+		Scope:         grant.Scope,
+	}
+
+	if forUser && containsString(strings.Fields(grant.Scope), ScopeOpenID) && a.OAuth.Issuer != "" {
+		if resp.IDToken, err = a.issueIDToken(client, grant, token); err != nil {
+			return nil, err
+		}
+	}
+	if forUser && client.allowsGrant(GrantRefreshToken) {
+		grant.CodeChallenge, grant.RedirectURI, grant.Nonce = "", "", ""
+		// Ротация не продлевает цепочку: срок отсчитывается от первого обмена кода
+		if grant.ExpiresAt == 0 {
+			grant.ExpiresAt = time.Now().Add(a.OAuth.RefreshTTL).Unix()
+		}
+		if ttl := time.Until(time.Unix(grant.ExpiresAt, 0)); ttl > 0 {
+			refresh := newOpaqueToken()
+			a.OAuth.RefreshTokens.SetWithTTL(hashOpaqueToken(refresh), grant, ttl)
+			resp.RefreshToken = refresh
+		}
+	}
+	return resp, nil
+}
+
+// verifyPKCE проверяет code_verifier против code_challenge метода S256 (RFC 7636)
+func verifyPKCE(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// grantedScopes проверяет, что запрошенные scope разрешены клиенту; пустой запрос - все разрешённые
+func grantedScopes(requested string, allowed []string) ([]string, bool) {
+	fields := strings.Fields(requested)
+	if len(fields) == 0 {
+		return allowed, true
+	}
+	for _, scope := range fields {
+		if !containsString(allowed, scope) {
+			return nil, false
+		}
+	}
+	return fields, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newOpaqueToken - случайный непрозрачный токен (код авторизации, refresh token, секрет клиента)
+func newOpaqueToken() string {
+	b := make([]byte, oauthTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate token: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryOAuthClientStore - OAuthClientStore в памяти процесса
+type MemoryOAuthClientStore struct {
+	mu      sync.RWMutex
+	clients map[string]*OAuthClient
+}
+
+func NewMemoryOAuthClientStore() *MemoryOAuthClientStore {
+	return &MemoryOAuthClientStore{clients: make(map[string]*OAuthClient)}
+}
+
+func (s *MemoryOAuthClientStore) Client(ctx context.Context, id string) (*OAuthClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	copied := *client
+	return &copied, nil
+}
+
+func (s *MemoryOAuthClientStore) SaveClient(ctx context.Context, client *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *client
+	s.clients[client.ID] = &copied
+	return nil
+}
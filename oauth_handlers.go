@@ -0,0 +1,454 @@
+package access
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// OAuthTokenResponse - ответ /token (RFC 6749 §5.1)
+type OAuthTokenResponse struct {
+	TokenResponse
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// oauthError - ошибка в формате RFC 6749 §5.2, клиенты OAuth ждут её, а не problem+json
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	status      int
+	basic       bool // Клиент аутентифицировался через Basic - нужен WWW-Authenticate
+}
+
+func (e *oauthError) write(w http.ResponseWriter) {
+	status := e.status
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	if status == http.StatusUnauthorized && e.basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+defaultRealm+`"`)
+	}
+	writeJSON(w, status, e)
+}
+
+// MountOAuthRoutes подключает /authorize, /token, /revoke и конечные точки OpenID Connect
+// к роутеру chi. Адрес монтирования должен совпадать с oauth.issuer.
+func (a *Authenticator) MountOAuthRoutes(r chi.Router) {
+	r.Get("/authorize", a.AuthorizeHandler().ServeHTTP)
+	r.Post("/authorize", a.AuthorizeHandler().ServeHTTP)
+	r.Post("/token", a.OAuthTokenHandler().ServeHTTP)
+	r.Post("/revoke", a.OAuthRevokeHandler().ServeHTTP)
+	r.Post("/introspect", a.OAuthIntrospectHandler().ServeHTTP)
+	r.Get("/.well-known/openid-configuration", a.DiscoveryHandler().ServeHTTP)
+	r.Get("/jwks", a.JWKSHandler().ServeHTTP)
+	r.Get("/userinfo", a.UserInfoHandler().ServeHTTP)
+	r.Post("/userinfo", a.UserInfoHandler().ServeHTTP)
+}
+
+// AuthorizeHandler - конечная точка авторизации: только response_type=code и обязательный PKCE S256.
+// Пользователь должен быть уже аутентифицирован (токен или cookie сессии).
+func (a *Authenticator) AuthorizeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Malformed authorization request", Err: err})
+			return
+		}
+		if a.OAuthClients == nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "OAuth is not available", Err: errors.New("oauth client store is not configured")})
+			return
+		}
+
+		// Пока клиент и redirect_uri не проверены, перенаправлять нельзя - отвечаем сами
+		client, err := a.OAuthClients.Client(r.Context(), r.Form.Get("client_id"))
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Unknown client_id", Err: err})
+			return
+		}
+		redirectURI := r.Form.Get("redirect_uri")
+		if redirectURI == "" && len(client.RedirectURIs) == 1 {
+			redirectURI = client.RedirectURIs[0]
+		}
+		if !client.allowsRedirect(redirectURI) {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "redirect_uri is not registered for this client"})
+			return
+		}
+
+		state := r.Form.Get("state")
+		fail := func(code, description string) {
+			redirectWithParams(w, r, redirectURI, url.Values{"error": {code}, "error_description": {description}, "state": {state}})
+		}
+
+		if r.Form.Get("response_type") != "code" {
+			fail("unsupported_response_type", "only response_type=code is supported")
+			return
+		}
+		if !client.allowsGrant(GrantAuthorizationCode) {
+			fail("unauthorized_client", "client may not use the authorization code grant")
+			return
+		}
+		scopes, ok := grantedScopes(r.Form.Get("scope"), client.Scopes)
+		if !ok {
+			fail("invalid_scope", "requested scope is not allowed for this client")
+			return
+		}
+		challenge, method := r.Form.Get("code_challenge"), r.Form.Get("code_challenge_method")
+		if challenge == "" || method != "S256" {
+			fail("invalid_request", "PKCE with code_challenge_method=S256 is required")
+			return
+		}
+
+		// OIDC: вход старше max_age не годится, а при prompt=none нельзя отправлять на страницу входа
+		user := a.currentUser(r)
+		if user != nil && authTooOld(user, r.Form.Get("max_age")) {
+			user = nil
+		}
+		if user == nil {
+			if r.Form.Get("prompt") == "none" {
+				fail("login_required", "the user must authenticate")
+				return
+			}
+			a.loginRequired(w, r)
+			return
+		}
+
+		req := &AuthorizeRequest{
+			Client:              client,
+			User:                user,
+			RedirectURI:         redirectURI,
+			Scopes:              scopes,
+			State:               state,
+			Nonce:               r.Form.Get("nonce"),
+			CodeChallenge:       challenge,
+			CodeChallengeMethod: method,
+		}
+		if a.OAuth.Consent != nil {
+			switch a.OAuth.Consent(w, r, req) {
+			case ConsentDenied:
+				fail("access_denied", "the user denied the request")
+				return
+			case ConsentPending:
+				return
+			}
+		}
+
+		userID, _ := user["user_id"].(float64)
+		username, _ := user["username"].(string)
+		role, _ := user["role"].(string)
+		authTime, _ := user["auth_time"].(float64)
+		code := newOpaqueToken()
+		a.OAuth.Codes.Set(hashOpaqueToken(code), OAuthGrant{
+			ClientID:      client.ID,
+			RedirectURI:   redirectURI,
+			RedirectSent:  r.Form.Get("redirect_uri") != "",
+			Scope:         strings.Join(scopes, " "),
+			UserID:        int(userID),
+			Username:      username,
+			Role:          role,
+			AuthTime:      int64(authTime),
+			AMR:           stringList(user["amr"]),
+			Nonce:         req.Nonce,
+			CodeChallenge: challenge,
+			GrantID:       newTokenID(),
+		})
+		redirectWithParams(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+	})
+}
+
+// currentUser - claims вошедшего пользователя или nil
+func (a *Authenticator) currentUser(r *http.Request) jwt.MapClaims {
+	tokenString := a.extractToken(r)
+	if tokenString == "" {
+		return nil
+	}
+	claims, err := a.JwtService.ParseJWT(tokenString)
+	if err != nil {
+		return nil
+	}
+	// Токен, выданный клиенту OAuth, не подтверждает вход пользователя
+	if _, delegated := claims["client_id"]; delegated {
+		return nil
+	}
+	return claims
+}
+
+// loginRequired отправляет на LoginURL с возвратом на текущий запрос или отвечает 401
+func (a *Authenticator) loginRequired(w http.ResponseWriter, r *http.Request) {
+	if a.OAuth.LoginURL == "" {
+		a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required"})
+		return
+	}
+	target := a.OAuth.LoginURL
+	sep := "?"
+	if strings.Contains(target, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, target+sep+"return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+}
+
+// authTooOld: параметр max_age (секунды) против auth_time; токен без auth_time не подходит
+func authTooOld(user jwt.MapClaims, maxAge string) bool {
+	if maxAge == "" {
+		return false
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil || seconds < 0 {
+		return false
+	}
+	authTime, ok := user["auth_time"].(float64)
+	return !ok || time.Since(time.Unix(int64(authTime), 0)) > time.Duration(seconds)*time.Second
+}
+
+// OAuthTokenHandler - конечная точка /token: authorization_code, client_credentials, refresh_token
+func (a *Authenticator) OAuthTokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			(&oauthError{Code: "invalid_request", Description: "malformed form body"}).write(w)
+			return
+		}
+		client, oerr := a.authenticateClient(r)
+		if oerr != nil {
+			oerr.write(w)
+			return
+		}
+
+		grantType := r.PostForm.Get("grant_type")
+		if !client.allowsGrant(grantType) {
+			(&oauthError{Code: "unauthorized_client", Description: "grant type is not allowed for this client"}).write(w)
+			return
+		}
+
+		var resp *OAuthTokenResponse
+		event := AuthEvent{Action: "oauth", Username: client.ID}
+		switch grantType {
+		case GrantAuthorizationCode:
+			resp, oerr = a.exchangeCode(r, client)
+		case GrantClientCredentials:
+			resp, oerr = a.clientCredentials(r, client)
+		case GrantRefreshToken:
+			resp, oerr = a.refreshGrant(r, client)
+		default:
+			oerr = &oauthError{Code: "unsupported_grant_type", Description: "grant_type is not supported"}
+		}
+		if oerr != nil {
+			a.audit(r, event, oerr.Code)
+			oerr.write(w)
+			return
+		}
+
+		a.audit(r, event, "")
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+func (a *Authenticator) exchangeCode(r *http.Request, client *OAuthClient) (*OAuthTokenResponse, *oauthError) {
+	key := hashOpaqueToken(r.PostForm.Get("code"))
+	// Код одноразовый: из одновременных обменов проходит только один
+	grant, ok := Take(a.OAuth.Codes, key)
+	if !ok {
+		// RFC 6749 §4.1.2: повтор кода означает утечку, поэтому выданные по нему токены отзываются
+		if grantID, used := a.OAuth.UsedCodes.Get(key); used {
+			a.revokeGrant(grantID)
+		}
+		return nil, &oauthError{Code: "invalid_grant", Description: "authorization code is invalid or expired"}
+	}
+	a.OAuth.UsedCodes.Set(key, grant.GrantID)
+	if grant.ClientID != client.ID {
+		return nil, &oauthError{Code: "invalid_grant", Description: "authorization code is invalid or expired"}
+	}
+	// RFC 6749 §4.1.3: redirect_uri обязателен, если был в запросе авторизации
+	if redirectURI := r.PostForm.Get("redirect_uri"); (grant.RedirectSent || redirectURI != "") && redirectURI != grant.RedirectURI {
+		return nil, &oauthError{Code: "invalid_grant", Description: "redirect_uri does not match the authorization request"}
+	}
+	if !verifyPKCE(grant.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		return nil, &oauthError{Code: "invalid_grant", Description: "code_verifier does not match code_challenge"}
+	}
+
+	resp, err := a.issueOAuthTokens(client, grant, true)
+	if err != nil {
+		return nil, &oauthError{Code: "server_error", status: http.StatusInternalServerError}
+	}
+	return resp, nil
+}
+
+func (a *Authenticator) clientCredentials(r *http.Request, client *OAuthClient) (*OAuthTokenResponse, *oauthError) {
+	if client.Public {
+		return nil, &oauthError{Code: "unauthorized_client", Description: "public clients cannot use client_credentials"}
+	}
+	scopes, ok := grantedScopes(r.PostForm.Get("scope"), client.Scopes)
+	if !ok {
+		return nil, &oauthError{Code: "invalid_scope", Description: "requested scope is not allowed for this client"}
+	}
+
+	resp, err := a.issueOAuthTokens(client, OAuthGrant{
+		ClientID: client.ID,
+		Scope:    strings.Join(scopes, " "),
+		Username: client.ID,
+		Role:     client.Role,
+	}, false)
+	if err != nil {
+		return nil, &oauthError{Code: "server_error", status: http.StatusInternalServerError}
+	}
+	return resp, nil
+}
+
+// refreshGrant меняет refresh token на новую пару; старый refresh token больше не действует.
+// Пользователь перечитывается, чтобы отключение или смена роли действовали и для клиентов
+func (a *Authenticator) refreshGrant(r *http.Request, client *OAuthClient) (*OAuthTokenResponse, *oauthError) {
+	key := hashOpaqueToken(r.PostForm.Get("refresh_token"))
+	invalid := &oauthError{Code: "invalid_grant", Description: "refresh token is invalid or expired"}
+	// Из одновременных обновлений одним refresh token проходит только одно
+	grant, ok := Take(a.OAuth.RefreshTokens, key)
+	if !ok || a.grantRevoked(grant.GrantID) {
+		return nil, invalid
+	}
+	// Отказ по вине запроса не сжигает чужой или ещё годный refresh token
+	restore := func() {
+		if ttl := time.Until(time.Unix(grant.ExpiresAt, 0)); ttl > 0 {
+			a.OAuth.RefreshTokens.SetWithTTL(key, grant, ttl)
+		}
+	}
+	if grant.ClientID != client.ID {
+		restore()
+		return nil, invalid
+	}
+
+	// Можно сузить scope, но не расширить
+	if requested := r.PostForm.Get("scope"); requested != "" {
+		scopes, ok := grantedScopes(requested, strings.Fields(grant.Scope))
+		if !ok {
+			restore()
+			return nil, &oauthError{Code: "invalid_scope", Description: "scope exceeds the original grant"}
+		}
+		grant.Scope = strings.Join(scopes, " ")
+	}
+
+	user, err := a.refreshUser(r.Context(), grant.UserID, grant.Username, grant.Role)
+	if errors.Is(err, errBadCredentials) {
+		a.revokeGrant(grant.GrantID)
+		return nil, &oauthError{Code: "invalid_grant", Description: "the user is no longer active"}
+	}
+	if err != nil {
+		restore()
+		return nil, &oauthError{Code: "server_error", status: http.StatusInternalServerError}
+	}
+	grant.Username, grant.Role = user.Username, user.Role
+
+	resp, err := a.issueOAuthTokens(client, grant, true)
+	if err != nil {
+		return nil, &oauthError{Code: "server_error", status: http.StatusInternalServerError}
+	}
+	return resp, nil
+}
+
+// OAuthRevokeHandler - отзыв токенов (RFC 7009). Неизвестный токен - тоже успех.
+func (a *Authenticator) OAuthRevokeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			(&oauthError{Code: "invalid_request", Description: "malformed form body"}).write(w)
+			return
+		}
+		client, oerr := a.authenticateClient(r)
+		if oerr != nil {
+			oerr.write(w)
+			return
+		}
+
+		token := r.PostForm.Get("token")
+		key := hashOpaqueToken(token)
+		if grant, ok := a.OAuth.RefreshTokens.Get(key); ok {
+			// RFC 7009 §2.1: вместе с refresh token отзываются и access token того же разрешения
+			if grant.ClientID == client.ID {
+				a.OAuth.RefreshTokens.Delete(key)
+				a.revokeGrant(grant.GrantID)
+			}
+		} else if claims, err := a.JwtService.ParseJWT(token); err == nil {
+			if clientID, _ := claims["client_id"].(string); clientID == client.ID {
+				// RFC 7009 §2.2.1: если отзыв не сохранился, клиент должен повторить запрос
+				if err := a.JwtService.RevokeJWT(token); errors.Is(err, ErrCacheUnavailable) {
+					(&oauthError{Code: "temporarily_unavailable", status: http.StatusServiceUnavailable}).write(w)
+					return
+				}
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// authenticateClient - client_secret_basic, client_secret_post или только client_id у публичных клиентов
+func (a *Authenticator) authenticateClient(r *http.Request) (*OAuthClient, *oauthError) {
+	if a.OAuthClients == nil {
+		return nil, &oauthError{Code: "server_error", status: http.StatusInternalServerError}
+	}
+
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 §2.3.1: значения в Basic закодированы как form-urlencoded
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	invalid := &oauthError{Code: "invalid_client", Description: "client authentication failed", status: http.StatusUnauthorized, basic: basic}
+
+	client, err := a.OAuthClients.Client(r.Context(), id)
+	if errors.Is(err, ErrClientNotFound) || id == "" {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, &oauthError{Code: "server_error", status: http.StatusInternalServerError}
+	}
+
+	if client.Public {
+		if secret != "" {
+			return nil, invalid
+		}
+		return client, nil
+	}
+	if secret == "" || !a.PasswordHasher.CheckPasswordHash(secret, client.SecretHash) {
+		return nil, invalid
+	}
+	return client, nil
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, target string, params url.Values) {
+	u, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// stringList приводит claim-массив (после JSON - []interface{}) к []string
+func stringList(v interface{}) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package access
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+)
+
+// OIDCDiscovery - документ /.well-known/openid-configuration (OpenID Connect Discovery 1.0)
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// DiscoveryHandler отдаёт метаданные провайдера; адреса строятся от oauth.issuer,
+// поэтому issuer должен совпадать с адресом, где смонтирован MountOAuthRoutes
+func (a *Authenticator) DiscoveryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer := strings.TrimSuffix(a.OAuth.Issuer, "/")
+		if issuer == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "OpenID Connect is not available", Err: errors.New("oauth.issuer is not configured")})
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		writeJSON(w, http.StatusOK, OIDCDiscovery{
+			Issuer:                            issuer,
+			AuthorizationEndpoint:             issuer + "/authorize",
+			TokenEndpoint:                     issuer + "/token",
+			UserInfoEndpoint:                  issuer + "/userinfo",
+			JWKSURI:                           issuer + "/jwks",
+			RevocationEndpoint:                issuer + "/revoke",
+			IntrospectionEndpoint:             issuer + "/introspect",
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{GrantAuthorizationCode, GrantClientCredentials, GrantRefreshToken},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+			ScopesSupported:                   []string{ScopeOpenID, ScopeProfile},
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+			ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "amr", "preferred_username", "role"},
+		})
+	})
+}
+
+// JWKSHandler отдаёт открытые ключи, которыми подписаны ID token
+func (a *Authenticator) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSON(w, http.StatusOK, a.JwtService.JWKS())
+	})
+}
+
+// UserInfoHandler - /userinfo: claims пользователя по access token со scope openid
+func (a *Authenticator) UserInfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := a.extractToken(r)
+		if tokenString == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required"})
+			return
+		}
+		claims, err := a.JwtService.ParseJWT(tokenString)
+		if err != nil {
+			a.reject(w, r, "", tokenError(err))
+			return
+		}
+		scopes := strings.Fields(stringClaim(claims, "scope"))
+		if _, ok := claims["client_id"]; !ok || !containsString(scopes, ScopeOpenID) {
+			a.reject(w, r, "", &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "The access token does not have the openid scope"})
+			return
+		}
+
+		userID, _ := claims["user_id"].(float64)
+		info := map[string]interface{}{"sub": strconv.Itoa(int(userID))}
+		if containsString(scopes, ScopeProfile) {
+			info["preferred_username"] = claims["username"]
+			info["role"] = claims["role"]
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+}
+
+// issueIDToken - ID token (OpenID Connect Core §2) с nonce, at_hash и auth_time
+func (a *Authenticator) issueIDToken(client *OAuthClient, grant OAuthGrant, accessToken string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":     strings.TrimSuffix(a.OAuth.Issuer, "/"),
+		"sub":     strconv.Itoa(grant.UserID),
+		"aud":     client.ID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(a.cfg.JWT.TTL).Unix(),
+		"at_hash": tokenHashClaim(accessToken),
+	}
+	if grant.AuthTime != 0 {
+		claims["auth_time"] = grant.AuthTime
+	}
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+	if len(grant.AMR) > 0 {
+		claims["amr"] = grant.AMR
+	}
+	if containsString(strings.Fields(grant.Scope), ScopeProfile) {
+		claims["preferred_username"] = grant.Username
+		claims["role"] = grant.Role
+	}
+	return a.JwtService.SignRS256(claims)
+}
+
+// tokenHashClaim - левая половина SHA-256 в base64url, как для at_hash при RS256
+func tokenHashClaim(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
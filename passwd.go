@@ -1,22 +1,47 @@
 package access
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"math"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AutoCost = -1 // Подобрать сложность по замеру на текущем хосте
+
+	defaultTargetLatency = 250 * time.Millisecond
+	safeMinCost          = 10 // Ниже автоподбор не опускается, см. cost_test_explanation.txt
+	calibrationCost      = 8
+	calibrationRounds    = 3
+)
 
 type PasswordHasher struct {
 	cost int
 	auth *Authenticator
+
+	// Compare сверяет пароль с хэшем, по умолчанию bcrypt.CompareHashAndPassword
+	Compare func(hash, password []byte) error
 }
 
 func NewPasswordHasher(cost int, auth *Authenticator) *PasswordHasher {
+	if cost == AutoCost {
+		cost = autoCost(auth)
+	}
 	if cost == 0 {
 		cost = bcrypt.DefaultCost
 	}
 	return &PasswordHasher{
-		cost: cost,
-		auth: auth,
+		cost:    cost,
+		auth:    auth,
+		Compare: bcrypt.CompareHashAndPassword,
 	}
 }
 
+func (p *PasswordHasher) Cost() int {
+	return p.cost
+}
+
 func (p *PasswordHasher) HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), p.cost)
 	return string(bytes), err
@@ -24,12 +49,62 @@ func (p *PasswordHasher) HashPassword(password string) (string, error) {
 
 func (p *PasswordHasher) CheckPasswordHash(password, hash string) bool {
 	cacheKey := hash + ":" + password
-	if result, ok := p.auth.passwordCache.Get(cacheKey); ok {
-		return result.(bool)
-	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	result := err == nil
-	p.auth.passwordCache.Set(cacheKey, result)
+	// Одновременные проверки одной пары выполняют bcrypt один раз
+	result, _ := GetOrLoad(p.auth.PasswordCache, cacheKey, func() (bool, time.Duration, error) {
+		err := p.Compare([]byte(hash), []byte(password))
+		return err == nil, p.auth.cfg.Cache.PasswordTTL, nil
+	})
 	return result
 }
+
+func autoCost(auth *Authenticator) int {
+	target := defaultTargetLatency
+	floor := safeMinCost
+	if auth != nil && auth.cfg != nil {
+		if auth.cfg.Password.TargetLatency > 0 {
+			target = auth.cfg.Password.TargetLatency
+		}
+		if auth.cfg.Password.MinCost > floor {
+			floor = auth.cfg.Password.MinCost
+		}
+	}
+
+	// Выбранная сложность видна в PasswordHasher.Cost() и метрике access_password_hash_cost
+	return CalibrateCost(measureCost(calibrationCost), calibrationCost, target, floor)
+}
+
+// CalibrateCost подбирает максимальную сложность, укладывающуюся в target,
+// исходя из времени хэширования measured на сложности base.
+// Каждая единица сложности удваивает время bcrypt.
+func CalibrateCost(measured time.Duration, base int, target time.Duration, floor int) int {
+	cost := floor
+	if measured > 0 && target > measured {
+		cost = base + int(math.Floor(math.Log2(float64(target)/float64(measured))))
+	} else if measured > 0 {
+		cost = base - int(math.Ceil(math.Log2(float64(measured)/float64(target))))
+	}
+
+	if cost < floor {
+		cost = floor
+	}
+	if cost > bcrypt.MaxCost {
+		cost = bcrypt.MaxCost
+	}
+	return cost
+}
+
+// measureCost берёт минимум из нескольких замеров, чтобы отсечь шум планировщика
+func measureCost(cost int) time.Duration {
+	best := time.Duration(math.MaxInt64)
+	for i := 0; i < calibrationRounds; i++ {
+		start := time.Now()
+		if _, err := bcrypt.GenerateFromPassword([]byte("calibration-password"), cost); err != nil {
+			return 0
+		}
+		if d := time.Since(start); d < best {
+			best = d
+		}
+	}
+	return best
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v4"
@@ -19,142 +21,180 @@ const (
 	UserClaimsKey contextKey = "GOMusic_contextKey"
 )
 
-func extractToken(r *http.Request) string {
-	bearerToken := r.Header.Get("Authorization")
-	if bearerToken == "" {
-		return ""
-	}
-	parts := strings.Split(bearerToken, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return ""
-	}
-	return parts[1]
-}
-
 func (a *Authenticator) CheckPermissions(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		a.configMu.RLock()
-		cfg := a.permissionsConfig
-		a.configMu.RUnlock()
+		cfg, err := a.permissions()
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Failed to load permissions configuration", Err: err})
+			return
+		}
 
-		if cfg == nil {
-			if err := a.LoadPermissions(a.cfg.Permissions.Path); err != nil {
-				http.Error(w, "Failed to load permissions configuration", http.StatusInternalServerError)
+		// Ключ машинного клиента превращается в claims той же формы, что и JWT
+		if apiKey := a.apiKeyFromRequest(r); apiKey != "" {
+			start := time.Now()
+			claims, err := a.ResolveAPIKey(r.Context(), apiKey)
+			a.Metrics.ObserveTokenValidation(time.Since(start), err == nil)
+			if err != nil {
+				a.reject(w, r, "", apiKeyError(err))
 				return
 			}
-			a.configMu.RLock()
-			cfg = a.permissionsConfig
-			a.configMu.RUnlock()
+			a.authorize(w, r, next, cfg, claims)
+			return
 		}
 
-		tokenString := extractToken(r)
+		tokenString := a.extractToken(r)
 		if tokenString == "" {
-			http.Error(w, "Authorization required", http.StatusUnauthorized)
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required"})
 			return
 		}
 
-		// Кэширование токена
-		var claims jwt.MapClaims
-		if cachedClaims, ok := a.TokenCache.Get(tokenString); ok {
-			claims = cachedClaims.(jwt.MapClaims)
-		} else {
-			var err error
-			claims, err = a.JwtService.ParseJWT(tokenString)
+		// Токены внешнего провайдера проверяются по его JWKS, роль назначают правила claim_roles
+		if a.IdentityProvider != nil && a.IdentityProvider.Issued(tokenString) {
+			start := time.Now()
+			idpClaims, err := a.parseIdentityToken(tokenString)
+			a.Metrics.ObserveTokenValidation(time.Since(start), err == nil)
 			if err != nil {
-				http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+				a.reject(w, r, "", tokenError(err))
 				return
 			}
-			a.TokenCache.Set(tokenString, claims)
-		}
-
-		role, ok := claims["role"].(string)
-		if !ok {
-			http.Error(w, "Invalid role in token", http.StatusForbidden)
-			return
-		}
-
-		path := r.URL.Path
-		method := r.Method
-
-		// Кэширование прав доступа
-		cacheKey := role + ":" + path + ":" + method
-		if cachedAccess, ok := a.permissionCache.Get(cacheKey); ok {
-			if !cachedAccess.(bool) {
-				http.Error(w, "Access denied", http.StatusForbidden)
+			claims, ok := identityClaims(cfg.ClaimRoles, idpClaims)
+			if !ok {
+				a.reject(w, r, "", &AuthError{Code: ReasonRoleUnknown, Status: http.StatusForbidden, Detail: "Access denied: identity provider claims are not mapped to a role"})
 				return
 			}
-			ctx := context.WithValue(r.Context(), UserClaimsKey, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			a.authorize(w, r, next, cfg, claims)
 			return
 		}
 
-		perms, ok := cfg.Roles[role]
-		if !ok {
-			http.Error(w, "Access denied: role not found", http.StatusForbidden)
+		// ParseJWT сам кэширует claims с учётом срока действия токена
+		start := time.Now()
+		claims, err := a.JwtService.ParseJWT(tokenString)
+		a.Metrics.ObserveTokenValidation(time.Since(start), err == nil)
+		if err != nil {
+			a.reject(w, r, "", tokenError(err))
 			return
 		}
 
-		var hasAccess bool
-		for _, section := range perms.Sections {
-			if strings.HasPrefix(path, section.URL) {
-				switch method {
-				case http.MethodGet, http.MethodHead, http.MethodOptions:
-					if section.CanRead {
-						hasAccess = true
-						break
-					}
-				case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
-					if section.CanWrite {
-						hasAccess = true
-						break
-					}
-				}
-			}
-			if hasAccess {
-				break
+		if a.cfg.Session.Enabled {
+			if err := a.checkCSRF(r, tokenString, claims); err != nil {
+				a.reject(w, r, "", &AuthError{Code: ReasonCSRFFailed, Status: http.StatusForbidden, Detail: "Invalid CSRF token", Err: err})
+				return
 			}
 		}
 
-		a.permissionCache.Set(cacheKey, hasAccess)
+		a.authorize(w, r, next, cfg, claims)
+	})
+}
 
-		if !hasAccess {
-			http.Error(w, "Access denied", http.StatusForbidden)
+// authorize проверяет доступ роли из claims к секции запроса
+func (a *Authenticator) authorize(w http.ResponseWriter, r *http.Request, next http.Handler, cfg *PermissionsConfig, claims jwt.MapClaims) {
+	role, ok := claims["role"].(string)
+	if !ok {
+		a.reject(w, r, "", &AuthError{Code: ReasonRoleInvalid, Status: http.StatusForbidden, Detail: "Invalid role in token"})
+		return
+	}
+
+	path := r.URL.Path
+	method := r.Method
+
+	// Кэширование прав доступа. Решение кэшируется по роли, поэтому ключи
+	// с ограниченными секциями и токены клиентов OAuth его не читают
+	scoped := scopedClaims(claims)
+	cacheKey := cfg.digest + ":" + role + ":" + path + ":" + method
+	if cachedAccess, ok := a.PermissionCache.Get(cacheKey); ok && !scoped {
+		if !cachedAccess {
+			a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Access denied"})
 			return
 		}
-
+		a.Metrics.RecordDecision(role, true, ReasonGranted)
 		ctx := context.WithValue(r.Context(), UserClaimsKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+		return
+	}
+
+	perms, ok := cfg.Roles[role]
+	if !ok {
+		a.reject(w, r, role, &AuthError{Code: ReasonRoleUnknown, Status: http.StatusForbidden, Detail: "Access denied: role not found"})
+		return
+	}
+
+	matched := matchSection(perms.Sections, path)
+	if matched != nil && !sectionPermits(matched, method) {
+		matched = nil
+	}
+
+	// Решение для секций со step-up зависит от самого токена, поэтому не кэшируется
+	if matched == nil || !matched.requiresStepUp() {
+		a.PermissionCache.Set(cacheKey, matched != nil)
+	}
+
+	if matched == nil {
+		a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Access denied"})
+		return
+	}
+	// Ключ с ограниченными секциями или токен клиента OAuth проходит, только если ему
+	// выдана сама совпавшая секция: более общая секция роли не открывает пути узкой
+	if !sectionAllowed(claims, matched) {
+		a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Access denied"})
+		return
+	}
+	if err := checkStepUp(matched, claims, time.Now()); err != nil {
+		a.reject(w, r, role, err)
+		return
+	}
+	a.Metrics.RecordDecision(role, true, ReasonGranted)
+
+	ctx := context.WithValue(r.Context(), UserClaimsKey, claims)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// matchSection выбирает секцию с самым длинным префиксом пути: более узкая секция
+// со своими правами и step-up переопределяет общую независимо от порядка в конфиге.
+// Права общей секции под узкой не действуют: can_write общей секции не открывает
+// запись под узкой секцией только для чтения (до появления step-up хватало любой секции)
+func matchSection(sections []Section, path string) *Section {
+	var matched *Section
+	for i, section := range sections {
+		if !strings.HasPrefix(path, section.URL) {
+			continue
+		}
+		if matched == nil || len(section.URL) > len(matched.URL) {
+			matched = &sections[i]
+		}
+	}
+	return matched
+}
+
+func sectionPermits(section *Section, method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return section.CanRead
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return section.CanWrite
+	}
+	return false
 }
 
 func (a *Authenticator) CheckOwnRecords(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		claims, ok := r.Context().Value(UserClaimsKey).(jwt.MapClaims)
 		if !ok {
-			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authentication required"})
 			return
 		}
 
 		role, ok := claims["role"].(string)
 		userID, okID := claims["user_id"].(float64)
 		if !ok || !okID {
-			http.Error(w, "Invalid user credentials", http.StatusForbidden)
+			a.reject(w, r, "", &AuthError{Code: ReasonClaimsInvalid, Status: http.StatusForbidden, Detail: "Invalid user credentials"})
 			return
 		}
 		intUserID := int(userID)
 
-		a.configMu.RLock()
-		permsConfig := a.permissionsConfig
-		a.configMu.RUnlock()
-
-		if permsConfig == nil {
-			if err := a.LoadPermissions(a.cfg.Permissions.Path); err != nil {
-				http.Error(w, "Configuration error", http.StatusInternalServerError)
-				return
-			}
-			a.configMu.RLock()
-			permsConfig = a.permissionsConfig
-			a.configMu.RUnlock()
+		permsConfig, err := a.permissions()
+		if err != nil {
+			a.reject(w, r, role, &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Configuration error", Err: err})
+			return
 		}
 
 		perms, ok := permsConfig.Roles[role]
@@ -164,14 +204,14 @@ func (a *Authenticator) CheckOwnRecords(next http.Handler) http.Handler {
 		}
 
 		if requestedID := chi.URLParam(r, "id"); requestedID != "" && requestedID != strconv.Itoa(intUserID) {
-			http.Error(w, "Access to this resource is denied", http.StatusForbidden)
+			a.reject(w, r, role, &AuthError{Code: ReasonOwnershipViolation, Status: http.StatusForbidden, Detail: "Access to this resource is denied"})
 			return
 		}
 
 		if isModifyingMethod(r.Method) {
 			bodyBytes, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, "Invalid request", http.StatusBadRequest)
+				a.reject(w, r, role, &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Invalid request", Err: err})
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
@@ -181,7 +221,7 @@ func (a *Authenticator) CheckOwnRecords(next http.Handler) http.Handler {
 					UserID int `json:"user_id"`
 				}
 				if err := json.Unmarshal(bodyBytes, &body); err == nil && body.UserID != 0 && body.UserID != intUserID {
-					http.Error(w, "Data ownership violation", http.StatusForbidden)
+					a.reject(w, r, role, &AuthError{Code: ReasonOwnershipViolation, Status: http.StatusForbidden, Detail: "Data ownership violation"})
 					return
 				}
 			}
@@ -192,6 +232,23 @@ func (a *Authenticator) CheckOwnRecords(next http.Handler) http.Handler {
 	})
 }
 
+// tokenError переводит ошибку разбора токена в ответ без подробностей библиотеки jwt
+func tokenError(err error) *AuthError {
+	if errors.Is(err, ErrTokenExpired) {
+		return &AuthError{Code: ReasonTokenExpired, Status: http.StatusUnauthorized, Detail: "The access token expired", Err: err}
+	}
+	if errors.Is(err, ErrProviderUnavailable) {
+		return &AuthError{Code: ReasonProviderUnavailable, Status: http.StatusServiceUnavailable, Detail: "The identity provider is unavailable", Err: err}
+	}
+	if errors.Is(err, ErrCacheUnavailable) {
+		return &AuthError{Code: ReasonConfigError, Status: http.StatusServiceUnavailable, Detail: "Token revocation is temporarily unavailable", Err: err}
+	}
+	if errors.Is(err, ErrTokenRevoked) {
+		return &AuthError{Code: ReasonTokenRevoked, Status: http.StatusUnauthorized, Detail: "The access token was revoked", Err: err}
+	}
+	return &AuthError{Code: ReasonTokenInvalid, Status: http.StatusUnauthorized, Detail: "The access token is invalid", Err: err}
+}
+
 func isModifyingMethod(method string) bool {
 	switch method {
 	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
@@ -0,0 +1,483 @@
+package access
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisChannel     = "access:invalidate"
+	defaultRedisDialTimeout = 5 * time.Second
+	defaultRedisTimeout     = 500 * time.Millisecond
+	defaultRedisPoolSize    = 8
+	redisReconnectDelay     = time.Second
+	redisScanCount          = "1000"
+)
+
+var errRedisUnavailable = errors.New("redis: backend unavailable")
+
+// RedisBackend - CacheBackend поверх Redis (протокол RESP) без внешних зависимостей.
+// Команды идут через небольшой пул соединений, подписка на инвалидации - через отдельное.
+// Зависший Redis не должен останавливать проверку токенов: каждая команда ограничена
+// Timeout, а после сетевой ошибки команды на redisReconnectDelay сразу завершаются
+// ошибкой и кэши работают только с локальным уровнем.
+type RedisBackend struct {
+	addr     string
+	password string
+	db       int
+	channel  string
+
+	Timeout  time.Duration // Время на команду, включая ожидание свободного соединения
+	PoolSize int           // Сколько команд выполняется одновременно; задаётся до первой команды
+
+	initOnce  sync.Once
+	slots     chan struct{}
+	idle      chan *respConn
+	mu        sync.Mutex
+	downUntil time.Time
+
+	subMu    sync.Mutex
+	handlers []func(string)
+	subConn  *respConn
+	started  bool
+	closed   chan struct{}
+	closeOne sync.Once
+	logger   logFunc // Куда сообщать о сбоях подписки, задаёт UseCacheBackend; под subMu
+}
+
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewRedisBackend(addr, password string, db int, channel string) *RedisBackend {
+	if channel == "" {
+		channel = defaultRedisChannel
+	}
+	return &RedisBackend{
+		addr:     addr,
+		password: password,
+		db:       db,
+		channel:  channel,
+		Timeout:  defaultRedisTimeout,
+		PoolSize: defaultRedisPoolSize,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (r *RedisBackend) init() {
+	r.initOnce.Do(func() {
+		if r.PoolSize <= 0 {
+			r.PoolSize = defaultRedisPoolSize
+		}
+		if r.Timeout <= 0 {
+			r.Timeout = defaultRedisTimeout
+		}
+		r.slots = make(chan struct{}, r.PoolSize)
+		r.idle = make(chan *respConn, r.PoolSize)
+	})
+}
+
+func (r *RedisBackend) Get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return data, true, nil
+}
+
+func (r *RedisBackend) Set(key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return nil
+	}
+	_, err := r.do("SET", key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (r *RedisBackend) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return false, nil
+	}
+	reply, err := r.do("SET", key, string(value), "PX", strconv.FormatInt(ms, 10), "NX")
+	if err != nil {
+		return false, err
+	}
+	// Без NX-записи Redis отвечает nil
+	return reply != nil, nil
+}
+
+// GetDel требует Redis 6.2 или новее
+func (r *RedisBackend) GetDel(key string) ([]byte, bool, error) {
+	reply, err := r.do("GETDEL", key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GETDEL reply %T", reply)
+	}
+	return data, true, nil
+}
+
+func (r *RedisBackend) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := r.do(append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+func (r *RedisBackend) Keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", escapeRedisPattern(prefix)+"*", "COUNT", redisScanCount)
+		if err != nil {
+			return nil, err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %T", reply)
+		}
+		next, _ := parts[0].([]byte)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if k, ok := key.([]byte); ok {
+				keys = append(keys, string(k))
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func (r *RedisBackend) Publish(message string) error {
+	_, err := r.do("PUBLISH", r.channel, message)
+	return err
+}
+
+// Subscribe регистрирует обработчик; при первом вызове запускается фоновая подписка
+// на канал инвалидаций с переподключением при обрыве связи.
+func (r *RedisBackend) setLogger(logger logFunc) {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	r.logger = logger
+}
+
+func (r *RedisBackend) Subscribe(handler func(message string)) error {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+
+	r.handlers = append(r.handlers, handler)
+	if !r.started {
+		r.started = true
+		go r.subscribeLoop()
+	}
+	return nil
+}
+
+func (r *RedisBackend) Close() error {
+	r.closeOne.Do(func() {
+		close(r.closed)
+
+		r.subMu.Lock()
+		if r.subConn != nil {
+			r.subConn.Close()
+		}
+		r.subMu.Unlock()
+
+		r.init()
+	drain:
+		for {
+			select {
+			case conn := <-r.idle:
+				conn.Close()
+			default:
+				break drain
+			}
+		}
+	})
+	return nil
+}
+
+func (r *RedisBackend) do(args ...string) (interface{}, error) {
+	r.init()
+	select {
+	case <-r.closed:
+		return nil, errors.New("redis: backend closed")
+	default:
+	}
+
+	r.mu.Lock()
+	down := time.Now().Before(r.downUntil)
+	r.mu.Unlock()
+	if down {
+		return nil, errRedisUnavailable
+	}
+
+	deadline := time.Now().Add(r.Timeout)
+	timer := time.NewTimer(r.Timeout)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: no free connection in %s", errRedisUnavailable, r.Timeout)
+	}
+	defer func() { <-r.slots }()
+
+	var conn *respConn
+	select {
+	case conn = <-r.idle:
+	default:
+		var err error
+		if conn, err = r.dial(true, deadline); err != nil {
+			r.markDown()
+			return nil, err
+		}
+	}
+
+	conn.SetDeadline(deadline)
+	reply, err := conn.call(args...)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// Сетевая ошибка или таймаут - соединение больше не годится
+		conn.Close()
+		r.markDown()
+		return nil, err
+	}
+
+	select {
+	case <-r.closed:
+		conn.Close()
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// markDown на время redisReconnectDelay отказывает командам без обращения к серверу
+func (r *RedisBackend) markDown() {
+	r.mu.Lock()
+	r.downUntil = time.Now().Add(redisReconnectDelay)
+	r.mu.Unlock()
+}
+
+// dial открывает соединение; deadline ограничивает подключение и AUTH/SELECT,
+// нулевой deadline - только подключение defaultRedisDialTimeout
+func (r *RedisBackend) dial(selectDB bool, deadline time.Time) (*respConn, error) {
+	timeout := defaultRedisDialTimeout
+	if !deadline.IsZero() {
+		timeout = time.Until(deadline)
+	}
+	netConn, err := net.DialTimeout("tcp", r.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := newRespConn(netConn)
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if r.password != "" {
+		if _, err := conn.call("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if selectDB && r.db != 0 {
+		if _, err := conn.call("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (r *RedisBackend) subscribeLoop() {
+	for {
+		err := r.subscribeOnce()
+
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+		if err != nil {
+			r.subMu.Lock()
+			logger := r.logger
+			r.subMu.Unlock()
+			logger.log(slog.LevelError, "access: cache backend subscription failed", "error", err)
+		}
+
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(redisReconnectDelay):
+		}
+	}
+}
+
+func (r *RedisBackend) subscribeOnce() error {
+	conn, err := r.dial(false, time.Time{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.subMu.Lock()
+	select {
+	case <-r.closed:
+		r.subMu.Unlock()
+		return nil
+	default:
+	}
+	r.subConn = conn
+	r.subMu.Unlock()
+
+	if err := conn.send("SUBSCRIBE", r.channel); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		// Сообщения приходят как ["message", channel, payload]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		payload, _ := parts[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		r.subMu.Lock()
+		handlers := append([]func(string){}, r.handlers...)
+		r.subMu.Unlock()
+		for _, handler := range handlers {
+			handler(string(payload))
+		}
+	}
+}
+
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, ch := range s {
+		switch ch {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// respConn - соединение с разбором протокола RESP2
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRespConn(conn net.Conn) *respConn {
+	return &respConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+func (c *respConn) call(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *respConn) send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.w.Flush()
+}
+
+func (c *respConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
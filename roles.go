@@ -1,8 +1,11 @@
 package access
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,15 +16,27 @@ type RolePermissions struct {
 	OwnRecordsOnly bool      `yaml:"own_records_only"` //Доступ к записям только по своему ID
 }
 
+// Section - права роли на URL с префиксом URL. Если префиксы нескольких секций роли
+// подходят к пути, действует только секция с самым длинным префиксом
 type Section struct {
 	Name     string `yaml:"name"` // Название секции
 	URL      string `yaml:"url"`  // URL секции
 	CanRead  bool   `yaml:"can_read"`
 	CanWrite bool   `yaml:"can_write"`
+
+	RequireMFA bool          `yaml:"require_mfa"`  // Нужен токен, прошедший второй фактор
+	MaxAuthAge time.Duration `yaml:"max_auth_age"` // Максимальный возраст аутентификации (auth_time)
 }
 
 type PermissionsConfig struct {
-	Roles map[string]RolePermissions `yaml:"roles"`
+	Roles        map[string]RolePermissions `yaml:"roles"`
+	Certificates []CertificateRule          `yaml:"certificates"` // Роли для клиентских сертификатов mTLS
+	ClaimRoles   []ClaimRoleRule            `yaml:"claim_roles"`  // Роли для токенов внешнего OIDC-провайдера
+	LDAPGroups   []GroupRoleRule            `yaml:"ldap_groups"`  // Роли для групп каталога LDAP
+
+	// Хэш содержимого файла. Входит в ключи кэша прав: в общем хранилище реплики
+	// с разными файлами прав (например, во время выкладки) не видят решения друг друга
+	digest string
 }
 
 var (
@@ -40,6 +55,8 @@ func LoadPermissions(path string) (*PermissionsConfig, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	sum := sha256.Sum256(data)
+	cfg.digest = hex.EncodeToString(sum[:8])
 
 	return &cfg, nil
 }
@@ -0,0 +1,153 @@
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultSessionCookie = "access_token"
+	defaultCSRFCookie    = "csrf_token"
+	defaultCSRFHeader    = "X-CSRF-Token"
+)
+
+var ErrCSRFTokenInvalid = errors.New("invalid CSRF token")
+
+func (a *Authenticator) sessionCookieName() string {
+	if a.cfg.Session.CookieName != "" {
+		return a.cfg.Session.CookieName
+	}
+	return defaultSessionCookie
+}
+
+func (a *Authenticator) csrfCookieName() string {
+	if a.cfg.Session.CSRFCookieName != "" {
+		return a.cfg.Session.CSRFCookieName
+	}
+	return defaultCSRFCookie
+}
+
+func (a *Authenticator) csrfHeader() string {
+	if a.cfg.Session.CSRFHeader != "" {
+		return a.cfg.Session.CSRFHeader
+	}
+	return defaultCSRFHeader
+}
+
+func (a *Authenticator) sameSite() http.SameSite {
+	switch strings.ToLower(a.cfg.Session.SameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// StartSession выпускает токен и кладёт его в HttpOnly cookie вместе с CSRF-токеном
+func (a *Authenticator) StartSession(w http.ResponseWriter, userID int, username, role string) (string, error) {
+	token, err := a.JwtService.GenerateJWT(userID, username, role)
+	if err != nil {
+		return "", err
+	}
+	claims, err := a.JwtService.ParseJWT(token)
+	if err != nil {
+		return "", err
+	}
+	a.SetSessionCookies(w, token, claims)
+	return token, nil
+}
+
+// SetSessionCookies ставит cookie сессии для уже выпущенного токена
+func (a *Authenticator) SetSessionCookies(w http.ResponseWriter, token string, claims jwt.MapClaims) {
+	jti, _ := claims["jti"].(string)
+	maxAge := int(a.cfg.JWT.TTL / time.Second)
+
+	http.SetCookie(w, a.sessionCookie(a.sessionCookieName(), token, maxAge, true))
+	// CSRF-cookie должна читаться скриптом клиента, поэтому без HttpOnly
+	http.SetCookie(w, a.sessionCookie(a.csrfCookieName(), a.CSRFToken(jti), maxAge, false))
+}
+
+// ClearSessionCookies удаляет cookie сессии, например при выходе
+func (a *Authenticator) ClearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, a.sessionCookie(a.sessionCookieName(), "", -1, true))
+	http.SetCookie(w, a.sessionCookie(a.csrfCookieName(), "", -1, false))
+}
+
+func (a *Authenticator) sessionCookie(name, value string, maxAge int, httpOnly bool) *http.Cookie {
+	path := a.cfg.Session.Path
+	if path == "" {
+		path = "/"
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   a.cfg.Session.Domain,
+		MaxAge:   maxAge,
+		Secure:   !a.cfg.Session.InsecureCookies,
+		HttpOnly: httpOnly,
+		SameSite: a.sameSite(),
+	}
+}
+
+// CSRFToken - синхронизирующий токен, привязанный к jti сессии
+func (a *Authenticator) CSRFToken(jti string) string {
+	mac := hmac.New(sha256.New, a.csrfKey())
+	mac.Write([]byte(jti))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *Authenticator) csrfKey() []byte {
+	secret := a.cfg.Session.CSRFSecret
+	if secret == "" {
+		secret = a.cfg.JWT.Secret
+	}
+	key := sha256.Sum256([]byte("csrf:" + secret))
+	return key[:]
+}
+
+// checkCSRF проверяет CSRF-токен изменяющих запросов, если токен пришёл из cookie сессии.
+// Запросы с токеном в заголовке браузер сам не отправляет, для них проверка не нужна.
+func (a *Authenticator) checkCSRF(r *http.Request, tokenString string, claims jwt.MapClaims) error {
+	if !isModifyingMethod(r.Method) {
+		return nil
+	}
+	cookie, err := r.Cookie(a.sessionCookieName())
+	if err != nil || cookie.Value != tokenString {
+		return nil
+	}
+
+	jti, _ := claims["jti"].(string)
+	got := r.Header.Get(a.csrfHeader())
+	if jti == "" || got == "" || !hmac.Equal([]byte(got), []byte(a.CSRFToken(jti))) {
+		return ErrCSRFTokenInvalid
+	}
+	return nil
+}
+
+// CSRFProtect - отдельный middleware проверки CSRF для маршрутов без CheckPermissions
+func (a *Authenticator) CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := a.extractToken(r)
+		if tokenString != "" && isModifyingMethod(r.Method) {
+			claims, err := a.JwtService.ParseJWT(tokenString)
+			if err != nil {
+				a.reject(w, r, "", tokenError(err))
+				return
+			}
+			if err := a.checkCSRF(r, tokenString, claims); err != nil {
+				a.reject(w, r, "", &AuthError{Code: ReasonCSRFFailed, Status: http.StatusForbidden, Detail: "Invalid CSRF token", Err: err})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package access
+
+import "sync"
+
+// flightCall - загрузка значения, которую ждут все конкурентные вызовы с тем же ключом
+type flightCall[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+}
+
+// flightGroup схлопывает одновременные загрузки одного ключа в один вызов
+type flightGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*flightCall[V]
+}
+
+func (g *flightGroup[K, V]) do(key K, fn func() (V, error)) (V, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*flightCall[V])
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+
+	call := &flightCall[V]{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.val, call.err = fn()
+	return call.val, call.err
+}
@@ -0,0 +1,55 @@
+package access
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// StepUpChallenge сообщает клиенту, какой аутентификации не хватает
+type StepUpChallenge struct {
+	RequireMFA bool `json:"require_mfa,omitempty"`
+	MaxAge     int  `json:"max_auth_age,omitempty"` // секунды
+}
+
+func (s *Section) requiresStepUp() bool {
+	return s.RequireMFA || s.MaxAuthAge > 0
+}
+
+// checkStepUp проверяет claims mfa/amr и auth_time против требований секции
+func checkStepUp(section *Section, claims jwt.MapClaims, now time.Time) *AuthError {
+	if !section.requiresStepUp() {
+		return nil
+	}
+
+	challenge := &StepUpChallenge{RequireMFA: section.RequireMFA}
+	if section.MaxAuthAge > 0 {
+		challenge.MaxAge = int(section.MaxAuthAge / time.Second)
+	}
+
+	if section.RequireMFA && !hasMFA(claims) {
+		return &AuthError{Code: ReasonStepUpRequired, Status: http.StatusUnauthorized, Detail: "Two-factor authentication required", StepUp: challenge}
+	}
+	if section.MaxAuthAge > 0 {
+		authTime, ok := claimTime(claims, "auth_time")
+		if !ok || now.Sub(authTime) > section.MaxAuthAge {
+			return &AuthError{Code: ReasonStepUpRequired, Status: http.StatusUnauthorized, Detail: "Recent authentication required", StepUp: challenge}
+		}
+	}
+	return nil
+}
+
+// hasMFA: claim mfa или значение "mfa" в amr (RFC 8176)
+func hasMFA(claims jwt.MapClaims) bool {
+	if mfa, _ := claims["mfa"].(bool); mfa {
+		return true
+	}
+	amr, _ := claims["amr"].([]interface{})
+	for _, method := range amr {
+		if method == "mfa" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package access_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	auth := newTestAuthenticator(t, "")
+	store := access.NewMemoryAPIKeyStore()
+	auth.APIKeys = store
+	ctx := context.Background()
+
+	var seen jwt.MapClaims
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = r.Context().Value(access.UserClaimsKey).(jwt.MapClaims)
+		w.WriteHeader(http.StatusOK)
+	}))
+	call := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	scopedKey, scoped, err := auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "cron", Role: "admin", OwnerID: 7, Sections: []string{"admin_users"}})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(scopedKey, "ak_"+scoped.ID+"_"))
+	assert.NotEqual(t, scopedKey, scoped.Hash)
+
+	t.Run("ScopedSections", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call("/api/admin/users", scopedKey).Code)
+		assert.Equal(t, "admin", seen["role"])
+		assert.Equal(t, scoped.ID, seen["api_key_id"])
+		assert.Equal(t, float64(7), seen["user_id"])
+
+		// Роль admin видит /api/admin/system, но ключ ограничен admin_users
+		assert.Equal(t, http.StatusForbidden, call("/api/admin/system", scopedKey).Code)
+	})
+
+	t.Run("ScopedNarrowSectionAfterBroader", func(t *testing.T) {
+		// У роли auditor /api/reports идёт раньше /api/reports/exports
+		key, _, err := auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "export", Role: "auditor", Sections: []string{"reports_exports"}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, call("/api/reports/exports/2024", key).Code)
+		assert.Equal(t, http.StatusForbidden, call("/api/reports/daily", key).Code)
+
+		// Общая секция не открывает пути более узкой, не выданной ключу
+		broad, _, err := auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "reports", Role: "auditor", Sections: []string{"reports"}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, call("/api/reports/daily", broad).Code)
+		assert.Equal(t, http.StatusForbidden, call("/api/reports/exports/2024", broad).Code)
+	})
+
+	t.Run("Unscoped", func(t *testing.T) {
+		key, _, err := auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "partner", Role: "admin"})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, call("/api/admin/system", key).Code)
+		assert.Equal(t, http.StatusForbidden, call("/api/mod/posts", key).Code)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		rr := call("/api/admin/users", scopedKey[:len(scopedKey)-2]+"xx")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, access.ReasonTokenInvalid, problemCode(t, rr))
+		assert.Equal(t, http.StatusUnauthorized, call("/api/admin/users", "nope").Code)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		key, created, err := auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "short", Role: "admin", TTL: time.Hour})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, call("/api/admin/users", key).Code)
+
+		past := time.Now().Add(-time.Minute)
+		created.ExpiresAt = &past
+		store.SaveAPIKey(ctx, created)
+		auth.APIKeyCache.Clear()
+
+		rr := call("/api/admin/users", key)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, access.ReasonTokenExpired, problemCode(t, rr))
+	})
+
+	t.Run("StoredHashIsNotAToken", func(t *testing.T) {
+		// Хэш из хранилища не должен заменять сам ключ ни в одном из заголовков
+		assert.Equal(t, http.StatusOK, call("/api/admin/users", scopedKey).Code)
+		for _, token := range []string{"apikey:" + scoped.Hash, scoped.Hash} {
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, token)
+		}
+		assert.Equal(t, http.StatusUnauthorized, call("/api/admin/users", scoped.Hash).Code)
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		// Ключ уже в кэше после первого запроса, отзыв должен его оттуда убрать
+		assert.Equal(t, http.StatusOK, call("/api/admin/users", scopedKey).Code)
+		assert.NoError(t, auth.RevokeAPIKey(ctx, scoped.ID))
+
+		rr := call("/api/admin/users", scopedKey)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, access.ReasonTokenRevoked, problemCode(t, rr))
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, _, err := auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "x", Role: "ghost"})
+		assert.Error(t, err)
+		_, _, err = auth.CreateAPIKey(ctx, access.APIKeyRequest{Name: "x", Role: "user", Sections: []string{"admin_users"}})
+		assert.Error(t, err)
+	})
+}
+
+func TestAPIKeyRoutes(t *testing.T) {
+	auth := newTestAuthenticator(t, "api_keys:\n  assignable_roles:\n    admin: [moderator]\n  admin_roles: [admin]\n")
+	auth.APIKeys = access.NewMemoryAPIKeyStore()
+	router := chi.NewRouter()
+
+	// Вместо CheckPermissions маршруты получают claims вызывающего из заголовков теста
+	router.With(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID := 5
+			if u := r.Header.Get("X-User"); u != "" {
+				userID, _ = strconv.Atoi(u)
+			}
+			claims := jwt.MapClaims{"user_id": float64(userID), "role": r.Header.Get("X-Role")}
+			if s := r.Header.Get("X-Sections"); s != "" {
+				claims["sections"] = []interface{}{s}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), access.UserClaimsKey, claims)))
+		})
+	}).Route("/keys", auth.MountAPIKeyRoutes)
+
+	doAsUser := func(userID int, role, sections, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("X-User", strconv.Itoa(userID))
+		req.Header.Set("X-Role", role)
+		req.Header.Set("X-Sections", sections)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	doAs := func(role, sections, method, path string, body interface{}) *httptest.ResponseRecorder {
+		return doAsUser(5, role, sections, method, path, body)
+	}
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		return doAs("admin", "", method, path, body)
+	}
+
+	rr := do(http.MethodPost, "/keys/", map[string]interface{}{"name": "cron", "role": "moderator", "owner_id": 1})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	assert.NotEmpty(t, created["key"])
+	assert.Equal(t, "moderator", created["role"])
+	// Владелец берётся из токена вызывающего, а не из запроса
+	assert.Equal(t, float64(5), created["owner_id"])
+
+	rr = do(http.MethodGet, "/keys/", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), created["key"])
+	var listed []access.APIKey
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	assert.Len(t, listed, 1)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/keys/"+listed[0].ID, nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/keys/unknown", nil).Code)
+
+	rr = do(http.MethodGet, "/keys/", nil)
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	assert.NotNil(t, listed[0].RevokedAt)
+
+	t.Run("Grant limits", func(t *testing.T) {
+		// moderator не может выпустить ключ admin
+		rr := doAs("moderator", "", http.MethodPost, "/keys/", map[string]interface{}{"name": "x", "role": "admin"})
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		// admin не назначает роли вне assignable_roles
+		assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/keys/", map[string]interface{}{"name": "x", "role": "user"}).Code)
+		// Ключ с секциями не выпускает ключ шире себя
+		assert.Equal(t, http.StatusForbidden, doAs("admin", "admin_users", http.MethodPost, "/keys/", map[string]interface{}{"name": "x", "role": "admin"}).Code)
+		assert.Equal(t, http.StatusForbidden, doAs("admin", "admin_users", http.MethodPost, "/keys/", map[string]interface{}{"name": "x", "role": "admin", "sections": []string{"admin_system"}}).Code)
+		assert.Equal(t, http.StatusCreated, doAs("admin", "admin_users", http.MethodPost, "/keys/", map[string]interface{}{"name": "x", "role": "admin", "sections": []string{"admin_users"}}).Code)
+	})
+
+	t.Run("Owner scoping", func(t *testing.T) {
+		rr := doAsUser(6, "moderator", "", http.MethodPost, "/keys/", map[string]interface{}{"name": "own", "role": "moderator"})
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		var own access.APIKey
+		json.Unmarshal(rr.Body.Bytes(), &own)
+
+		// Не-администратор видит только свои ключи
+		var listed []access.APIKey
+		json.Unmarshal(doAsUser(6, "moderator", "", http.MethodGet, "/keys/", nil).Body.Bytes(), &listed)
+		if assert.Len(t, listed, 1) {
+			assert.Equal(t, own.ID, listed[0].ID)
+		}
+
+		// И не отзывает чужие
+		json.Unmarshal(do(http.MethodGet, "/keys/", nil).Body.Bytes(), &listed)
+		assert.Greater(t, len(listed), 1)
+		var foreign string
+		for _, key := range listed {
+			if key.OwnerID != 6 && key.RevokedAt == nil {
+				foreign = key.ID
+			}
+		}
+		assert.Equal(t, http.StatusNotFound, doAsUser(6, "moderator", "", http.MethodDelete, "/keys/"+foreign, nil).Code)
+		// Ключ с секциями не получает прав администратора
+		assert.Equal(t, http.StatusNotFound, doAs("admin", "admin_users", http.MethodDelete, "/keys/"+own.ID, nil).Code)
+
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/keys/"+own.ID, nil).Code)
+		assert.Equal(t, http.StatusNoContent, doAsUser(5, "moderator", "", http.MethodDelete, "/keys/"+foreign, nil).Code)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		for _, ttl := range []interface{}{3600, "1h"} {
+			rr := do(http.MethodPost, "/keys/", map[string]interface{}{"name": "ttl", "role": "admin", "ttl": ttl})
+			assert.Equal(t, http.StatusCreated, rr.Code)
+			var key access.APIKey
+			json.Unmarshal(rr.Body.Bytes(), &key)
+			if assert.NotNil(t, key.ExpiresAt) {
+				assert.WithinDuration(t, time.Now().Add(time.Hour), *key.ExpiresAt, time.Minute)
+			}
+		}
+		for _, ttl := range []interface{}{"soon", -60, true} {
+			rr := do(http.MethodPost, "/keys/", map[string]interface{}{"name": "ttl", "role": "admin", "ttl": ttl})
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package access_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+	return path
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(hash)
+}
+
+func TestBasicAuth(t *testing.T) {
+	// Apache htpasswd пишет bcrypt с префиксом $2y$
+	apacheHash := "$2y$" + strings.TrimPrefix(bcryptHash(t, "probe-pass"), "$2a$")
+	path := writeHtpasswd(t,
+		"# health checkers",
+		"probe:"+apacheHash,
+		"ops:"+bcryptHash(t, "ops-pass")+":admin",
+	)
+	auth := newTestAuthenticator(t, "basic:\n  htpasswd: \""+filepath.ToSlash(path)+"\"\n  default_role: moderator\n")
+	lockout := access.NewLockout(2, time.Minute)
+	auth.Hooks = access.AuthHooks{Locked: lockout.Locked, Attempt: lockout.Attempt, Audit: lockout.Audit}
+
+	handler := auth.BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	call := func(path, username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := call("/api/mod/queue", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Basic realm="access", charset="UTF-8"`, rr.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(t, http.StatusOK, call("/api/mod/queue", "probe", "probe-pass").Code)
+	assert.Equal(t, http.StatusForbidden, call("/api/admin/users", "probe", "probe-pass").Code)
+	assert.Equal(t, http.StatusOK, call("/api/admin/users", "ops", "ops-pass").Code)
+
+	rr = call("/api/admin/users", "ops", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, access.ReasonBadCredentials, problemCode(t, rr))
+	assert.True(t, strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Basic "))
+	assert.Equal(t, http.StatusUnauthorized, call("/api/admin/users", "nobody", "ops-pass").Code)
+
+	t.Run("Lockout", func(t *testing.T) {
+		call("/api/admin/users", "ops", "wrong")
+		assert.Equal(t, http.StatusTooManyRequests, call("/api/admin/users", "ops", "ops-pass").Code)
+	})
+}
+
+func TestBasicAuthUserLookup(t *testing.T) {
+	auth := newTestAuthenticator(t, "")
+	hash := bcryptHash(t, "secret")
+	auth.UserLookup = func(ctx context.Context, username string) (*access.User, error) {
+		if username == "admin" {
+			return &access.User{ID: 1, Username: "admin", Role: "admin", PasswordHash: hash}, nil
+		}
+		return nil, nil
+	}
+
+	handler := auth.BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/system", nil)
+	req.SetBasicAuth("admin", "secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestBasicAuthAuditsChanges(t *testing.T) {
+	path := writeHtpasswd(t, "ops:"+bcryptHash(t, "ops-pass")+":admin")
+	auth := newTestAuthenticator(t, "basic:\n  htpasswd: \""+filepath.ToSlash(path)+"\"\n")
+	var events []access.AuthEvent
+	auth.Hooks.Audit = func(r *http.Request, event access.AuthEvent) { events = append(events, event) }
+	lookups := 0
+	lookup := auth.BasicLookup
+	auth.BasicLookup = func(ctx context.Context, username string) (*access.User, error) {
+		lookups++
+		return lookup(ctx, username)
+	}
+
+	handler := auth.BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	call := func(password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+		req.SetBasicAuth("ops", password)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, call("ops-pass"))
+	}
+	assert.Equal(t, http.StatusUnauthorized, call("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, call("wrong"))
+
+	// Повторные успешные запросы берутся из кэша проверок и не пишутся в аудит
+	assert.Equal(t, 3, lookups)
+	if assert.Len(t, events, 3) {
+		assert.True(t, events[0].Success)
+		assert.Equal(t, access.StableUserID("ops"), events[0].UserID)
+		assert.False(t, events[1].Success)
+	}
+}
+
+func TestHtpasswdUserIDs(t *testing.T) {
+	path := writeHtpasswd(t,
+		"alice:"+bcryptHash(t, "a"),
+		"bob:"+bcryptHash(t, "b")+"::42",
+	)
+	lookup, err := access.HtpasswdLookup(path, "user")
+	assert.NoError(t, err)
+
+	alice, _ := lookup(context.Background(), "alice")
+	bob, _ := lookup(context.Background(), "bob")
+	assert.Equal(t, access.StableUserID("alice"), alice.ID)
+	assert.Equal(t, 42, bob.ID)
+	assert.Equal(t, "user", bob.Role)
+
+	// Идентификатор не зависит от положения строки в файле
+	reordered, err := access.HtpasswdLookup(writeHtpasswd(t, "# moved", "bob:"+bcryptHash(t, "b")+"::42", "alice:"+bcryptHash(t, "a")), "user")
+	assert.NoError(t, err)
+	moved, _ := reordered(context.Background(), "alice")
+	assert.Equal(t, alice.ID, moved.ID)
+
+	_, err = access.HtpasswdLookup(writeHtpasswd(t, "a:"+bcryptHash(t, "a")+":user:7", "b:"+bcryptHash(t, "b")+":user:7"), "user")
+	assert.Error(t, err)
+	_, err = access.HtpasswdLookup(writeHtpasswd(t, "a:"+bcryptHash(t, "a")+":user:x"), "user")
+	assert.Error(t, err)
+}
+
+func TestHtpasswdRejectsNonBcrypt(t *testing.T) {
+	path := writeHtpasswd(t, "legacy:$apr1$abcdefgh$0123456789abcdefghijkl")
+	_, err := access.HtpasswdLookup(path, "user")
+	assert.Error(t, err)
+
+	_, err = access.NewAuthenticator(writeTestConfig(t, "basic:\n  htpasswd: \""+filepath.ToSlash(path)+"\"\n"))
+	assert.Error(t, err)
+}
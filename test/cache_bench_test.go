@@ -0,0 +1,88 @@
+package access_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+)
+
+// Сравнение кэша с одной блокировкой и шардированного под параллельной нагрузкой:
+//
+//	go test ./test -run '^$' -bench BenchmarkCache -cpu 1,4,16
+const benchKeys = 10000
+
+func benchCaches() map[string]func() access.Cache[string, bool] {
+	return map[string]func() access.Cache[string, bool]{
+		"Single": func() access.Cache[string, bool] {
+			return access.NewLRUCache[string, bool](time.Minute, benchKeys*2)
+		},
+		"Sharded16": func() access.Cache[string, bool] {
+			return access.NewShardedCache[bool](time.Minute, benchKeys*2, 16)
+		},
+		"Sharded64": func() access.Cache[string, bool] {
+			return access.NewShardedCache[bool](time.Minute, benchKeys*2, 64)
+		},
+	}
+}
+
+func benchKeySet() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:/api/users/%d:GET", i)
+	}
+	return keys
+}
+
+// BenchmarkCache_ParallelGet - только чтения, как при повторных запросах в CheckPermissions
+func BenchmarkCache_ParallelGet(b *testing.B) {
+	keys := benchKeySet()
+	for name, newCache := range benchCaches() {
+		b.Run(name, func(b *testing.B) {
+			cache := newCache()
+			for _, key := range keys {
+				cache.Set(key, true)
+			}
+
+			var seq atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seq.Add(1) * 7919
+				for pb.Next() {
+					cache.Get(keys[i%benchKeys])
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCache_ParallelMixed - 90% чтений, 10% записей
+func BenchmarkCache_ParallelMixed(b *testing.B) {
+	keys := benchKeySet()
+	for name, newCache := range benchCaches() {
+		b.Run(name, func(b *testing.B) {
+			cache := newCache()
+			for _, key := range keys {
+				cache.Set(key, true)
+			}
+
+			var seq atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seq.Add(1) * 7919
+				for pb.Next() {
+					key := keys[i%benchKeys]
+					if i%10 == 0 {
+						cache.Set(key, true)
+					} else {
+						cache.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,13 +1,21 @@
 package access_test
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestMemoryCache(t *testing.T) {
@@ -74,6 +82,475 @@ func TestMemoryCache(t *testing.T) {
 	})
 }
 
+func TestLRUCache(t *testing.T) {
+	t.Run("Evicts least recently used", func(t *testing.T) {
+		cache := access.NewLRUCache[string, int](time.Minute, 2)
+		cache.Set("a", 1)
+		cache.Set("b", 2)
+
+		// Обращение к "a" делает её свежее "b"
+		_, ok := cache.Get("a")
+		assert.True(t, ok)
+
+		cache.Set("c", 3)
+		assert.Equal(t, 2, cache.Len())
+
+		_, ok = cache.Get("b")
+		assert.False(t, ok)
+		_, ok = cache.Get("a")
+		assert.True(t, ok)
+		_, ok = cache.Get("c")
+		assert.True(t, ok)
+	})
+
+	t.Run("Update does not grow cache", func(t *testing.T) {
+		cache := access.NewLRUCache[string, int](time.Minute, 2)
+		for i := 0; i < 10; i++ {
+			cache.Set("key", i)
+		}
+		assert.Equal(t, 1, cache.Len())
+
+		val, ok := cache.Get("key")
+		assert.True(t, ok)
+		assert.Equal(t, 9, val)
+	})
+
+	t.Run("Bounded under many distinct keys", func(t *testing.T) {
+		cache := access.NewLRUCache[string, bool](time.Minute, 100)
+		for i := 0; i < 10000; i++ {
+			cache.Set(fmt.Sprintf("user:/users/%d:GET", i), true)
+		}
+		assert.Equal(t, 100, cache.Len())
+	})
+
+	t.Run("Bounded by bytes", func(t *testing.T) {
+		sizeOf := func(key string, value string) int64 { return int64(len(value)) }
+		cache := access.NewLRUCache[string, string](time.Minute, 0).LimitBytes(10, sizeOf)
+		cache.Set("a", "1234")
+		cache.Set("b", "1234")
+		cache.Set("c", "1234")
+		assert.Equal(t, 2, cache.Len())
+		assert.EqualValues(t, 8, cache.Stats().Bytes)
+		_, ok := cache.Get("a")
+		assert.False(t, ok)
+
+		// Обновление пересчитывает размер записи
+		cache.Set("c", "123456")
+		assert.Equal(t, 2, cache.Len())
+		assert.EqualValues(t, 10, cache.Stats().Bytes)
+
+		// Запись больше всего кэша не сохраняется и не вытесняет остальные
+		cache.Set("d", "12345678901")
+		_, ok = cache.Get("d")
+		assert.False(t, ok)
+		assert.Equal(t, 2, cache.Len())
+
+		cache.Delete("b")
+		assert.EqualValues(t, 6, cache.Stats().Bytes)
+	})
+
+	t.Run("Sweeper removes entries nobody reads", func(t *testing.T) {
+		cache := access.NewLRUCache[string, bool](0, 0)
+		stop := cache.StartSweeper(10 * time.Millisecond)
+		defer stop()
+
+		for i := 0; i < 100; i++ {
+			cache.SetWithTTL(fmt.Sprintf("jti-%d", i), true, 5*time.Millisecond)
+		}
+		assert.Eventually(t, func() bool { return cache.Len() == 0 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Add is atomic", func(t *testing.T) {
+		cache := access.NewLRUCache[string, bool](time.Minute, 0)
+		var added atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _ := access.AddIfAbsent[string, bool](cache, "jti", true, time.Minute); ok {
+					added.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), added.Load())
+	})
+
+	t.Run("Take is atomic", func(t *testing.T) {
+		caches := map[string]access.Cache[string, bool]{
+			"memory":  access.NewLRUCache[string, bool](time.Minute, 0),
+			"sharded": access.NewShardedCache[bool](time.Minute, 0, 4),
+			"backend": access.NewBackendCache[bool](access.NewMemoryBackend(0), "t:", time.Minute, time.Minute, 0),
+		}
+		for name, cache := range caches {
+			cache.Set("code", true)
+			var taken atomic.Int32
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, ok := access.Take(cache, "code"); ok {
+						taken.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), taken.Load(), name)
+			_, ok := cache.Get("code")
+			assert.False(t, ok, name)
+		}
+	})
+
+	t.Run("Estimated size", func(t *testing.T) {
+		// EstimateSize не знает типов jwt: claims оцениваются как обычная map
+		sizeOf := func(key string, claims jwt.MapClaims) int64 {
+			return access.EstimateSize(key) + access.EstimateSize(map[string]interface{}(claims))
+		}
+		cache := access.NewShardedCache[jwt.MapClaims](time.Minute, 0, 4).LimitBytes(64<<10, sizeOf)
+		claims := jwt.MapClaims{"user_id": float64(1), "username": strings.Repeat("u", 1000), "role": "admin"}
+		for i := 0; i < 1000; i++ {
+			cache.Set(fmt.Sprintf("token-%d", i), claims)
+		}
+		stats := cache.Stats()
+		assert.Less(t, cache.Len(), 100)
+		assert.LessOrEqual(t, stats.Bytes, int64(64<<10))
+		assert.Greater(t, stats.Bytes, int64(0))
+	})
+
+	t.Run("Token cache counts claims", func(t *testing.T) {
+		for _, shards := range []string{"", "  shards: 4\n"} {
+			auth := newTestAuthenticator(t, "cache:\n  token_max_bytes: 65536\n"+shards)
+			claims := jwt.MapClaims{"user_id": float64(1), "username": strings.Repeat("u", 1000), "role": "admin"}
+			for i := 0; i < 1000; i++ {
+				auth.TokenCache.Set(fmt.Sprintf("token-%d", i), claims)
+			}
+			assert.Less(t, auth.TokenCache.Len(), 100)
+		}
+	})
+}
+
+func TestTypedCache(t *testing.T) {
+	var cache access.Cache[string, int] = access.NewLRUCache[string, int](time.Minute, 0)
+
+	t.Run("SetWithTTL overrides default TTL", func(t *testing.T) {
+		cache.Clear()
+		cache.SetWithTTL("short", 1, 50*time.Millisecond)
+		cache.Set("long", 2)
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, ok := cache.Get("short")
+		assert.False(t, ok)
+		val, ok := cache.Get("long")
+		assert.True(t, ok)
+		assert.Equal(t, 2, val)
+	})
+
+	t.Run("Delete and Len", func(t *testing.T) {
+		cache.Clear()
+		cache.Set("a", 1)
+		cache.Set("b", 2)
+		assert.Equal(t, 2, cache.Len())
+
+		cache.Delete("a")
+		assert.Equal(t, 1, cache.Len())
+		_, ok := cache.Get("a")
+		assert.False(t, ok)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		cache.Clear()
+		for i := 0; i < 5; i++ {
+			cache.Set(fmt.Sprintf("key%d", i), i)
+		}
+
+		sum := 0
+		cache.Range(func(key string, value int) bool {
+			sum += value
+			return true
+		})
+		assert.Equal(t, 10, sum)
+
+		visited := 0
+		cache.Range(func(key string, value int) bool {
+			visited++
+			return visited < 2
+		})
+		assert.Equal(t, 2, visited)
+	})
+}
+
+func TestShardedCache(t *testing.T) {
+	t.Run("Basic operations", func(t *testing.T) {
+		cache := access.NewShardedCache[int](time.Minute, 0, 8)
+		for i := 0; i < 100; i++ {
+			cache.Set(fmt.Sprintf("key%d", i), i)
+		}
+		assert.Equal(t, 100, cache.Len())
+
+		val, ok := cache.Get("key42")
+		assert.True(t, ok)
+		assert.Equal(t, 42, val)
+
+		cache.Delete("key42")
+		_, ok = cache.Get("key42")
+		assert.False(t, ok)
+
+		sum := 0
+		cache.Range(func(key string, value int) bool {
+			sum += value
+			return true
+		})
+		assert.Equal(t, 4950-42, sum)
+
+		cache.Clear()
+		assert.Equal(t, 0, cache.Len())
+	})
+
+	t.Run("Size limit is split across shards", func(t *testing.T) {
+		cache := access.NewShardedCache[int](time.Minute, 64, 4)
+		for i := 0; i < 10000; i++ {
+			cache.Set(fmt.Sprintf("key%d", i), i)
+		}
+		assert.LessOrEqual(t, cache.Len(), 64)
+		assert.Greater(t, cache.Stats().Evictions, uint64(0))
+	})
+
+	t.Run("Incremental sweep", func(t *testing.T) {
+		cache := access.NewShardedCache[int](time.Minute, 0, 4)
+		for i := 0; i < 1000; i++ {
+			cache.SetWithTTL(fmt.Sprintf("short%d", i), i, 10*time.Millisecond)
+		}
+		cache.Set("long", 1)
+		time.Sleep(20 * time.Millisecond)
+
+		removed := 0
+		for i := 0; i < 4; i++ {
+			removed += cache.SweepNext()
+		}
+		assert.Equal(t, 1000, removed)
+		assert.Equal(t, 1, cache.Len())
+	})
+
+	t.Run("Sweep survives concurrent deletes", func(t *testing.T) {
+		cache := access.NewShardedCache[int](time.Minute, 0, 1)
+		for i := 0; i < 5000; i++ {
+			cache.SetWithTTL(fmt.Sprintf("short%d", i), i, 10*time.Millisecond)
+		}
+		cache.Set("long", 1)
+		time.Sleep(20 * time.Millisecond)
+
+		// Удаления между пачками не должны останавливать обход
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 5000; i += 7 {
+				cache.Delete(fmt.Sprintf("short%d", i))
+			}
+		}()
+		cache.SweepNext()
+		<-done
+
+		assert.Equal(t, 1, cache.Len())
+	})
+
+	t.Run("Sweep survives concurrent reads and writes", func(t *testing.T) {
+		cache := access.NewShardedCache[int](time.Minute, 0, 1)
+		for i := 0; i < 5000; i++ {
+			cache.SetWithTTL(fmt.Sprintf("short%d", i), i, 10*time.Millisecond)
+			if i%100 == 0 {
+				cache.Set(fmt.Sprintf("long%d", i), i)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		// Чтения и перезаписи поднимают записи в начало списка прямо под позицией обхода
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 5000; i += 100 {
+				cache.Get(fmt.Sprintf("long%d", i))
+				cache.Set(fmt.Sprintf("long%d", i), i)
+			}
+		}()
+		removed := cache.SweepNext()
+		<-done
+		removed += cache.SweepNext()
+
+		assert.Equal(t, 50, cache.Len())
+		assert.LessOrEqual(t, removed, 5000)
+	})
+
+	t.Run("Background sweeper", func(t *testing.T) {
+		cache := access.NewShardedCache[int](10*time.Millisecond, 0, 4)
+		stop := cache.StartSweeper(20 * time.Millisecond)
+		defer stop()
+
+		cache.Set("key", 1)
+		assert.Eventually(t, func() bool {
+			return cache.Stats().Expirations == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestGetOrLoad(t *testing.T) {
+	t.Run("Concurrent misses load once", func(t *testing.T) {
+		cache := access.NewLRUCache[string, int](time.Minute, 0)
+		var loads atomic.Int32
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := cache.GetOrLoad("key", func() (int, time.Duration, error) {
+					loads.Add(1)
+					time.Sleep(50 * time.Millisecond)
+					return 42, time.Minute, nil
+				})
+				assert.NoError(t, err)
+				assert.Equal(t, 42, value)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(1), loads.Load())
+		value, ok := cache.Get("key")
+		assert.True(t, ok)
+		assert.Equal(t, 42, value)
+	})
+
+	t.Run("Errors are not cached", func(t *testing.T) {
+		cache := access.NewLRUCache[string, int](time.Minute, 0)
+		_, err := cache.GetOrLoad("key", func() (int, time.Duration, error) {
+			return 0, time.Minute, errors.New("boom")
+		})
+		assert.Error(t, err)
+
+		_, ok := cache.Get("key")
+		assert.False(t, ok)
+	})
+
+	t.Run("Concurrent password checks", func(t *testing.T) {
+		auth, err := access.NewAuthenticator("./test_config.yml")
+		assert.NoError(t, err)
+		hasher := access.NewPasswordHasher(10, auth)
+		hash, err := hasher.HashPassword("secret")
+		assert.NoError(t, err)
+
+		var compares atomic.Int32
+		hasher.Compare = func(hash, password []byte) error {
+			compares.Add(1)
+			return bcrypt.CompareHashAndPassword(hash, password)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.True(t, hasher.CheckPasswordHash("secret", hash))
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), compares.Load())
+		assert.Equal(t, 1, auth.PasswordCache.Len())
+	})
+
+	t.Run("Caches without Loader", func(t *testing.T) {
+		var cache access.Cache[string, int] = plainCache{access.NewLRUCache[string, int](time.Minute, 0)}
+		_, isLoader := cache.(access.Loader[string, int])
+		assert.False(t, isLoader)
+
+		loads := 0
+		for i := 0; i < 3; i++ {
+			value, err := access.GetOrLoad(cache, "key", func() (int, time.Duration, error) {
+				loads++
+				return 42, time.Minute, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 42, value)
+		}
+		assert.Equal(t, 1, loads)
+	})
+}
+
+// plainCache - собственная реализация Cache без GetOrLoad
+type plainCache struct {
+	inner access.Cache[string, int]
+}
+
+func (c plainCache) Get(key string) (int, bool)      { return c.inner.Get(key) }
+func (c plainCache) Set(key string, value int)       { c.inner.Set(key, value) }
+func (c plainCache) Delete(key string)               { c.inner.Delete(key) }
+func (c plainCache) Len() int                        { return c.inner.Len() }
+func (c plainCache) Clear()                          { c.inner.Clear() }
+func (c plainCache) Range(fn func(string, int) bool) { c.inner.Range(fn) }
+func (c plainCache) SetWithTTL(key string, value int, ttl time.Duration) {
+	c.inner.SetWithTTL(key, value, ttl)
+}
+
+func signTestToken(t *testing.T, role string, exp time.Time) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id":  1,
+		"username": "user",
+		"role":     role,
+		"exp":      exp.Unix(),
+	})
+	signed, err := token.SignedString([]byte("test-secret"))
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestTokenCache_RespectsExpiry(t *testing.T) {
+	auth, err := access.NewAuthenticator("./test_config.yml")
+	assert.NoError(t, err)
+
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("Expired token rejected despite being cached", func(t *testing.T) {
+		token := signTestToken(t, "admin", time.Now().Add(-time.Minute))
+
+		// Имитируем запись, попавшую в кэш до истечения токена, с TTL кэша в 12 часов
+		auth.TokenCache.Set(token, jwt.MapClaims{
+			"user_id": float64(1),
+			"role":    "admin",
+			"exp":     float64(time.Now().Add(-time.Minute).Unix()),
+		})
+
+		assert.Equal(t, http.StatusUnauthorized, serve(token))
+		_, cached := auth.TokenCache.Get(token)
+		assert.False(t, cached)
+	})
+
+	t.Run("Cache entry lives no longer than token", func(t *testing.T) {
+		exp := time.Now().Add(2 * time.Second)
+		token := signTestToken(t, "admin", exp)
+
+		assert.Equal(t, http.StatusOK, serve(token))
+		_, cached := auth.TokenCache.Get(token)
+		assert.True(t, cached)
+
+		time.Sleep(time.Until(time.Unix(exp.Unix()+1, 0)))
+
+		_, cached = auth.TokenCache.Get(token)
+		assert.False(t, cached)
+		assert.Equal(t, http.StatusUnauthorized, serve(token))
+	})
+}
+
 // TestResult - структура для хранения результатов тестирования
 type TestResult struct {
 	Name       string
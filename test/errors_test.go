@@ -0,0 +1,111 @@
+package access_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemResponses(t *testing.T) {
+	auth, err := access.NewAuthenticator("./test_config.yml")
+	assert.NoError(t, err)
+
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	userToken, _ := auth.JwtService.GenerateJWT(1, "user", "user")
+	ghostToken, _ := auth.JwtService.GenerateJWT(1, "ghost", "ghost")
+
+	tests := []struct {
+		name          string
+		token         string
+		wantStatus    int
+		wantCode      string
+		wantChallenge string
+	}{
+		{
+			name:          "Missing token",
+			wantStatus:    http.StatusUnauthorized,
+			wantCode:      "token_missing",
+			wantChallenge: `Bearer realm="access"`,
+		},
+		{
+			name:          "Malformed token",
+			token:         "not-a-jwt",
+			wantStatus:    http.StatusUnauthorized,
+			wantCode:      "token_invalid",
+			wantChallenge: `Bearer realm="access", error="invalid_token", error_description="The access token is invalid"`,
+		},
+		{
+			name:          "Expired token",
+			token:         signTestToken(t, "admin", time.Now().Add(-time.Minute)),
+			wantStatus:    http.StatusUnauthorized,
+			wantCode:      "token_expired",
+			wantChallenge: `Bearer realm="access", error="invalid_token", error_description="The access token expired"`,
+		},
+		{
+			name:       "Unknown role",
+			token:      ghostToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   "role_unknown",
+		},
+		{
+			name:       "Access denied",
+			token:      userToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   "access_denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+			assert.Equal(t, tt.wantChallenge, rr.Header().Get("WWW-Authenticate"))
+
+			var problem access.Problem
+			assert.NoError(t, json.NewDecoder(rr.Body).Decode(&problem))
+			assert.Equal(t, tt.wantCode, problem.Code)
+			assert.Equal(t, tt.wantStatus, problem.Status)
+			assert.Equal(t, "/api/admin/users", problem.Instance)
+			// Подробности библиотеки jwt наружу не уходят
+			assert.NotContains(t, problem.Detail, "segments")
+		})
+	}
+}
+
+func TestCustomErrorHandler(t *testing.T) {
+	auth, err := access.NewAuthenticator("./test_config.yml")
+	assert.NoError(t, err)
+
+	var got *access.AuthError
+	auth.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err *access.AuthError) {
+		got = err
+		w.WriteHeader(http.StatusTeapot)
+	}
+
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, access.ReasonTokenInvalid, got.Code)
+		assert.ErrorIs(t, got, access.ErrTokenInvalid)
+	}
+}
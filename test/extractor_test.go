@@ -0,0 +1,129 @@
+package access_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExtractors(t *testing.T) {
+	tests := []struct {
+		name      string
+		extractor access.TokenExtractor
+		setup     func(r *http.Request)
+		want      string
+	}{
+		{
+			name:      "Bearer",
+			extractor: access.BearerExtractor(),
+			setup:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer abc") },
+			want:      "abc",
+		},
+		{
+			name:      "Bearer scheme is case-insensitive",
+			extractor: access.BearerExtractor(),
+			setup:     func(r *http.Request) { r.Header.Set("Authorization", "bearer abc") },
+			want:      "abc",
+		},
+		{
+			name:      "Wrong scheme",
+			extractor: access.BearerExtractor(),
+			setup:     func(r *http.Request) { r.Header.Set("Authorization", "Basic abc") },
+			want:      "",
+		},
+		{
+			name:      "Malformed header",
+			extractor: access.BearerExtractor(),
+			setup:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer abc def") },
+			want:      "",
+		},
+		{
+			name:      "Custom header without scheme",
+			extractor: access.HeaderExtractor("X-Auth-Token", ""),
+			setup:     func(r *http.Request) { r.Header.Set("X-Auth-Token", "abc") },
+			want:      "abc",
+		},
+		{
+			name:      "Cookie",
+			extractor: access.CookieExtractor("access_token"),
+			setup:     func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "access_token", Value: "abc"}) },
+			want:      "abc",
+		},
+		{
+			name:      "Query param",
+			extractor: access.QueryExtractor("access_token"),
+			setup:     func(r *http.Request) { r.URL.RawQuery = "access_token=abc" },
+			want:      "abc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.setup(req)
+			assert.Equal(t, tt.want, tt.extractor.ExtractToken(req))
+		})
+	}
+}
+
+func TestTokenExtractorChain(t *testing.T) {
+	permPath, err := filepath.Abs("./test_perm_config.yml")
+	assert.NoError(t, err)
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yml")
+	cfg := "jwt:\n  secret: \"test-secret\"\n  ttl: \"1h\"\n" +
+		"token:\n  extractors:\n" +
+		"    - type: bearer\n" +
+		"    - type: cookie\n      name: access_token\n" +
+		"    - type: query\n      name: access_token\n" +
+		"permissions:\n  path: \"" + filepath.ToSlash(permPath) + "\"\n" +
+		"password:\n  cost: 4\n" +
+		"cache:\n  token_ttl: \"1h\"\n  permission_ttl: \"1h\"\n"
+	assert.NoError(t, os.WriteFile(cfgPath, []byte(cfg), 0644))
+
+	auth, err := access.NewAuthenticator(cfgPath)
+	assert.NoError(t, err)
+	assert.Len(t, auth.TokenExtractors, 3)
+
+	token, err := auth.JwtService.GenerateJWT(1, "admin", "admin")
+	assert.NoError(t, err)
+
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  int
+	}{
+		{"Header", func(r *http.Request) { r.Header.Set("Authorization", "BEARER "+token) }, http.StatusOK},
+		{"Cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "access_token", Value: token}) }, http.StatusOK},
+		{"Query", func(r *http.Request) { r.URL.RawQuery = "access_token=" + token }, http.StatusOK},
+		{"Header wins over bad cookie", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+			r.AddCookie(&http.Cookie{Name: "access_token", Value: "garbage"})
+		}, http.StatusOK},
+		{"No token", func(r *http.Request) {}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+			tt.setup(req)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.want, rr.Code)
+		})
+	}
+
+	t.Run("Unknown extractor type", func(t *testing.T) {
+		_, err := access.NewTokenExtractor(access.ExtractorConfig{Type: "carrier-pigeon"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,300 @@
+package access_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type authFixture struct {
+	auth   *access.Authenticator
+	router *chi.Mux
+
+	mu     sync.Mutex
+	users  map[string]*access.User
+	events []access.AuthEvent
+}
+
+// setUser заменяет учётную запись, которую видит UserLookup
+func (f *authFixture) setUser(user *access.User) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[user.Username] = user
+}
+
+func newAuthFixture(t *testing.T, extra string) *authFixture {
+	t.Helper()
+	return newAuthFixtureJWT(t, "", extra)
+}
+
+// newAuthFixtureJWT - newAuthFixture с дополнительными строками секции jwt
+func newAuthFixtureJWT(t *testing.T, jwtExtra, extra string) *authFixture {
+	t.Helper()
+	auth := newTestAuthenticatorJWT(t, jwtExtra, extra)
+
+	hash, err := auth.PasswordHasher.HashPassword("secret")
+	assert.NoError(t, err)
+	users := map[string]*access.User{
+		"admin":  {ID: 1, Username: "admin", Role: "admin", PasswordHash: hash},
+		"banned": {ID: 2, Username: "banned", Role: "user", PasswordHash: hash, Disabled: true},
+	}
+	f := &authFixture{auth: auth, router: chi.NewRouter(), users: users}
+	auth.UserLookup = func(ctx context.Context, username string) (*access.User, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.users[username], nil
+	}
+
+	lockout := access.NewLockout(3, time.Minute)
+	auth.Hooks = access.AuthHooks{
+		Locked:  lockout.Locked,
+		Attempt: lockout.Attempt,
+		Audit: func(r *http.Request, event access.AuthEvent) {
+			lockout.Audit(r, event)
+			f.mu.Lock()
+			f.events = append(f.events, event)
+			f.mu.Unlock()
+		},
+	}
+
+	f.router.Route("/auth", auth.MountAuthRoutes)
+	f.router.With(auth.CheckPermissions).Get("/api/admin/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return f
+}
+
+func (f *authFixture) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	f.router.ServeHTTP(rr, req)
+	return rr
+}
+
+func (f *authFixture) login(t *testing.T, username, password string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	rr := f.do(http.MethodPost, "/auth/login", "", map[string]string{"username": username, "password": password})
+	var resp access.TokenResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return rr, resp.AccessToken
+}
+
+func problemCode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+	var problem access.Problem
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+	return problem.Code
+}
+
+func TestLoginHandler(t *testing.T) {
+	f := newAuthFixture(t, "")
+
+	t.Run("Success", func(t *testing.T) {
+		rr, token := f.login(t, "admin", "secret")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+		assert.NotEmpty(t, token)
+
+		assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+	})
+
+	t.Run("Wrong password and unknown user look the same", func(t *testing.T) {
+		rr, _ := f.login(t, "admin", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "invalid_credentials", problemCode(t, rr))
+
+		rr, _ = f.login(t, "nobody", "secret")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "invalid_credentials", problemCode(t, rr))
+	})
+
+	t.Run("Disabled user", func(t *testing.T) {
+		rr, _ := f.login(t, "banned", "secret")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("Malformed body", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBufferString("{"))
+		rr := httptest.NewRecorder()
+		f.router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("Lockout", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			f.login(t, "admin", "wrong")
+		}
+		rr, _ := f.login(t, "admin", "secret")
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "account_locked", problemCode(t, rr))
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if assert.NotEmpty(t, f.events) {
+			first := f.events[0]
+			assert.Equal(t, "login", first.Action)
+			assert.Equal(t, "admin", first.Username)
+			assert.Equal(t, 1, first.UserID)
+			assert.True(t, first.Success)
+		}
+	})
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	f := newAuthFixture(t, "")
+	_, token := f.login(t, "admin", "secret")
+
+	rr := f.do(http.MethodPost, "/auth/refresh", token, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp access.TokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.NotEqual(t, token, resp.AccessToken)
+
+	// Старый токен отозван, новый работает
+	rr = f.do(http.MethodGet, "/api/admin/users", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "token_revoked", problemCode(t, rr))
+	assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", resp.AccessToken, nil).Code)
+
+	assert.Equal(t, http.StatusNoContent, f.do(http.MethodPost, "/auth/logout", resp.AccessToken, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodGet, "/api/admin/users", resp.AccessToken, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodPost, "/auth/refresh", resp.AccessToken, nil).Code)
+}
+
+func TestRefreshChecks(t *testing.T) {
+	t.Run("Disabled user", func(t *testing.T) {
+		f := newAuthFixture(t, "")
+		_, token := f.login(t, "admin", "secret")
+		f.setUser(&access.User{ID: 1, Username: "admin", Role: "admin", Disabled: true})
+
+		rr := f.do(http.MethodPost, "/auth/refresh", token, nil)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, access.ReasonAccountDisabled, problemCode(t, rr))
+	})
+
+	t.Run("Role change applies", func(t *testing.T) {
+		f := newAuthFixture(t, "")
+		_, token := f.login(t, "admin", "secret")
+		f.setUser(&access.User{ID: 1, Username: "admin", Role: "user"})
+
+		rr := f.do(http.MethodPost, "/auth/refresh", token, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var resp access.TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		claims, err := f.auth.JwtService.ParseJWT(resp.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, "user", claims["role"])
+	})
+
+	t.Run("Absolute session cap", func(t *testing.T) {
+		f := newAuthFixture(t, "")
+		token, err := f.auth.JwtService.GenerateJWTWithClaims(1, "admin", "admin", jwt.MapClaims{
+			"auth_time": time.Now().Add(-25 * time.Hour).Unix(),
+		})
+		assert.NoError(t, err)
+
+		rr := f.do(http.MethodPost, "/auth/refresh", token, nil)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, access.ReasonTokenExpired, problemCode(t, rr))
+
+		// auth_time переносится в новый токен, а не сбрасывается обновлением
+		_, token = f.login(t, "admin", "secret")
+		before, _ := f.auth.JwtService.ParseJWT(token)
+		rr = f.do(http.MethodPost, "/auth/refresh", token, nil)
+		var resp access.TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		after, _ := f.auth.JwtService.ParseJWT(resp.AccessToken)
+		assert.NotNil(t, after["auth_time"])
+		assert.Equal(t, before["auth_time"], after["auth_time"])
+	})
+
+	t.Run("Concurrent refresh succeeds once", func(t *testing.T) {
+		f := newAuthFixture(t, "")
+		_, token := f.login(t, "admin", "secret")
+
+		var ok atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if f.do(http.MethodPost, "/auth/refresh", token, nil).Code == http.StatusOK {
+					ok.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), ok.Load())
+	})
+}
+
+func TestLockoutParallelGuesses(t *testing.T) {
+	f := newAuthFixture(t, "")
+
+	// Все догадки приходят до первой неудачи: проверку пароля проходят только три
+	var rejected, locked atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch rr, _ := f.login(t, "admin", "wrong"); rr.Code {
+			case http.StatusUnauthorized:
+				rejected.Add(1)
+			case http.StatusTooManyRequests:
+				locked.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), rejected.Load())
+	assert.Equal(t, int32(7), locked.Load())
+
+	lockout := access.NewLockout(3, time.Minute)
+	var reserved atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if lockout.Attempt("admin") {
+				reserved.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), reserved.Load())
+}
+
+func TestLoginSessionMode(t *testing.T) {
+	f := newAuthFixture(t, sessionConfig)
+
+	rr, _ := f.login(t, "admin", "secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	names := map[string]bool{}
+	for _, c := range rr.Result().Cookies() {
+		names[c.Name] = true
+	}
+	assert.True(t, names["access_token"])
+	assert.True(t, names["csrf_token"])
+}
@@ -0,0 +1,60 @@
+package access_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestConfig пишет во временный каталог конфиг на основе test_config.yml,
+// дополненный секциями extra, и возвращает путь к нему
+func writeTestConfig(t *testing.T, extra string) string {
+	return writeTestConfigJWT(t, "", extra)
+}
+
+// writeTestConfigJWT - writeTestConfig с дополнительными строками секции jwt
+func writeTestConfigJWT(t *testing.T, jwtExtra, extra string) string {
+	t.Helper()
+	permPath, err := filepath.Abs("./test_perm_config.yml")
+	assert.NoError(t, err)
+
+	cfg := "jwt:\n  secret: \"test-secret\"\n  ttl: \"1h\"\n" + jwtExtra +
+		"permissions:\n  path: \"" + filepath.ToSlash(permPath) + "\"\n" +
+		"password:\n  cost: 4\n" + extra
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(path, []byte(cfg), 0644))
+	return path
+}
+
+func newTestAuthenticator(t *testing.T, extra string) *access.Authenticator {
+	t.Helper()
+	return newTestAuthenticatorJWT(t, "", extra)
+}
+
+func newTestAuthenticatorJWT(t *testing.T, jwtExtra, extra string) *access.Authenticator {
+	t.Helper()
+	auth, err := access.NewAuthenticator(writeTestConfigJWT(t, jwtExtra, extra))
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth.Close() })
+	return auth
+}
+
+// writeRSAKey пишет во временный каталог новый ключ RSA в PEM и возвращает путь к нему
+func writeRSAKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return filepath.ToSlash(path)
+}
@@ -0,0 +1,218 @@
+package access_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubIdP - внешний OIDC-провайдер с discovery и JWKS
+type stubIdP struct {
+	srv      *httptest.Server
+	mu       sync.Mutex
+	key      *rsa.PrivateKey
+	kid      string
+	keys     []access.JSONWebKey
+	jwksHits int32
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+	idp := &stubIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(access.OIDCDiscovery{Issuer: idp.srv.URL, JWKSURI: idp.srv.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.jwksHits, 1)
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(access.JSONWebKeySet{Keys: idp.keys})
+	})
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	idp.rotate(t, "key-1")
+	return idp
+}
+
+// rotate публикует новый ключ подписи рядом со старым
+func (idp *stubIdP) rotate(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key, idp.kid = key, kid
+	idp.keys = append(idp.keys, access.JSONWebKey{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	})
+}
+
+func (idp *stubIdP) sign(t *testing.T, extra jwt.MapClaims) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss":                idp.srv.URL,
+		"aud":                []string{"orders-api"},
+		"sub":                "00u1a2b3c",
+		"preferred_username": "jane@corp.example",
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	signed, err := token.SignedString(idp.key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func newIdPFixture(t *testing.T, idp *stubIdP) *authFixture {
+	t.Helper()
+	f := newAuthFixture(t, "identity_provider:\n  issuer: \""+idp.srv.URL+"\"\n  audience: orders-api\n")
+	f.router.With(f.auth.CheckPermissions).Get("/api/mod/queue", func(w http.ResponseWriter, r *http.Request) {
+		claims := r.Context().Value(access.UserClaimsKey).(jwt.MapClaims)
+		w.Write([]byte(claims["username"].(string)))
+	})
+	return f
+}
+
+func TestIdentityProviderTokens(t *testing.T) {
+	idp := newStubIdP(t)
+	f := newIdPFixture(t, idp)
+
+	t.Run("GroupMapsToRole", func(t *testing.T) {
+		token := idp.sign(t, jwt.MapClaims{"groups": []string{"everyone", "platform-admins"}})
+		assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+
+		// JWKS кэшируется: другой токен проверяется без запроса к провайдеру
+		other := idp.sign(t, jwt.MapClaims{"groups": "platform-admins", "jti": "2"})
+		assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", other, nil).Code)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&idp.jwksHits))
+	})
+
+	t.Run("CustomClaim", func(t *testing.T) {
+		token := idp.sign(t, jwt.MapClaims{"department": "support-emea"})
+		rr := f.do(http.MethodGet, "/api/mod/queue", token, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "jane@corp.example", rr.Body.String())
+		assert.Equal(t, http.StatusForbidden, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+	})
+
+	t.Run("Unmapped", func(t *testing.T) {
+		// Claim role провайдера не даёт роль сам по себе
+		token := idp.sign(t, jwt.MapClaims{"groups": []string{"everyone"}, "role": "admin"})
+		rr := f.do(http.MethodGet, "/api/admin/users", token, nil)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Equal(t, access.ReasonRoleUnknown, problemCode(t, rr))
+	})
+
+	t.Run("CachedClaimsAreNotTokens", func(t *testing.T) {
+		// Проверенные claims провайдера лежат в кэше; под другим именем токен
+		// не должен их находить и обходить claim_roles
+		for _, claims := range []jwt.MapClaims{
+			{"groups": "platform-admins", "jti": "cached"},
+			{"groups": []string{"everyone"}, "role": "admin", "jti": "cached-unmapped"},
+		} {
+			token := idp.sign(t, claims)
+			f.do(http.MethodGet, "/api/admin/users", token, nil)
+			rr := f.do(http.MethodGet, "/api/admin/users", "idp:"+token, nil)
+			assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		groups := jwt.MapClaims{"groups": "platform-admins"}
+		cases := map[string]struct {
+			extra jwt.MapClaims
+			code  string
+		}{
+			"audience": {jwt.MapClaims{"aud": "billing-api"}, access.ReasonTokenInvalid},
+			"expired":  {jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, access.ReasonTokenExpired},
+			"no exp":   {jwt.MapClaims{"exp": nil}, access.ReasonTokenInvalid},
+		}
+		for name, tc := range cases {
+			extra := jwt.MapClaims{}
+			for k, v := range groups {
+				extra[k] = v
+			}
+			for k, v := range tc.extra {
+				extra[k] = v
+			}
+			rr := f.do(http.MethodGet, "/api/admin/users", idp.sign(t, extra), nil)
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, name)
+			assert.Equal(t, tc.code, problemCode(t, rr), name)
+		}
+
+		// Подпись чужим ключом с тем же kid
+		forged, _ := rsa.GenerateKey(rand.Reader, 2048)
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": idp.srv.URL, "aud": "orders-api", "groups": "platform-admins", "exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "key-1"
+		signed, _ := token.SignedString(forged)
+		assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodGet, "/api/admin/users", signed, nil).Code)
+	})
+
+	t.Run("KeyRotation", func(t *testing.T) {
+		hits := atomic.LoadInt32(&idp.jwksHits)
+		idp.rotate(t, "key-2")
+		token := idp.sign(t, jwt.MapClaims{"groups": "platform-admins"})
+
+		// Сразу после загрузки JWKS неизвестный kid не приводит к новому запросу
+		assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+		assert.Equal(t, hits, atomic.LoadInt32(&idp.jwksHits))
+
+		f.auth.IdentityProvider.UnknownKeyRefetch = 0
+		f.auth.IdentityCache.Clear()
+		assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+		assert.Equal(t, hits+1, atomic.LoadInt32(&idp.jwksHits))
+	})
+
+	t.Run("OwnTokensStillWork", func(t *testing.T) {
+		_, token := f.login(t, "admin", "secret")
+		assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+	})
+}
+
+func TestIdentityProviderUnavailable(t *testing.T) {
+	idp := newStubIdP(t)
+	f := newIdPFixture(t, idp)
+	token := idp.sign(t, jwt.MapClaims{"groups": "platform-admins"})
+	idp.srv.Close()
+
+	rr := f.do(http.MethodGet, "/api/admin/users", token, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, access.ReasonProviderUnavailable, problemCode(t, rr))
+}
+
+func TestIdentityProviderConfig(t *testing.T) {
+	_, err := access.NewAuthenticator(writeTestConfig(t, "identity_provider:\n  issuer: https://idp.example\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,143 @@
+package access_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+func (f *oauthFixture) introspect(t *testing.T, values url.Values) access.IntrospectionResponse {
+	t.Helper()
+	rr := f.form("/oauth/introspect", values, "billing", f.secret)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	var resp access.IntrospectionResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestOAuthIntrospection(t *testing.T) {
+	f := newOAuthFixture(t, "oauth:\n  issuer: https://auth.example\n")
+
+	t.Run("ClientCredentialsToken", func(t *testing.T) {
+		rr := f.form("/oauth/token", url.Values{"grant_type": {access.GrantClientCredentials}}, "billing", f.secret)
+		var tokens access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &tokens)
+
+		resp := f.introspect(t, url.Values{"token": {tokens.AccessToken}})
+		assert.True(t, resp.Active)
+		assert.Equal(t, "billing", resp.ClientID)
+		assert.Equal(t, "billing", resp.Sub)
+		assert.Equal(t, "read", resp.Scope)
+		assert.Equal(t, "Bearer", resp.TokenType)
+		assert.Equal(t, "https://auth.example", resp.Iss)
+		assert.Greater(t, resp.Exp, time.Now().Unix())
+	})
+
+	t.Run("LoginTokenAndRevocation", func(t *testing.T) {
+		_, token := f.login(t, "admin", "secret")
+		resp := f.introspect(t, url.Values{"token": {token}})
+		assert.True(t, resp.Active)
+		assert.Equal(t, "1", resp.Sub)
+		assert.Equal(t, "admin", resp.Username)
+		assert.Equal(t, "admin", resp.Role)
+
+		assert.NoError(t, f.auth.JwtService.RevokeJWT(token))
+		assert.Equal(t, access.IntrospectionResponse{Active: false}, f.introspect(t, url.Values{"token": {token}}))
+	})
+
+	t.Run("UnknownToken", func(t *testing.T) {
+		resp := f.introspect(t, url.Values{"token": {"not-a-token"}, "token_type_hint": {"refresh_token"}})
+		assert.False(t, resp.Active)
+		assert.Empty(t, resp.Sub)
+	})
+
+	t.Run("RefreshToken", func(t *testing.T) {
+		portal := &access.OAuthClient{
+			ID:           "portal",
+			RedirectURIs: []string{testRedirect},
+			GrantTypes:   []string{access.GrantAuthorizationCode, access.GrantRefreshToken},
+			Scopes:       []string{"read"},
+			// Без флага portal не смог бы проверить даже свой refresh token
+			ResourceServer: true,
+		}
+		secret, err := f.auth.RegisterOAuthClient(context.Background(), portal)
+		assert.NoError(t, err)
+
+		_, userToken := f.login(t, "admin", "secret")
+		verifier, challenge := pkcePair()
+		params := authorizeParams(challenge)
+		params.Set("client_id", "portal")
+		_, redirect := f.authorize(t, userToken, params)
+		rr := f.form("/oauth/token", url.Values{
+			"grant_type":    {access.GrantAuthorizationCode},
+			"code":          {redirect.Get("code")},
+			"redirect_uri":  {testRedirect},
+			"code_verifier": {verifier},
+		}, "portal", secret)
+		var tokens access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &tokens)
+		assert.NotEmpty(t, tokens.RefreshToken)
+
+		values := url.Values{"token": {tokens.RefreshToken}, "token_type_hint": {"refresh_token"}}
+		rr = f.form("/oauth/introspect", values, "portal", secret)
+		var resp access.IntrospectionResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.True(t, resp.Active)
+		assert.Equal(t, "portal", resp.ClientID)
+		assert.Equal(t, "1", resp.Sub)
+		assert.Greater(t, resp.Exp, time.Now().Add(time.Hour).Unix())
+
+		// Чужой refresh token другому клиенту не раскрывается
+		assert.False(t, f.introspect(t, values).Active)
+
+		// Повтор кода отзывает цепочку: refresh token остался в кэше, но уже неактивен
+		rr = f.form("/oauth/token", url.Values{
+			"grant_type":    {access.GrantAuthorizationCode},
+			"code":          {redirect.Get("code")},
+			"redirect_uri":  {testRedirect},
+			"code_verifier": {verifier},
+		}, "portal", secret)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		rr = f.form("/oauth/introspect", values, "portal", secret)
+		resp = access.IntrospectionResponse{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.False(t, resp.Active)
+	})
+
+	t.Run("ClientAuthentication", func(t *testing.T) {
+		_, token := f.login(t, "admin", "secret")
+		rr := f.form("/oauth/introspect", url.Values{"token": {token}}, "", "")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "invalid_client", decodeOAuth(t, rr)["error"])
+
+		rr = f.form("/oauth/introspect", url.Values{"token": {token}}, "billing", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+		// Публичный клиент не может проверять токены
+		rr = f.form("/oauth/introspect", url.Values{"token": {token}, "client_id": {"spa"}}, "", "")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+		// Конфиденциальный клиент без флага ResourceServer тоже не может
+		reporting := &access.OAuthClient{ID: "reporting", GrantTypes: []string{access.GrantClientCredentials}, Scopes: []string{"read"}}
+		secret, err := f.auth.RegisterOAuthClient(context.Background(), reporting)
+		assert.NoError(t, err)
+		rr = f.form("/oauth/introspect", url.Values{"token": {token}}, "reporting", secret)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "invalid_client", decodeOAuth(t, rr)["error"])
+
+		// Публичный клиент нельзя зарегистрировать как resource server
+		_, err = f.auth.RegisterOAuthClient(context.Background(), &access.OAuthClient{ID: "spa-rs", Public: true, ResourceServer: true})
+		assert.Error(t, err)
+
+		rr = f.form("/oauth/introspect", url.Values{}, "billing", f.secret)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Equal(t, "invalid_request", decodeOAuth(t, rr)["error"])
+	})
+}
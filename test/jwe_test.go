@@ -0,0 +1,130 @@
+package access_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+func jweHeader(t *testing.T, token string) map[string]string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	assert.Len(t, parts, 5)
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	assert.NoError(t, err)
+	var header map[string]string
+	assert.NoError(t, json.Unmarshal(raw, &header))
+	return header
+}
+
+// assertOpaque проверяет, что claims нельзя прочитать, просто декодировав части токена
+func assertOpaque(t *testing.T, token string) {
+	t.Helper()
+	for _, part := range strings.Split(token, ".") {
+		decoded, _ := base64.RawURLEncoding.DecodeString(part)
+		assert.NotContains(t, string(decoded), "jane")
+	}
+}
+
+func TestJWEDir(t *testing.T) {
+	auth := newTestAuthenticatorJWT(t, "  old_keys_to_keep: 1\n  encryption:\n    alg: dir\n", "")
+
+	token, err := auth.JwtService.GenerateJWT(7, "jane", "user")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"alg": "dir", "enc": "A256GCM", "cty": "JWT"}, jweHeader(t, token))
+	assertOpaque(t, token)
+
+	claims, err := auth.JwtService.ParseJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane", claims["username"])
+	assert.Equal(t, float64(7), claims["user_id"])
+
+	t.Run("Tampered", func(t *testing.T) {
+		parts := strings.Split(token, ".")
+		ciphertext, _ := base64.RawURLEncoding.DecodeString(parts[3])
+		ciphertext[0] ^= 0x01
+		parts[3] = base64.RawURLEncoding.EncodeToString(ciphertext)
+		_, err := auth.JwtService.ParseJWT(strings.Join(parts, "."))
+		assert.True(t, errors.Is(err, access.ErrTokenInvalid))
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		// Ключ шифрования выводится из секрета и уходит вместе с ним
+		auth.JwtService.RotateSecret("second-secret")
+		auth.TokenCache.Clear()
+		_, err := auth.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+
+		auth.JwtService.RotateSecret("third-secret")
+		auth.TokenCache.Clear()
+		_, err = auth.JwtService.ParseJWT(token)
+		assert.True(t, errors.Is(err, access.ErrTokenInvalid))
+	})
+
+	t.Run("PlainTokensStillAccepted", func(t *testing.T) {
+		plain := newTestAuthenticatorJWT(t, "", "")
+		plain.JwtService.RotateSecret(string(auth.JwtService.CurrentSecret))
+		token, err := plain.JwtService.GenerateJWT(7, "jane", "user")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, strings.Count(token, "."))
+
+		_, err = auth.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+	})
+}
+
+func TestJWERSAOAEP(t *testing.T) {
+	jwtExtra := "  old_keys_to_keep: 1\n  encryption:\n    alg: RSA-OAEP\n    key_file: \"" + writeRSAKey(t) + "\"\n"
+	a := newTestAuthenticatorJWT(t, jwtExtra, "")
+	b := newTestAuthenticatorJWT(t, jwtExtra, "")
+
+	token, err := a.JwtService.GenerateJWT(7, "jane", "user")
+	assert.NoError(t, err)
+	header := jweHeader(t, token)
+	assert.Equal(t, "RSA-OAEP", header["alg"])
+	assert.Equal(t, "A256GCM", header["enc"])
+	assert.NotEmpty(t, header["kid"])
+	assertOpaque(t, token)
+
+	// Реплика с тем же ключом и секретом читает токен
+	claims, err := b.JwtService.ParseJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane", claims["username"])
+
+	// Без ключа расшифровки токен недействителен, даже если подпись верна
+	other := newTestAuthenticatorJWT(t, "  encryption:\n    alg: RSA-OAEP\n    key_file: \""+writeRSAKey(t)+"\"\n", "")
+	_, err = other.JwtService.ParseJWT(token)
+	assert.True(t, errors.Is(err, access.ErrTokenInvalid))
+
+	t.Run("Rotation", func(t *testing.T) {
+		next, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		b.JwtService.RotateEncryptionKey(next)
+		b.TokenCache.Clear()
+
+		fresh, err := b.JwtService.GenerateJWT(8, "jane", "user")
+		assert.NoError(t, err)
+		assert.NotEqual(t, header["kid"], jweHeader(t, fresh)["kid"])
+
+		_, err = b.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+		_, err = b.JwtService.ParseJWT(fresh)
+		assert.NoError(t, err)
+	})
+}
+
+func TestJWEConfig(t *testing.T) {
+	_, err := access.NewAuthenticator(writeTestConfigJWT(t, "  encryption:\n    alg: A128KW\n", ""))
+	assert.Error(t, err)
+
+	// Случайный ключ на каждой реплике не годится
+	_, err = access.NewAuthenticator(writeTestConfigJWT(t, "  encryption:\n    alg: RSA-OAEP\n", ""))
+	assert.Error(t, err)
+}
@@ -0,0 +1,368 @@
+package access_test
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	ldapServiceDN  = "cn=svc-access,dc=example,dc=org"
+	ldapServicePwd = "svc-secret"
+)
+
+type ldapStubEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// ldapStub - минимальный сервер LDAPv3: bind, поиск с фильтрами &, |, !, = и =*, unbind.
+// Искать может только служебная учётка, как в каталогах с закрытым анонимным доступом
+type ldapStub struct {
+	ln      net.Listener
+	entries map[string]ldapStubEntry
+
+	mu    sync.Mutex
+	binds []string
+}
+
+func newLDAPStub(t *testing.T) *ldapStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &ldapStub{ln: ln, entries: map[string]ldapStubEntry{
+		ldapServiceDN: {password: ldapServicePwd},
+		"uid=jdoe,ou=people,dc=example,dc=org": {password: "directory-pass", attrs: map[string][]string{
+			"uid":       {"jdoe"},
+			"entryUUID": {"5b4a8c0e-1f5e-4b7e-9d8a-2f1c3e4d5a60"},
+			"memberOf":  {"cn=Platform-Admins,ou=groups,dc=example,dc=org"},
+		}},
+		"uid=msmith,ou=people,dc=example,dc=org": {password: "support-pass", attrs: map[string][]string{
+			"uid":       {"msmith"},
+			"entryUUID": {"0d7f3a52-8c1b-4f0e-a6b2-7e9c5d4f3b21"},
+		}},
+		"uid=nogroup,ou=people,dc=example,dc=org": {password: "nogroup-pass", attrs: map[string][]string{
+			"uid":       {"nogroup"},
+			"entryUUID": {"c3e1b9d4-2a7f-4e58-9b06-1d8f4a2c7e93"},
+		}},
+		// Запись без entryUUID: идентификатор не из чего вывести
+		"uid=legacy,ou=people,dc=example,dc=org": {password: "legacy-pass", attrs: map[string][]string{
+			"uid":      {"legacy"},
+			"memberOf": {"cn=Platform-Admins,ou=groups,dc=example,dc=org"},
+		}},
+		"cn=support-l2,ou=groups,dc=example,dc=org": {attrs: map[string][]string{
+			"cn":     {"support-l2"},
+			"member": {"uid=msmith,ou=people,dc=example,dc=org"},
+		}},
+	}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *ldapStub) url() string { return "ldap://" + s.ln.Addr().String() }
+
+func (s *ldapStub) bindCount(dn string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, b := range s.binds {
+		if b == dn {
+			n++
+		}
+	}
+	return n
+}
+
+type ldapMessage struct {
+	ID int
+	Op asn1.RawValue
+}
+
+type ldapAttribute struct {
+	Type []byte
+	Vals [][]byte `asn1:"set"`
+}
+
+func (s *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	bound := ""
+	for {
+		raw, err := readASN1(r)
+		if err != nil {
+			return
+		}
+		var msg ldapMessage
+		if _, err := asn1.Unmarshal(raw, &msg); err != nil {
+			return
+		}
+
+		switch msg.Op.Tag {
+		case 0: // bind
+			var version int
+			var name, auth asn1.RawValue
+			rest, _ := asn1.Unmarshal(msg.Op.Bytes, &version)
+			rest, _ = asn1.Unmarshal(rest, &name)
+			asn1.Unmarshal(rest, &auth)
+			dn := string(name.Bytes)
+			s.mu.Lock()
+			s.binds = append(s.binds, dn)
+			s.mu.Unlock()
+
+			entry, ok := s.entries[dn]
+			if !ok || entry.password == "" || entry.password != string(auth.Bytes) {
+				bound = ""
+				writeLDAP(conn, msg.ID, 1, ldapResult(49, "invalid credentials"))
+				continue
+			}
+			bound = dn
+			writeLDAP(conn, msg.ID, 1, ldapResult(0, ""))
+		case 2: // unbind
+			return
+		case 3: // search
+			var base, filter, attrs asn1.RawValue
+			var scope, deref asn1.Enumerated
+			var sizeLimit, timeLimit int
+			var typesOnly bool
+			rest, _ := asn1.Unmarshal(msg.Op.Bytes, &base)
+			for _, v := range []interface{}{&scope, &deref, &sizeLimit, &timeLimit, &typesOnly, &filter, &attrs} {
+				rest, _ = asn1.Unmarshal(rest, v)
+			}
+			if bound != ldapServiceDN {
+				writeLDAP(conn, msg.ID, 5, ldapResult(50, "insufficient access rights"))
+				continue
+			}
+
+			var requested []string
+			for rest := attrs.Bytes; len(rest) > 0; {
+				var name []byte
+				rest, _ = asn1.Unmarshal(rest, &name)
+				requested = append(requested, string(name))
+			}
+			sent := 0
+			for dn, entry := range s.entries {
+				if !strings.HasSuffix(strings.ToLower(dn), strings.ToLower(string(base.Bytes))) || !matchFilter(filter, entry.attrs) {
+					continue
+				}
+				if sizeLimit > 0 && sent == sizeLimit {
+					writeLDAP(conn, msg.ID, 5, ldapResult(4, "size limit exceeded"))
+					sent = -1
+					break
+				}
+				var list []ldapAttribute
+				for _, name := range requested {
+					if vals, ok := entry.attrs[name]; ok {
+						attr := ldapAttribute{Type: []byte(name)}
+						for _, v := range vals {
+							attr.Vals = append(attr.Vals, []byte(v))
+						}
+						list = append(list, attr)
+					}
+				}
+				dnBytes, _ := asn1.Marshal([]byte(dn))
+				listBytes, _ := asn1.Marshal(list)
+				writeLDAP(conn, msg.ID, 4, append(dnBytes, listBytes...))
+				sent++
+			}
+			if sent >= 0 {
+				writeLDAP(conn, msg.ID, 5, ldapResult(0, ""))
+			}
+		}
+	}
+}
+
+func matchFilter(filter asn1.RawValue, attrs map[string][]string) bool {
+	children := func() []asn1.RawValue {
+		var list []asn1.RawValue
+		for rest := filter.Bytes; len(rest) > 0; {
+			var child asn1.RawValue
+			rest, _ = asn1.Unmarshal(rest, &child)
+			list = append(list, child)
+		}
+		return list
+	}
+	switch filter.Tag {
+	case 0, 1: // and, or
+		for _, child := range children() {
+			if matchFilter(child, attrs) == (filter.Tag == 1) {
+				return filter.Tag == 1
+			}
+		}
+		return filter.Tag == 0
+	case 2: // not
+		return !matchFilter(children()[0], attrs)
+	case 3: // equalityMatch
+		pair := children()
+		for _, v := range attrs[string(pair[0].Bytes)] {
+			if strings.EqualFold(v, string(pair[1].Bytes)) {
+				return true
+			}
+		}
+	case 7: // present
+		return len(attrs[string(filter.Bytes)]) > 0
+	}
+	return false
+}
+
+func ldapResult(code int, message string) []byte {
+	codeBytes, _ := asn1.Marshal(asn1.Enumerated(code))
+	matched, _ := asn1.Marshal([]byte{})
+	diag, _ := asn1.Marshal([]byte(message))
+	return append(append(codeBytes, matched...), diag...)
+}
+
+func writeLDAP(w io.Writer, id, op int, content []byte) {
+	out, _ := asn1.Marshal(ldapMessage{ID: id, Op: asn1.RawValue{Class: asn1.ClassApplication, Tag: op, IsCompound: true, Bytes: content}})
+	w.Write(out)
+}
+
+// readASN1 читает из потока один элемент с определённой длиной
+func readASN1(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if header[1] >= 0x80 {
+		extra := make([]byte, header[1]&0x7f)
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return nil, err
+		}
+		header = append(header, extra...)
+		length = 0
+		for _, b := range extra {
+			length = length<<8 | int(b)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+func newLDAPFixture(t *testing.T) (*authFixture, *ldapStub) {
+	t.Helper()
+	stub := newLDAPStub(t)
+	f := newAuthFixture(t, "ldap:\n"+
+		"  url: \""+stub.url()+"\"\n"+
+		"  bind_dn: \""+ldapServiceDN+"\"\n"+
+		"  bind_password: \""+ldapServicePwd+"\"\n"+
+		"  base_dn: \"ou=people,dc=example,dc=org\"\n"+
+		"  group_base_dn: \"ou=groups,dc=example,dc=org\"\n")
+	return f, stub
+}
+
+func TestLDAPLogin(t *testing.T) {
+	f, stub := newLDAPFixture(t)
+	var logs lockedBuffer
+	f.auth.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	t.Run("MemberOf", func(t *testing.T) {
+		rr, token := f.login(t, "jdoe", "directory-pass")
+		// Стенд без TLS: при первом входе об этом предупреждает логгер
+		assert.Equal(t, 1, strings.Count(logs.String(), "passwords are sent in clear text"))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		claims, err := f.auth.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "admin", claims["role"])
+		assert.Equal(t, "jdoe", claims["username"])
+		assert.Equal(t, float64(access.StableUserID("5b4a8c0e-1f5e-4b7e-9d8a-2f1c3e4d5a60")), claims["user_id"])
+		assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+	})
+
+	t.Run("StableID", func(t *testing.T) {
+		// Каноническое имя и ID берутся из записи, а не из введённого имени
+		_, first := f.login(t, "JDoe", "directory-pass")
+		_, other := f.login(t, "msmith", "support-pass")
+		firstClaims, err := f.auth.JwtService.ParseJWT(first)
+		assert.NoError(t, err)
+		otherClaims, err := f.auth.JwtService.ParseJWT(other)
+		assert.NoError(t, err)
+		assert.Equal(t, "jdoe", firstClaims["username"])
+		assert.Equal(t, float64(access.StableUserID("5b4a8c0e-1f5e-4b7e-9d8a-2f1c3e4d5a60")), firstClaims["user_id"])
+		assert.NotEqual(t, firstClaims["user_id"], otherClaims["user_id"])
+		assert.NotZero(t, otherClaims["user_id"])
+	})
+
+	t.Run("MissingIDAttribute", func(t *testing.T) {
+		rr, _ := f.login(t, "legacy", "legacy-pass")
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	})
+
+	t.Run("GroupSearch", func(t *testing.T) {
+		rr, token := f.login(t, "msmith", "support-pass")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		claims, _ := f.auth.JwtService.ParseJWT(token)
+		assert.Equal(t, "moderator", claims["role"])
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		for name, creds := range map[string][2]string{
+			"wrong password": {"jdoe", "guess"},
+			"unknown user":   {"ghost", "directory-pass"},
+			"no groups":      {"nogroup", "nogroup-pass"},
+			"wildcard":       {"*", "directory-pass"},
+			"injection":      {"jdoe)(uid=*", "directory-pass"},
+		} {
+			rr, _ := f.login(t, creds[0], creds[1])
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, name)
+			assert.Equal(t, access.ReasonBadCredentials, problemCode(t, rr), name)
+		}
+	})
+
+	t.Run("EmptyPassword", func(t *testing.T) {
+		// Пустой пароль не должен доходить до сервера как unauthenticated bind
+		before := stub.bindCount("uid=msmith,ou=people,dc=example,dc=org")
+		rr, _ := f.login(t, "msmith", "")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, before, stub.bindCount("uid=msmith,ou=people,dc=example,dc=org"))
+	})
+
+	t.Run("BasicAuth", func(t *testing.T) {
+		f.router.With(f.auth.BasicAuth).Get("/api/admin/system", func(w http.ResponseWriter, r *http.Request) {})
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/system", nil)
+		req.SetBasicAuth("jdoe", "directory-pass")
+		rr := httptest.NewRecorder()
+		f.router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+}
+
+func TestLDAPUnavailable(t *testing.T) {
+	f, stub := newLDAPFixture(t)
+	stub.ln.Close()
+
+	rr, _ := f.login(t, "jdoe", "directory-pass")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestLDAPConfig(t *testing.T) {
+	for name, extra := range map[string]string{
+		"scheme":  "ldap:\n  url: \"http://dir.example\"\n  base_dn: \"dc=example\"\n",
+		"base_dn": "ldap:\n  url: \"ldaps://dir.example\"\n",
+		"filter":  "ldap:\n  url: \"ldaps://dir.example\"\n  base_dn: \"dc=example\"\n  user_filter: \"(uid={username}\"\n",
+	} {
+		_, err := access.NewAuthenticator(writeTestConfig(t, extra))
+		assert.Error(t, err, name)
+	}
+}
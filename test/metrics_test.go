@@ -0,0 +1,109 @@
+package access_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStats(t *testing.T) {
+	cache := access.NewLRUCache[string, int](50*time.Millisecond, 2)
+	cache.Set("a", 1)
+	cache.Get("a")       // hit
+	cache.Get("missing") // miss
+	cache.Set("b", 2)
+	cache.Set("c", 3) // вытесняет "a"
+
+	time.Sleep(100 * time.Millisecond)
+	cache.Get("b") // истёк
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.Equal(t, 1, stats.Size)
+}
+
+func TestMetrics(t *testing.T) {
+	auth, err := access.NewAuthenticator("./test_config.yml")
+	assert.NoError(t, err)
+
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(role, path string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if role != "" {
+			token, err := auth.JwtService.GenerateJWT(1, "user", role)
+			assert.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("admin", "/api/admin/users")
+	serve("admin", "/api/admin/users")
+	serve("user", "/api/admin/users")
+	serve("ghost", "/api/admin/users")
+	serve("", "/api/admin/users")
+
+	snap := auth.Metrics.Snapshot()
+	assert.Equal(t, uint64(2), snap.Decisions[access.DecisionKey{Role: "admin", Allowed: true, Reason: access.ReasonGranted}])
+	assert.Equal(t, uint64(1), snap.Decisions[access.DecisionKey{Role: "user", Allowed: false, Reason: access.ReasonAccessDenied}])
+	assert.Equal(t, uint64(1), snap.Decisions[access.DecisionKey{Role: "ghost", Allowed: false, Reason: access.ReasonRoleUnknown}])
+	assert.Equal(t, uint64(1), snap.Decisions[access.DecisionKey{Role: "", Allowed: false, Reason: access.ReasonTokenMissing}])
+	assert.Equal(t, uint64(4), snap.TokenValidation[true].Count)
+
+	// Второй запрос admin попадает в кэш прав
+	assert.Equal(t, uint64(1), snap.Caches["permission"].Hits)
+
+	t.Run("Prometheus text format", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		auth.Metrics.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body, _ := io.ReadAll(rr.Body)
+		text := string(body)
+
+		assert.Contains(t, rr.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+		assert.Contains(t, text, "# TYPE access_cache_hits_total counter\n")
+		assert.Contains(t, text, `access_cache_hits_total{cache="permission"} 1`)
+		assert.Contains(t, text, `access_authz_decisions_total{role="admin",decision="allowed",reason="granted"} 2`)
+		assert.Contains(t, text, `access_authz_decisions_total{role="ghost",decision="denied",reason="role_unknown"} 1`)
+		assert.Contains(t, text, "# TYPE access_token_validation_duration_seconds histogram\n")
+		assert.Contains(t, text, `access_token_validation_duration_seconds_bucket{result="valid",le="+Inf"} 4`)
+		assert.Contains(t, text, `access_token_validation_duration_seconds_count{result="invalid"} 0`)
+		assert.Contains(t, text, "access_password_hash_cost 4\n")
+	})
+}
+
+func TestMetrics_Concurrent(t *testing.T) {
+	metrics := access.NewMetrics(nil)
+	const workers, iterations = 16, 1000
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			role := []string{"admin", "user"}[i%2]
+			for j := 0; j < iterations; j++ {
+				metrics.RecordDecision(role, true, access.ReasonGranted)
+				metrics.ObserveTokenValidation(time.Millisecond, true)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	snap := metrics.Snapshot()
+	assert.Equal(t, uint64(workers/2*iterations), snap.Decisions[access.DecisionKey{Role: "admin", Allowed: true, Reason: access.ReasonGranted}])
+	assert.Equal(t, uint64(workers/2*iterations), snap.Decisions[access.DecisionKey{Role: "user", Allowed: true, Reason: access.ReasonGranted}])
+	h := snap.TokenValidation[true]
+	assert.Equal(t, uint64(workers*iterations), h.Count)
+	assert.InDelta(t, float64(workers*iterations)*0.001, h.Sum, 1e-6)
+}
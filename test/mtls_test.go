@@ -0,0 +1,156 @@
+package access_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue выпускает клиентский сертификат; ca == nil - самоподписанный
+func (ca *testCA) issue(t *testing.T, cn string, dns []string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	auth := newTestAuthenticator(t, "")
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(auth.ClientCertAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := r.Context().Value(access.UserClaimsKey).(jwt.MapClaims)
+		io.WriteString(w, claims["role"].(string)+" "+claims["username"].(string))
+	})))
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	call := func(path string, certs ...tls.Certificate) (int, string) {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL + path)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("SPIFFE", func(t *testing.T) {
+		cert := ca.issue(t, "payments", nil, "spiffe://example.org/payments/worker")
+		code, body := call("/api/admin/users", cert)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "admin spiffe://example.org/payments/worker", body)
+
+		// "*" не захватывает вложенные сегменты пути
+		cert = ca.issue(t, "payments", nil, "spiffe://example.org/payments/worker/debug")
+		code, _ = call("/api/admin/users", cert)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("CommonName", func(t *testing.T) {
+		cert := ca.issue(t, "health-probe", nil)
+		code, body := call("/api/mod/queue", cert)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "moderator health-probe", body)
+
+		code, _ = call("/api/admin/users", cert)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("DNS", func(t *testing.T) {
+		cert := ca.issue(t, "", []string{"profile.users.internal"})
+		code, body := call("/api/user/1", cert)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "user profile.users.internal", body)
+	})
+
+	t.Run("Unmapped", func(t *testing.T) {
+		code, _ := call("/api/mod/queue", ca.issue(t, "billing", nil))
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("NoCertificate", func(t *testing.T) {
+		code, _ := call("/api/mod/queue")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("Unverified", func(t *testing.T) {
+		// Сервер, запрашивающий сертификат без проверки цепочки
+		lax := httptest.NewUnstartedServer(server.Config.Handler)
+		lax.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		lax.StartTLS()
+		defer lax.Close()
+
+		transport := lax.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{(*testCA)(nil).issue(t, "health-probe", nil)}
+		resp, err := (&http.Client{Transport: transport}).Get(lax.URL + "/api/mod/queue")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
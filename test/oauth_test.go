@@ -0,0 +1,392 @@
+package access_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRedirect = "https://app.example/callback"
+
+type oauthFixture struct {
+	*authFixture
+	spa     *access.OAuthClient
+	service *access.OAuthClient
+	secret  string
+}
+
+func newOAuthFixture(t *testing.T, extra string) *oauthFixture {
+	t.Helper()
+	// oauth.issuer требует постоянного ключа подписи
+	f := &oauthFixture{authFixture: newAuthFixtureJWT(t, "  signing_key_file: \""+writeRSAKey(t)+"\"\n", extra)}
+	f.auth.OAuthClients = access.NewMemoryOAuthClientStore()
+	f.router.Route("/oauth", f.auth.MountOAuthRoutes)
+
+	f.spa = &access.OAuthClient{
+		ID:           "spa",
+		Public:       true,
+		RedirectURIs: []string{testRedirect},
+		GrantTypes:   []string{access.GrantAuthorizationCode, access.GrantRefreshToken},
+		Scopes:       []string{"read", "write", "admin_users"},
+	}
+	_, err := f.auth.RegisterOAuthClient(context.Background(), f.spa)
+	assert.NoError(t, err)
+
+	f.service = &access.OAuthClient{
+		ID:         "billing",
+		GrantTypes: []string{access.GrantClientCredentials},
+		Scopes:     []string{"read"},
+		Role:       "moderator",
+		// billing заодно принимает токены других клиентов и проверяет их интроспекцией
+		ResourceServer: true,
+	}
+	f.secret, err = f.auth.RegisterOAuthClient(context.Background(), f.service)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, f.secret)
+	return f
+}
+
+func (f *oauthFixture) form(path string, values url.Values, basicUser, basicPass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicUser != "" {
+		req.SetBasicAuth(basicUser, basicPass)
+	}
+	rr := httptest.NewRecorder()
+	f.router.ServeHTTP(rr, req)
+	return rr
+}
+
+func pkcePair() (verifier, challenge string) {
+	verifier = strings.Repeat("v", 20) + "-pkce-verifier-0123456789abcdef"
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize проходит /authorize от имени владельца token и возвращает параметры редиректа
+func (f *oauthFixture) authorize(t *testing.T, token string, params url.Values) (int, url.Values) {
+	t.Helper()
+	rr := f.do(http.MethodGet, "/oauth/authorize?"+params.Encode(), token, nil)
+	if rr.Code != http.StatusFound {
+		return rr.Code, nil
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	return rr.Code, location.Query()
+}
+
+func authorizeParams(challenge string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {testRedirect},
+		"scope":                 {"read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// exchangeCode проходит /authorize и /token и возвращает выданные токены
+func (f *oauthFixture) exchangeCode(t *testing.T, userToken, scope string) access.OAuthTokenResponse {
+	t.Helper()
+	verifier, challenge := pkcePair()
+	params := authorizeParams(challenge)
+	params.Set("scope", scope)
+	_, redirect := f.authorize(t, userToken, params)
+	rr := f.form("/oauth/token", url.Values{
+		"grant_type":    {access.GrantAuthorizationCode},
+		"client_id":     {"spa"},
+		"code":          {redirect.Get("code")},
+		"redirect_uri":  {testRedirect},
+		"code_verifier": {verifier},
+	}, "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var tokens access.OAuthTokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+	return tokens
+}
+
+func (f *oauthFixture) refresh(refreshToken string) *httptest.ResponseRecorder {
+	return f.form("/oauth/token", url.Values{"grant_type": {access.GrantRefreshToken}, "client_id": {"spa"}, "refresh_token": {refreshToken}}, "", "")
+}
+
+func opaqueKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func decodeOAuth(t *testing.T, rr *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	return body
+}
+
+func TestOAuthAuthorizationCode(t *testing.T) {
+	f := newOAuthFixture(t, "oauth:\n  issuer: https://auth.example\n")
+	_, userToken := f.login(t, "admin", "secret")
+	verifier, challenge := pkcePair()
+
+	code, params := f.authorize(t, userToken, authorizeParams(challenge))
+	assert.Equal(t, http.StatusFound, code)
+	assert.Equal(t, "xyz", params.Get("state"))
+	assert.NotEmpty(t, params.Get("code"))
+
+	exchange := url.Values{
+		"grant_type":    {access.GrantAuthorizationCode},
+		"client_id":     {"spa"},
+		"code":          {params.Get("code")},
+		"redirect_uri":  {testRedirect},
+		"code_verifier": {verifier},
+	}
+
+	t.Run("WrongVerifier", func(t *testing.T) {
+		_, params := f.authorize(t, userToken, authorizeParams(challenge))
+		bad := url.Values{"grant_type": {access.GrantAuthorizationCode}, "client_id": {"spa"}, "code": {params.Get("code")}, "redirect_uri": {testRedirect}, "code_verifier": {strings.Repeat("x", 43)}}
+		rr := f.form("/oauth/token", bad, "", "")
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Equal(t, "invalid_grant", decodeOAuth(t, rr)["error"])
+	})
+
+	rr := f.form("/oauth/token", exchange, "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	var tokens access.OAuthTokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, "read", tokens.Scope)
+	assert.NotEmpty(t, tokens.RefreshToken)
+
+	claims, err := f.auth.JwtService.ParseJWT(tokens.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", claims["role"])
+	assert.Equal(t, "spa", claims["client_id"])
+	assert.Equal(t, "https://auth.example", claims["iss"])
+	assert.Equal(t, []interface{}{access.AMRPassword}, claims["amr"])
+
+	// Токен клиента проходит CheckPermissions только в секции, названные в scope
+	assert.Equal(t, http.StatusForbidden, f.do(http.MethodGet, "/api/admin/users", tokens.AccessToken, nil).Code)
+	scoped := f.exchangeCode(t, userToken, "admin_users")
+	assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", scoped.AccessToken, nil).Code)
+
+	// Токен клиента не меняется на сессию пользователя
+	rr = f.do(http.MethodPost, "/auth/refresh", scoped.AccessToken, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	t.Run("RedirectURIRequired", func(t *testing.T) {
+		verifier, challenge := pkcePair()
+		_, params := f.authorize(t, userToken, authorizeParams(challenge))
+		exchange := url.Values{"grant_type": {access.GrantAuthorizationCode}, "client_id": {"spa"}, "code": {params.Get("code")}, "code_verifier": {verifier}}
+		// RFC 6749 §4.1.3: redirect_uri был в запросе авторизации, без него код не обменивается
+		rr := f.form("/oauth/token", exchange, "", "")
+		assert.Equal(t, "invalid_grant", decodeOAuth(t, rr)["error"])
+
+		// Без redirect_uri в запросе авторизации он не нужен и при обмене
+		verifier, challenge = pkcePair()
+		authorize := authorizeParams(challenge)
+		authorize.Del("redirect_uri")
+		_, params = f.authorize(t, userToken, authorize)
+		exchange = url.Values{"grant_type": {access.GrantAuthorizationCode}, "client_id": {"spa"}, "code": {params.Get("code")}, "code_verifier": {verifier}}
+		assert.Equal(t, http.StatusOK, f.form("/oauth/token", exchange, "", "").Code)
+	})
+
+	t.Run("CodeReuse", func(t *testing.T) {
+		verifier, challenge := pkcePair()
+		_, params := f.authorize(t, userToken, authorizeParams(challenge))
+		exchange := url.Values{"grant_type": {access.GrantAuthorizationCode}, "client_id": {"spa"}, "code": {params.Get("code")}, "redirect_uri": {testRedirect}, "code_verifier": {verifier}}
+		rr := f.form("/oauth/token", exchange, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var issued access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &issued)
+		rr = f.refresh(issued.RefreshToken)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var rotated access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &rotated)
+
+		rr = f.form("/oauth/token", exchange, "", "")
+		assert.Equal(t, "invalid_grant", decodeOAuth(t, rr)["error"])
+
+		// RFC 6749 §4.1.2: всё, что выдано по повторно предъявленному коду, отозвано
+		_, err := f.auth.JwtService.ParseJWT(issued.AccessToken)
+		assert.ErrorIs(t, err, access.ErrTokenRevoked)
+		_, err = f.auth.JwtService.ParseJWT(rotated.AccessToken)
+		assert.ErrorIs(t, err, access.ErrTokenRevoked)
+		assert.Equal(t, "invalid_grant", decodeOAuth(t, f.refresh(rotated.RefreshToken))["error"])
+	})
+
+	t.Run("ConcurrentExchange", func(t *testing.T) {
+		verifier, challenge := pkcePair()
+		_, params := f.authorize(t, userToken, authorizeParams(challenge))
+		exchange := url.Values{"grant_type": {access.GrantAuthorizationCode}, "client_id": {"spa"}, "code": {params.Get("code")}, "redirect_uri": {testRedirect}, "code_verifier": {verifier}}
+		var ok atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if f.form("/oauth/token", exchange, "", "").Code == http.StatusOK {
+					ok.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), ok.Load())
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		refresh := url.Values{"grant_type": {access.GrantRefreshToken}, "client_id": {"spa"}, "refresh_token": {tokens.RefreshToken}}
+		rr := f.form("/oauth/token", refresh, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var rotated access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &rotated)
+		assert.NotEqual(t, tokens.RefreshToken, rotated.RefreshToken)
+
+		// Старый refresh token после ротации не действует
+		rr = f.form("/oauth/token", refresh, "", "")
+		assert.Equal(t, "invalid_grant", decodeOAuth(t, rr)["error"])
+
+		// Расширить scope при обновлении нельзя, но refresh token после отказа годен
+		rr = f.form("/oauth/token", url.Values{"grant_type": {access.GrantRefreshToken}, "client_id": {"spa"}, "refresh_token": {rotated.RefreshToken}, "scope": {"read write"}}, "", "")
+		assert.Equal(t, "invalid_scope", decodeOAuth(t, rr)["error"])
+
+		// Ротация не продлевает срок цепочки
+		before, ok := f.auth.OAuth.RefreshTokens.Get(opaqueKey(rotated.RefreshToken))
+		assert.True(t, ok)
+		time.Sleep(1100 * time.Millisecond)
+		rr = f.refresh(rotated.RefreshToken)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var again access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &again)
+		after, ok := f.auth.OAuth.RefreshTokens.Get(opaqueKey(again.RefreshToken))
+		assert.True(t, ok)
+		assert.Equal(t, before.ExpiresAt, after.ExpiresAt)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		rr := f.form("/oauth/revoke", url.Values{"client_id": {"spa"}, "token": {tokens.AccessToken}}, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodGet, "/api/admin/users", tokens.AccessToken, nil).Code)
+	})
+
+	t.Run("RefreshChecksUser", func(t *testing.T) {
+		issued := f.exchangeCode(t, userToken, "admin_users")
+
+		hash, _ := f.auth.PasswordHasher.HashPassword("secret")
+		f.setUser(&access.User{ID: 1, Username: "admin", Role: "moderator", PasswordHash: hash})
+		rr := f.refresh(issued.RefreshToken)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var demoted access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &demoted)
+		claims, err := f.auth.JwtService.ParseJWT(demoted.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, "moderator", claims["role"])
+
+		f.setUser(&access.User{ID: 1, Username: "admin", Role: "admin", PasswordHash: hash, Disabled: true})
+		assert.Equal(t, "invalid_grant", decodeOAuth(t, f.refresh(demoted.RefreshToken))["error"])
+		// Выданные пользователю токены отозваны вместе с цепочкой
+		_, err = f.auth.JwtService.ParseJWT(demoted.AccessToken)
+		assert.ErrorIs(t, err, access.ErrTokenRevoked)
+	})
+}
+
+func TestOAuthAuthorizeErrors(t *testing.T) {
+	f := newOAuthFixture(t, "")
+	_, userToken := f.login(t, "admin", "secret")
+	_, challenge := pkcePair()
+
+	t.Run("UnregisteredRedirect", func(t *testing.T) {
+		params := authorizeParams(challenge)
+		params.Set("redirect_uri", "https://evil.example/cb")
+		code, _ := f.authorize(t, userToken, params)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("PKCERequired", func(t *testing.T) {
+		params := authorizeParams(challenge)
+		params.Del("code_challenge")
+		_, redirect := f.authorize(t, userToken, params)
+		assert.Equal(t, "invalid_request", redirect.Get("error"))
+		assert.Equal(t, "xyz", redirect.Get("state"))
+	})
+
+	t.Run("InvalidScope", func(t *testing.T) {
+		params := authorizeParams(challenge)
+		params.Set("scope", "admin")
+		_, redirect := f.authorize(t, userToken, params)
+		assert.Equal(t, "invalid_scope", redirect.Get("error"))
+	})
+
+	t.Run("NotLoggedIn", func(t *testing.T) {
+		code, _ := f.authorize(t, "", authorizeParams(challenge))
+		assert.Equal(t, http.StatusUnauthorized, code)
+
+		f.auth.OAuth.LoginURL = "/login"
+		defer func() { f.auth.OAuth.LoginURL = "" }()
+		rr := f.do(http.MethodGet, "/oauth/authorize?"+authorizeParams(challenge).Encode(), "", nil)
+		assert.Equal(t, http.StatusFound, rr.Code)
+		assert.True(t, strings.HasPrefix(rr.Header().Get("Location"), "/login?return_to=%2Foauth%2Fauthorize"))
+	})
+
+	t.Run("ConsentDenied", func(t *testing.T) {
+		var asked *access.AuthorizeRequest
+		f.auth.OAuth.Consent = func(w http.ResponseWriter, r *http.Request, req *access.AuthorizeRequest) access.ConsentDecision {
+			asked = req
+			return access.ConsentDenied
+		}
+		defer func() { f.auth.OAuth.Consent = nil }()
+
+		_, redirect := f.authorize(t, userToken, authorizeParams(challenge))
+		assert.Equal(t, "access_denied", redirect.Get("error"))
+		assert.Equal(t, "spa", asked.Client.ID)
+		assert.Equal(t, []string{"read"}, asked.Scopes)
+		assert.Equal(t, "admin", asked.User["username"])
+	})
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	f := newOAuthFixture(t, "")
+	grant := url.Values{"grant_type": {access.GrantClientCredentials}}
+
+	rr := f.form("/oauth/token", grant, "billing", f.secret)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var tokens access.OAuthTokenResponse
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	assert.Empty(t, tokens.RefreshToken)
+
+	claims, err := f.auth.JwtService.ParseJWT(tokens.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "moderator", claims["role"])
+	assert.Equal(t, "billing", claims["username"])
+	assert.Equal(t, "read", claims["scope"])
+
+	t.Run("SecretPost", func(t *testing.T) {
+		rr := f.form("/oauth/token", url.Values{"grant_type": {access.GrantClientCredentials}, "client_id": {"billing"}, "client_secret": {f.secret}}, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		rr := f.form("/oauth/token", grant, "billing", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "invalid_client", decodeOAuth(t, rr)["error"])
+		assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("GrantNotAllowed", func(t *testing.T) {
+		rr := f.form("/oauth/token", url.Values{"grant_type": {access.GrantClientCredentials}, "client_id": {"spa"}}, "", "")
+		assert.Equal(t, "unauthorized_client", decodeOAuth(t, rr)["error"])
+	})
+}
@@ -0,0 +1,193 @@
+package access_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const testIssuer = "https://auth.example/oauth"
+
+func newOIDCFixture(t *testing.T, extra string) *oauthFixture {
+	t.Helper()
+	f := newOAuthFixture(t, "oauth:\n  issuer: "+testIssuer+"\n"+extra)
+	_, err := f.auth.RegisterOAuthClient(context.Background(), &access.OAuthClient{
+		ID:           "rp",
+		Public:       true,
+		RedirectURIs: []string{testRedirect},
+		GrantTypes:   []string{access.GrantAuthorizationCode, access.GrantRefreshToken},
+		Scopes:       []string{access.ScopeOpenID, access.ScopeProfile},
+	})
+	assert.NoError(t, err)
+	return f
+}
+
+// verifyIDToken проверяет подпись ID token по ключам из /jwks, как это делает клиентская библиотека
+func verifyIDToken(t *testing.T, f *oauthFixture, idToken string) jwt.MapClaims {
+	t.Helper()
+	var set access.JSONWebKeySet
+	assert.NoError(t, json.Unmarshal(f.do(http.MethodGet, "/oauth/jwks", "", nil).Body.Bytes(), &set))
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != "RS256" {
+			return nil, errors.New("unexpected alg")
+		}
+		for _, key := range set.Keys {
+			if key.Kid == token.Header["kid"] {
+				return key.RSAPublicKey()
+			}
+		}
+		return nil, errors.New("unknown kid")
+	})
+	assert.NoError(t, err)
+	return token.Claims.(jwt.MapClaims)
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	f := newOIDCFixture(t, "")
+	rr := f.do(http.MethodGet, "/oauth/.well-known/openid-configuration", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var doc access.OIDCDiscovery
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &doc))
+	assert.Equal(t, testIssuer, doc.Issuer)
+	assert.Equal(t, testIssuer+"/token", doc.TokenEndpoint)
+	assert.Equal(t, testIssuer+"/jwks", doc.JWKSURI)
+	assert.Equal(t, testIssuer+"/introspect", doc.IntrospectionEndpoint)
+	assert.Equal(t, []string{"RS256"}, doc.IDTokenSigningAlgValuesSupported)
+	assert.Contains(t, doc.CodeChallengeMethodsSupported, "S256")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	f := newOIDCFixture(t, "")
+	_, userToken := f.login(t, "admin", "secret")
+	verifier, challenge := pkcePair()
+
+	params := authorizeParams(challenge)
+	params.Set("client_id", "rp")
+	params.Set("scope", "openid profile")
+	params.Set("nonce", "n-0S6_WzA2Mj")
+	_, redirect := f.authorize(t, userToken, params)
+	assert.NotEmpty(t, redirect.Get("code"))
+
+	rr := f.form("/oauth/token", url.Values{
+		"grant_type":    {access.GrantAuthorizationCode},
+		"client_id":     {"rp"},
+		"code":          {redirect.Get("code")},
+		"redirect_uri":  {testRedirect},
+		"code_verifier": {verifier},
+	}, "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var tokens access.OAuthTokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+	assert.NotEmpty(t, tokens.IDToken)
+
+	claims := verifyIDToken(t, f, tokens.IDToken)
+	assert.Equal(t, testIssuer, claims["iss"])
+	assert.Equal(t, "rp", claims["aud"])
+	assert.Equal(t, "1", claims["sub"])
+	assert.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+	assert.Equal(t, "admin", claims["preferred_username"])
+	assert.NotNil(t, claims["auth_time"])
+
+	sum := sha256.Sum256([]byte(tokens.AccessToken))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:16]), claims["at_hash"])
+
+	t.Run("UserInfo", func(t *testing.T) {
+		rr := f.do(http.MethodGet, "/oauth/userinfo", tokens.AccessToken, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var info map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &info)
+		assert.Equal(t, "1", info["sub"])
+		assert.Equal(t, "admin", info["preferred_username"])
+
+		// Обычный токен входа - не токен клиента OIDC
+		assert.Equal(t, http.StatusForbidden, f.do(http.MethodGet, "/oauth/userinfo", userToken, nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodGet, "/oauth/userinfo", "", nil).Code)
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		rr := f.form("/oauth/token", url.Values{"grant_type": {access.GrantRefreshToken}, "client_id": {"rp"}, "refresh_token": {tokens.RefreshToken}}, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var refreshed access.OAuthTokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &refreshed)
+
+		refreshedClaims := verifyIDToken(t, f, refreshed.IDToken)
+		assert.Equal(t, claims["auth_time"], refreshedClaims["auth_time"])
+		assert.Nil(t, refreshedClaims["nonce"])
+	})
+}
+
+func TestOIDCPromptAndMaxAge(t *testing.T) {
+	f := newOIDCFixture(t, "")
+	_, challenge := pkcePair()
+	params := authorizeParams(challenge)
+	params.Set("client_id", "rp")
+	params.Set("scope", "openid")
+
+	t.Run("PromptNone", func(t *testing.T) {
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Set("prompt", "none")
+		_, redirect := f.authorize(t, "", p)
+		assert.Equal(t, "login_required", redirect.Get("error"))
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		stale, err := f.auth.JwtService.GenerateJWTWithClaims(1, "admin", "admin", jwt.MapClaims{"auth_time": time.Now().Add(-time.Hour).Unix()})
+		assert.NoError(t, err)
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Set("max_age", "60")
+		code, _ := f.authorize(t, stale, p)
+		assert.Equal(t, http.StatusUnauthorized, code)
+
+		_, fresh := f.login(t, "admin", "secret")
+		code, redirect := f.authorize(t, fresh, p)
+		assert.Equal(t, http.StatusFound, code)
+		assert.NotEmpty(t, redirect.Get("code"))
+	})
+}
+
+func TestIssuerRequiresSigningKey(t *testing.T) {
+	_, err := access.NewAuthenticator(writeTestConfig(t, "oauth:\n  issuer: "+testIssuer+"\n"))
+	assert.Error(t, err)
+}
+
+func TestSigningKeyFile(t *testing.T) {
+	// Реплики с общим ключом публикуют одинаковый JWKS
+	jwtExtra := "  old_keys_to_keep: 1\n  signing_key_file: \"" + writeRSAKey(t) + "\"\n"
+	a := newTestAuthenticatorJWT(t, jwtExtra, "")
+	b := newTestAuthenticatorJWT(t, jwtExtra, "")
+
+	assert.Len(t, a.JwtService.JWKS().Keys, 1)
+	assert.Equal(t, a.JwtService.JWKS(), b.JwtService.JWKS())
+
+	// Старый ключ остаётся в JWKS после ротации, пока не истекут выданные токены
+	signed, err := a.JwtService.SignRS256(jwt.MapClaims{"sub": "1"})
+	assert.NoError(t, err)
+	next, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	a.JwtService.RotateSigningKey(next)
+	keys := a.JwtService.JWKS().Keys
+	assert.Len(t, keys, 2)
+
+	parsed, _ := jwt.Parse(signed, nil)
+	assert.Equal(t, b.JwtService.JWKS().Keys[0].Kid, parsed.Header["kid"])
+}
@@ -3,7 +3,10 @@ package access_test
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/SerMoskvin/access"
 	"github.com/stretchr/testify/assert"
@@ -148,3 +151,45 @@ func TestJWT_Rotation(t *testing.T) {
 	_, err = svc.ParseJWT(token3)
 	assert.NoError(t, err)
 }
+
+func TestPasswordHasher_AutoCost(t *testing.T) {
+	permPath, err := filepath.Abs("./test_perm_config.yml")
+	assert.NoError(t, err)
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yml")
+	cfg := "jwt:\n  secret: \"test-secret\"\n  ttl: \"1h\"\n" +
+		"permissions:\n  path: \"" + filepath.ToSlash(permPath) + "\"\n" +
+		"password:\n  auto_cost: true\n  target_latency: \"1ms\"\n"
+	assert.NoError(t, os.WriteFile(cfgPath, []byte(cfg), 0644))
+
+	auth, err := access.NewAuthenticator(cfgPath)
+	assert.NoError(t, err)
+
+	// Целевое время заведомо недостижимо - должен сработать безопасный минимум
+	assert.Equal(t, 10, auth.PasswordHasher.Cost())
+
+	hash, err := auth.PasswordHasher.HashPassword("secret")
+	assert.NoError(t, err)
+	assert.True(t, auth.PasswordHasher.CheckPasswordHash("secret", hash))
+}
+
+func TestCalibrateCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		measured time.Duration
+		target   time.Duration
+		floor    int
+		want     int
+	}{
+		{name: "Ryzen 2600, 250ms", measured: 14 * time.Millisecond, target: 250 * time.Millisecond, floor: 10, want: 12},
+		{name: "Fast host", measured: 3 * time.Millisecond, target: 250 * time.Millisecond, floor: 10, want: 14},
+		{name: "Slow host keeps floor", measured: 200 * time.Millisecond, target: 250 * time.Millisecond, floor: 10, want: 10},
+		{name: "Max cost", measured: time.Nanosecond, target: time.Hour, floor: 10, want: 31},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, access.CalibrateCost(tt.measured, 8, tt.target, tt.floor))
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"net/http/httptest"
 	"path/filepath"
 	"testing"
-	"time"
 
 	"github.com/SerMoskvin/access"
 	"github.com/go-chi/chi/v5"
@@ -26,10 +25,13 @@ func getTestConfigPath(t *testing.T) string {
 
 func TestCheckPermissions(t *testing.T) {
 	configPath := getTestConfigPath(t)
-	auth := access.NewAuthenticator("test-secret")
+	auth, err := access.NewAuthenticator(configPath)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
 
 	// Инициализируем конфиг
-	_, err := access.GetPermissions(configPath)
+	_, err = access.GetPermissions(configPath)
 	if err != nil {
 		t.Fatalf("Failed to load permissions config: %v", err)
 	}
@@ -77,7 +79,7 @@ func TestCheckPermissions(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			token, _ := auth.GenerateJWT(1, "testuser", tt.role, time.Hour)
+			token, _ := auth.JwtService.GenerateJWT(1, "testuser", tt.role)
 			req := httptest.NewRequest(tt.method, tt.path, nil)
 			req.Header.Set("Authorization", "Bearer "+token)
 
@@ -93,10 +95,13 @@ func TestCheckPermissions(t *testing.T) {
 
 func TestCheckOwnRecords(t *testing.T) {
 	configPath := getTestConfigPath(t)
-	auth := access.NewAuthenticator("test-secret")
+	auth, err := access.NewAuthenticator(configPath)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
 
 	// Инициализируем конфиг
-	_, err := access.GetPermissions(configPath)
+	_, err = access.GetPermissions(configPath)
 	if err != nil {
 		t.Fatalf("Failed to load permissions config: %v", err)
 	}
@@ -118,7 +123,7 @@ func TestCheckOwnRecords(t *testing.T) {
 	t.Run("Teacher can modify own record", func(t *testing.T) {
 		router := createTestRouter()
 		teacherID := 10
-		token, _ := auth.GenerateJWT(teacherID, "teacher1", "teacher", time.Hour)
+		token, _ := auth.JwtService.GenerateJWT(teacherID, "teacher1", "teacher")
 
 		body := map[string]interface{}{"grade": "A"}
 		bodyBytes, _ := json.Marshal(body)
@@ -142,7 +147,7 @@ func TestCheckOwnRecords(t *testing.T) {
 	t.Run("Student cannot access other's records", func(t *testing.T) {
 		router := createTestRouter()
 		studentID := 5
-		token, _ := auth.GenerateJWT(studentID, "student1", "student", time.Hour)
+		token, _ := auth.JwtService.GenerateJWT(studentID, "student1", "student")
 
 		req := httptest.NewRequest(http.MethodGet, "/grades/10", nil) // Чужой ID
 		req.Header.Set("Authorization", "Bearer "+token)
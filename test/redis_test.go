@@ -0,0 +1,485 @@
+package access_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis - минимальный сервер RESP в памяти процесса, понимает только
+// команды, которые использует RedisBackend
+type fakeRedis struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	store       map[string]fakeRedisItem
+	subscribers map[string][]net.Conn
+}
+
+type fakeRedisItem struct {
+	value  string
+	expire time.Time
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := &fakeRedis{
+		ln:          ln,
+		store:       make(map[string]fakeRedisItem),
+		subscribers: make(map[string][]net.Conn),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return srv
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		reply := s.exec(conn, args)
+		s.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) exec(conn net.Conn, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		item, ok := s.store[args[1]]
+		if !ok || time.Now().After(item.expire) {
+			return "$-1\r\n"
+		}
+		return bulk(item.value)
+	case "GETDEL":
+		item, ok := s.store[args[1]]
+		delete(s.store, args[1])
+		if !ok || time.Now().After(item.expire) {
+			return "$-1\r\n"
+		}
+		return bulk(item.value)
+	case "SET":
+		ttl := time.Hour
+		if len(args) >= 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			ttl = time.Duration(ms) * time.Millisecond
+		}
+		if len(args) == 6 && strings.ToUpper(args[5]) == "NX" {
+			if item, ok := s.store[args[1]]; ok && time.Now().Before(item.expire) {
+				return "$-1\r\n"
+			}
+		}
+		s.store[args[1]] = fakeRedisItem{value: args[2], expire: time.Now().Add(ttl)}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.store[key]; ok {
+				delete(s.store, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key, item := range s.store {
+			if matchGlob(pattern, key) && time.Now().Before(item.expire) {
+				keys = append(keys, bulk(key))
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	case "PUBLISH":
+		subs := s.subscribers[args[1]]
+		for _, sub := range subs {
+			io.WriteString(sub, "*3\r\n"+bulk("message")+bulk(args[1])+bulk(args[2]))
+		}
+		return fmt.Sprintf(":%d\r\n", len(subs))
+	case "SUBSCRIBE":
+		s.subscribers[args[1]] = append(s.subscribers[args[1]], conn)
+		return "*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// matchGlob - упрощённый glob Redis: '*', '?' и экранирование обратным слэшем
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisBackend(t *testing.T) {
+	srv := startFakeRedis(t)
+	backend := access.NewRedisBackend(srv.Addr(), "secret", 1, "")
+	defer backend.Close()
+
+	t.Run("Set, Get and Delete", func(t *testing.T) {
+		assert.NoError(t, backend.Set("access:a", []byte("1"), time.Minute))
+
+		value, ok, err := backend.Get("access:a")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("1"), value)
+
+		assert.NoError(t, backend.Delete("access:a"))
+		_, ok, err = backend.Get("access:a")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("GetDel", func(t *testing.T) {
+		assert.NoError(t, backend.Set("access:once", []byte("1"), time.Minute))
+		value, ok, err := backend.GetDel("access:once")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("1"), value)
+		_, ok, err = backend.GetDel("access:once")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("SetNX", func(t *testing.T) {
+		added, err := backend.SetNX("access:nx", []byte("1"), time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, added)
+		added, err = backend.SetNX("access:nx", []byte("2"), time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, added)
+	})
+
+	t.Run("Keys by prefix", func(t *testing.T) {
+		assert.NoError(t, backend.Set("access:token:1", []byte("1"), time.Minute))
+		assert.NoError(t, backend.Set("access:token:2", []byte("2"), time.Minute))
+		assert.NoError(t, backend.Set("access:password:1", []byte("3"), time.Minute))
+
+		keys, err := backend.Keys("access:token:")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"access:token:1", "access:token:2"}, keys)
+	})
+
+	t.Run("Publish reaches subscribers", func(t *testing.T) {
+		received := make(chan string, 1)
+		assert.NoError(t, backend.Subscribe(func(message string) { received <- message }))
+
+		// Подписка поднимается в фоне, публикуем до первого полученного сообщения
+		assert.Eventually(t, func() bool {
+			assert.NoError(t, backend.Publish("hello"))
+			select {
+			case msg := <-received:
+				return msg == "hello"
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestCacheBackend_RevocationFailsClosed(t *testing.T) {
+	// Адрес, на котором никто не слушает: хранилище недоступно
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	f := newAuthFixture(t, "")
+	var logs lockedBuffer
+	f.auth.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	backend := access.NewRedisBackend(addr, "", 0, "")
+	backend.Timeout = 50 * time.Millisecond
+	f.auth.UseCacheBackend(backend)
+	t.Cleanup(func() { f.auth.Close() })
+
+	token, err := f.auth.JwtService.GenerateJWT(1, "admin", "admin")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, f.auth.JwtService.RevokeJWT(token), access.ErrCacheUnavailable)
+
+	// Выход не сообщает об успехе, пока токен остаётся действительным
+	rr := f.do(http.MethodPost, "/auth/logout", token, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	// Сбой хранилища виден в логгере из SetLogger, а не в глобальном log
+	assert.Contains(t, logs.String(), "cache backend failed")
+}
+
+// lockedBuffer - приёмник логов, в который пишут и фоновые горутины
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newReplica(t *testing.T, redisAddr string) *access.Authenticator {
+	t.Helper()
+	permPath, err := filepath.Abs("./test_perm_config.yml")
+	assert.NoError(t, err)
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yml")
+	cfg := "jwt:\n  secret: \"test-secret\"\n  ttl: \"1h\"\n" +
+		"permissions:\n  path: \"" + filepath.ToSlash(permPath) + "\"\n" +
+		"password:\n  cost: 4\n" +
+		"cache:\n  token_ttl: \"1h\"\n  password_ttl: \"1h\"\n  permission_ttl: \"1h\"\n" +
+		"  backend: redis\n  local_ttl: \"1h\"\n  redis:\n    addr: \"" + redisAddr + "\"\n"
+	assert.NoError(t, os.WriteFile(cfgPath, []byte(cfg), 0644))
+
+	auth, err := access.NewAuthenticator(cfgPath)
+	assert.NoError(t, err)
+	t.Cleanup(func() { auth.Close() })
+	return auth
+}
+
+func TestCacheBackend_Replicas(t *testing.T) {
+	srv := startFakeRedis(t)
+	replicaA := newReplica(t, srv.Addr())
+	replicaB := newReplica(t, srv.Addr())
+
+	token, err := replicaA.JwtService.GenerateJWT(1, "user", "admin")
+	assert.NoError(t, err)
+
+	t.Run("Entries are shared", func(t *testing.T) {
+		_, err := replicaA.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+
+		claims, ok := replicaB.TokenCache.Get(token)
+		assert.True(t, ok)
+		assert.Equal(t, "admin", claims["role"])
+	})
+
+	t.Run("Revocation drops local copies on other replicas", func(t *testing.T) {
+		// У реплики B запись уже лежит в локальном кэше на час
+		_, ok := replicaB.TokenCache.Get(token)
+		assert.True(t, ok)
+
+		replicaA.TokenCache.Delete(token)
+
+		assert.Eventually(t, func() bool {
+			_, ok := replicaB.TokenCache.Get(token)
+			return !ok
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Permission reset is broadcast", func(t *testing.T) {
+		replicaB.PermissionCache.Set("admin:/api/admin/users:GET", true)
+		_, ok := replicaB.PermissionCache.Get("admin:/api/admin/users:GET")
+		assert.True(t, ok)
+
+		replicaA.PermissionCache.Clear()
+
+		assert.Eventually(t, func() bool {
+			return replicaB.PermissionCache.Len() == 0
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			_, ok := replicaB.PermissionCache.Get("admin:/api/admin/users:GET")
+			return !ok
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Permission decisions are keyed by permissions file", func(t *testing.T) {
+		// Решения, закэшированные репликой с другим файлом прав, не применяются
+		replicaB.PermissionCache.Set("admin:/api/unlisted:GET", true)
+		replicaB.PermissionCache.Set("0123456789abcdef:admin:/api/unlisted:GET", true)
+
+		handler := replicaA.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/api/unlisted", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("Secrets stay out of the shared store", func(t *testing.T) {
+		hash, err := replicaA.PasswordHasher.HashPassword("hunter22")
+		assert.NoError(t, err)
+		assert.True(t, replicaA.PasswordHasher.CheckPasswordHash("hunter22", hash))
+		_, err = replicaA.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		assert.NotEmpty(t, srv.store)
+		for key, item := range srv.store {
+			assert.NotContains(t, key, token)
+			assert.NotContains(t, key, "hunter22")
+			assert.NotContains(t, item.value, "hunter22")
+		}
+	})
+
+	t.Run("Revocation is check-and-set across replicas", func(t *testing.T) {
+		token, err := replicaA.JwtService.GenerateJWT(1, "user", "admin")
+		assert.NoError(t, err)
+		assert.NoError(t, replicaA.JwtService.RevokeJWT(token))
+		// Реплика B ещё не видела отзыв в локальном кэше токенов, но jti уже занят
+		replicaB.TokenCache.Delete(token)
+		assert.ErrorIs(t, replicaB.JwtService.RevokeJWT(token), access.ErrTokenRevoked)
+	})
+
+	t.Run("Claims survive JSON round trip", func(t *testing.T) {
+		replicaA.TokenCache.Set("custom", jwt.MapClaims{"role": "user", "user_id": 7})
+		claims, ok := replicaB.TokenCache.Get("custom")
+		assert.True(t, ok)
+		assert.Equal(t, float64(7), claims["user_id"])
+	})
+}
+
+func TestRedisBackend_Stalled(t *testing.T) {
+	// Сервер принимает соединения, но не отвечает
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	backend := access.NewRedisBackend(ln.Addr().String(), "", 0, "")
+	backend.Timeout = 50 * time.Millisecond
+	defer backend.Close()
+
+	start := time.Now()
+	_, _, err = backend.Get("access:a")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// После таймаута команды сразу отказывают, не дожидаясь сервера
+	start = time.Now()
+	_, _, err = backend.Get("access:a")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+
+	t.Run("Authenticator keeps working", func(t *testing.T) {
+		auth := newReplica(t, ln.Addr().String())
+		token, err := auth.JwtService.GenerateJWT(1, "user", "admin")
+		assert.NoError(t, err)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := auth.JwtService.ParseJWT(token)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ParseJWT blocked on a stalled Redis")
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package access_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+const sessionConfig = "session:\n  enabled: true\n  same_site: strict\n"
+
+func TestSessionCookies(t *testing.T) {
+	auth := newTestAuthenticator(t, sessionConfig)
+
+	rr := httptest.NewRecorder()
+	token, err := auth.StartSession(rr, 1, "admin", "admin")
+	assert.NoError(t, err)
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rr.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+
+	session := cookies["access_token"]
+	if assert.NotNil(t, session) {
+		assert.Equal(t, token, session.Value)
+		assert.True(t, session.HttpOnly)
+		assert.True(t, session.Secure)
+		assert.Equal(t, http.SameSiteStrictMode, session.SameSite)
+		assert.Equal(t, 3600, session.MaxAge)
+	}
+
+	csrf := cookies["csrf_token"]
+	if assert.NotNil(t, csrf) {
+		assert.False(t, csrf.HttpOnly)
+		claims, err := auth.JwtService.ParseJWT(token)
+		assert.NoError(t, err)
+		assert.Equal(t, auth.CSRFToken(claims["jti"].(string)), csrf.Value)
+	}
+
+	t.Run("Clear", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		auth.ClearSessionCookies(rr)
+		for _, c := range rr.Result().Cookies() {
+			assert.Equal(t, "", c.Value)
+			assert.True(t, c.MaxAge < 0)
+		}
+	})
+}
+
+func TestCSRFProtection(t *testing.T) {
+	auth := newTestAuthenticator(t, sessionConfig)
+
+	login := httptest.NewRecorder()
+	token, err := auth.StartSession(login, 1, "admin", "admin")
+	assert.NoError(t, err)
+	var csrfToken string
+	for _, c := range login.Result().Cookies() {
+		if c.Name == "csrf_token" {
+			csrfToken = c.Value
+		}
+	}
+
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{
+			name:   "Cookie GET needs no CSRF token",
+			method: http.MethodGet,
+			setup:  func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "access_token", Value: token}) },
+			want:   http.StatusOK,
+		},
+		{
+			name:   "Cookie POST without CSRF token",
+			method: http.MethodPost,
+			setup:  func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "access_token", Value: token}) },
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "Cookie POST with wrong CSRF token",
+			method: http.MethodDelete,
+			setup: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+				r.Header.Set("X-CSRF-Token", auth.CSRFToken("other-jti"))
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name:   "Cookie POST with CSRF token",
+			method: http.MethodPost,
+			setup: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+				r.Header.Set("X-CSRF-Token", csrfToken)
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:   "Bearer POST is not CSRF-prone",
+			method: http.MethodPost,
+			setup:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) },
+			want:   http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/admin/users", nil)
+			tt.setup(req)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.want, rr.Code)
+		})
+	}
+
+	t.Run("Standalone middleware", func(t *testing.T) {
+		protected := auth.CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		req := httptest.NewRequest(http.MethodPut, "/profile", nil)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+		rr := httptest.NewRecorder()
+		protected.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	assert.Equal(t, uint64(3), auth.Metrics.Snapshot().Decisions[access.DecisionKey{Reason: access.ReasonCSRFFailed}])
+}
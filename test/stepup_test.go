@@ -0,0 +1,102 @@
+package access_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepUpRequirements(t *testing.T) {
+	auth := newTestAuthenticator(t, "")
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	token := func(extra jwt.MapClaims) string {
+		tok, err := auth.JwtService.GenerateJWTWithClaims(1, "admin", "admin", extra)
+		assert.NoError(t, err)
+		return tok
+	}
+	call := func(path, tok string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	now := time.Now().Unix()
+	passwordOnly := token(jwt.MapClaims{"amr": []string{access.AMRPassword}, "auth_time": now})
+	withMFA := token(jwt.MapClaims{"amr": []string{access.AMRPassword, access.AMROTP}, "mfa": true, "auth_time": now})
+	stale := token(jwt.MapClaims{"amr": []string{access.AMRPassword}, "auth_time": time.Now().Add(-time.Hour).Unix()})
+
+	t.Run("RequireMFA", func(t *testing.T) {
+		rr := call("/api/admin/payments", passwordOnly)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+
+		var problem access.Problem
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+		assert.Equal(t, access.ReasonStepUpRequired, problem.Code)
+		assert.True(t, problem.StepUp.RequireMFA)
+
+		assert.Equal(t, http.StatusOK, call("/api/admin/payments", withMFA).Code)
+		// Повторный запрос без MFA не проходит за счёт кэша решений
+		assert.Equal(t, http.StatusUnauthorized, call("/api/admin/payments", passwordOnly).Code)
+	})
+
+	t.Run("MaxAuthAge", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call("/api/admin/keys", passwordOnly).Code)
+
+		rr := call("/api/admin/keys", stale)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.True(t, strings.HasSuffix(rr.Header().Get("WWW-Authenticate"), "max_age=600"))
+
+		// Токен без auth_time не подтверждает свежую аутентификацию
+		plain, _ := auth.JwtService.GenerateJWT(1, "admin", "admin")
+		assert.Equal(t, http.StatusUnauthorized, call("/api/admin/keys", plain).Code)
+	})
+
+	t.Run("OtherSectionsUnaffected", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call("/api/admin/users", stale).Code)
+	})
+
+	snap := auth.Metrics.Snapshot()
+	assert.Equal(t, uint64(4), snap.Decisions[access.DecisionKey{Role: "admin", Allowed: false, Reason: access.ReasonStepUpRequired}])
+}
+
+func TestSectionLongestPrefix(t *testing.T) {
+	auth := newTestAuthenticator(t, "")
+	handler := auth.CheckPermissions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	call := func(method, path string, extra jwt.MapClaims) int {
+		tok, err := auth.JwtService.GenerateJWTWithClaims(3, "auditor", "auditor", extra)
+		assert.NoError(t, err)
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	withMFA := jwt.MapClaims{"mfa": true, "auth_time": time.Now().Unix()}
+
+	// /api/reports идёт в конфиге первой, но /api/reports/finance решает за свои пути
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/api/reports/daily", nil))
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/api/reports/finance/q1", nil))
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/api/reports/finance/q1", withMFA))
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/api/reports/finance/q1", withMFA))
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/reports/daily", nil))
+
+	// Запись разрешена общей секцией, но под узкой секцией только для чтения
+	// действуют её права: can_write общей секции их не расширяет
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/api/reports/archive/2023", nil))
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/api/reports/archive/2023", nil))
+}
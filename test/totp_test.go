@@ -0,0 +1,278 @@
+package access_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryTOTPStore struct {
+	mu     sync.Mutex
+	secret string
+	codes  []string
+}
+
+func (s *memoryTOTPStore) TOTPSecret(ctx context.Context, userID int) (string, error) {
+	return s.secret, nil
+}
+
+func (s *memoryTOTPStore) RecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.codes...), nil
+}
+
+func (s *memoryTOTPStore) ConsumeRecoveryCode(ctx context.Context, userID int, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, h := range s.codes {
+		if h == hash {
+			s.codes = append(s.codes[:i], s.codes[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func TestTOTP_RFC6238Vectors(t *testing.T) {
+	vectors := []struct {
+		algorithm string
+		key       string
+		at        int64
+		code      string
+	}{
+		{"SHA1", "12345678901234567890", 59, "94287082"},
+		{"SHA1", "12345678901234567890", 1111111109, "07081804"},
+		{"SHA1", "12345678901234567890", 20000000000, "65353130"},
+		{"SHA256", "12345678901234567890123456789012", 59, "46119246"},
+		{"SHA512", "1234567890123456789012345678901234567890123456789012345678901234", 59, "90693936"},
+	}
+
+	for _, v := range vectors {
+		auth := newTestAuthenticator(t, "mfa:\n  totp:\n    digits: 8\n    algorithm: "+v.algorithm+"\n")
+		secret := base32.StdEncoding.EncodeToString([]byte(v.key))
+
+		code, err := auth.TOTP.Code(secret, time.Unix(v.at, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, v.code, code, "%s at %d", v.algorithm, v.at)
+	}
+}
+
+func TestTOTP_Validate(t *testing.T) {
+	auth := newTestAuthenticator(t, "mfa:\n  totp:\n    issuer: Access\n")
+	secret, err := access.GenerateTOTPSecret()
+	assert.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	code, _ := auth.TOTP.Code(secret, now)
+
+	t.Run("Skew", func(t *testing.T) {
+		prev, _ := auth.TOTP.Code(secret, now.Add(-30*time.Second))
+		assert.True(t, auth.TOTP.Validate("skew", secret, prev, now))
+
+		old, _ := auth.TOTP.Code(secret, now.Add(-90*time.Second))
+		assert.False(t, auth.TOTP.Validate("skew-old", secret, old, now))
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		assert.True(t, auth.TOTP.Validate("replay", secret, code, now))
+		assert.False(t, auth.TOTP.Validate("replay", secret, code, now))
+
+		// Код предыдущего шага после принятого текущего тоже отклоняется
+		prev, _ := auth.TOTP.Code(secret, now.Add(-30*time.Second))
+		assert.False(t, auth.TOTP.Validate("replay", secret, prev, now))
+	})
+
+	t.Run("Provisioning", func(t *testing.T) {
+		uri := auth.TOTP.ProvisioningURI(secret, "admin@example.com")
+		assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Access:admin@example.com?"))
+		assert.Contains(t, uri, "secret="+secret)
+		assert.Contains(t, uri, "digits=6")
+		assert.Contains(t, uri, "period=30")
+
+		png, err := auth.TOTP.QRCodePNG(secret, "admin@example.com", 256)
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(png, []byte("\x89PNG\r\n\x1a\n")))
+	})
+}
+
+func TestTOTPHandler(t *testing.T) {
+	f := newAuthFixture(t, "")
+	secret, _ := access.GenerateTOTPSecret()
+	codes, hashes, err := f.auth.TOTP.GenerateRecoveryCodes(2)
+	assert.NoError(t, err)
+	assert.Len(t, codes, 2)
+	assert.NotEqual(t, codes[0], hashes[0])
+
+	store := &memoryTOTPStore{secret: secret, codes: hashes}
+	f.auth.TOTPStore = store
+
+	_, token := f.login(t, "admin", "secret")
+	claims, err := f.auth.JwtService.ParseJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{access.AMRPassword}, claims["amr"])
+	assert.Nil(t, claims["mfa"])
+
+	rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": "000000x"})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, access.ReasonBadCredentials, problemCode(t, rr))
+
+	code, _ := f.auth.TOTP.Code(secret, time.Now())
+	rr = f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": code})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mfaToken := decodeToken(t, rr)
+
+	claims, err = f.auth.JwtService.ParseJWT(mfaToken)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{access.AMRPassword, access.AMROTP}, claims["amr"])
+	assert.Equal(t, true, claims["mfa"])
+	assert.NotNil(t, claims["auth_time"])
+
+	// Токен после пароля отозван
+	_, err = f.auth.JwtService.ParseJWT(token)
+	assert.ErrorIs(t, err, access.ErrTokenRevoked)
+
+	t.Run("RefreshKeepsMFA", func(t *testing.T) {
+		rr := f.do(http.MethodPost, "/auth/refresh", mfaToken, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		refreshed, err := f.auth.JwtService.ParseJWT(decodeToken(t, rr))
+		assert.NoError(t, err)
+		assert.Equal(t, true, refreshed["mfa"])
+		assert.Equal(t, claims["auth_time"], refreshed["auth_time"])
+	})
+
+	t.Run("RecoveryCode", func(t *testing.T) {
+		_, token := f.login(t, "admin", "secret")
+		rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"recovery_code": strings.ToUpper(codes[1])})
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Len(t, store.codes, 1)
+
+		claims, _ := f.auth.JwtService.ParseJWT(decodeToken(t, rr))
+		assert.Equal(t, []interface{}{access.AMRPassword, access.AMRRecovery}, claims["amr"])
+
+		// Повторно тот же код не принимается
+		_, token = f.login(t, "admin", "secret")
+		rr = f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"recovery_code": codes[1]})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		store.secret = ""
+		_, token := f.login(t, "admin", "secret")
+		rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": "123456"})
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Equal(t, access.ReasonMFANotConfigured, problemCode(t, rr))
+	})
+}
+
+func TestTOTPHandler_Attempts(t *testing.T) {
+	t.Run("Built-in limit without hooks", func(t *testing.T) {
+		f := newAuthFixture(t, "mfa:\n  totp:\n    max_attempts: 2\n")
+		f.auth.Hooks = access.AuthHooks{}
+		secret, _ := access.GenerateTOTPSecret()
+		_, hashes, _ := f.auth.TOTP.GenerateRecoveryCodes(1)
+		f.auth.TOTPStore = &memoryTOTPStore{secret: secret, codes: hashes}
+
+		_, token := f.login(t, "admin", "secret")
+		rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": "000000"})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		rr = f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"recovery_code": "aaaa-bbbb"})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+		// Попытки исчерпаны: верный код тоже не проверяется
+		code, _ := f.auth.TOTP.Code(secret, time.Now())
+		rr = f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": code})
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, access.ReasonAccountLocked, problemCode(t, rr))
+		assert.True(t, f.auth.TOTP.Locked("1"))
+	})
+
+	t.Run("Lockout counts mfa failures", func(t *testing.T) {
+		f := newAuthFixture(t, "mfa:\n  totp:\n    max_attempts: 10\n")
+		secret, _ := access.GenerateTOTPSecret()
+		f.auth.TOTPStore = &memoryTOTPStore{secret: secret}
+
+		_, token := f.login(t, "admin", "secret")
+		for i := 0; i < 3; i++ {
+			f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": "000000"})
+		}
+		code, _ := f.auth.TOTP.Code(secret, time.Now())
+		rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"code": code})
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+		rr, _ = f.login(t, "admin", "secret")
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	})
+
+	t.Run("Recovery code accepted once under concurrency", func(t *testing.T) {
+		f := newAuthFixture(t, "")
+		secret, _ := access.GenerateTOTPSecret()
+		codes, hashes, _ := f.auth.TOTP.GenerateRecoveryCodes(1)
+		f.auth.TOTPStore = &memoryTOTPStore{secret: secret, codes: hashes}
+
+		const n = 4
+		tokens := make([]string, n)
+		for i := range tokens {
+			_, tokens[i] = f.login(t, "admin", "secret")
+		}
+		var ok atomic.Int32
+		var wg sync.WaitGroup
+		for _, token := range tokens {
+			wg.Add(1)
+			go func(token string) {
+				defer wg.Done()
+				rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"recovery_code": codes[0]})
+				if rr.Code == http.StatusOK {
+					ok.Add(1)
+				}
+			}(token)
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), ok.Load())
+	})
+
+	t.Run("Parallel guesses do not exceed limit", func(t *testing.T) {
+		f := newAuthFixture(t, "mfa:\n  totp:\n    max_attempts: 3\n")
+		f.auth.Hooks = access.AuthHooks{}
+		secret, _ := access.GenerateTOTPSecret()
+		_, hashes, _ := f.auth.TOTP.GenerateRecoveryCodes(1)
+		f.auth.TOTPStore = &memoryTOTPStore{secret: secret, codes: hashes}
+		_, token := f.login(t, "admin", "secret")
+
+		var checked, locked atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rr := f.do(http.MethodPost, "/auth/mfa/totp", token, map[string]string{"recovery_code": "aaaa-bbbb"})
+				switch rr.Code {
+				case http.StatusUnauthorized:
+					checked.Add(1)
+				case http.StatusTooManyRequests:
+					locked.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(3), checked.Load())
+		assert.Equal(t, int32(7), locked.Load())
+	})
+}
+
+func decodeToken(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp access.TokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	return resp.AccessToken
+}
@@ -0,0 +1,102 @@
+package access_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/SerMoskvin/access"
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+func newSQLiteStore(t *testing.T) *access.SQLUserStore {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	store := access.NewSQLUserStore(db, access.DialectSQLite)
+	assert.NoError(t, store.Migrate(context.Background()))
+	return store
+}
+
+func TestUserStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) access.UserStore{
+		"Memory": func(t *testing.T) access.UserStore { return access.NewMemoryUserStore() },
+		"SQLite": func(t *testing.T) access.UserStore { return newSQLiteStore(t) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			user := &access.User{Username: "alice", Role: "user", PasswordHash: "hash1"}
+			assert.NoError(t, store.Create(ctx, user))
+			assert.NotZero(t, user.ID)
+
+			assert.ErrorIs(t, store.Create(ctx, &access.User{Username: "alice", Role: "user"}), access.ErrUserExists)
+
+			found, err := store.FindByUsername(ctx, "alice")
+			assert.NoError(t, err)
+			assert.Equal(t, *user, *found)
+
+			found, err = store.FindByID(ctx, user.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "alice", found.Username)
+
+			assert.NoError(t, store.UpdatePasswordHash(ctx, user.ID, "hash2"))
+			assert.NoError(t, store.SetRole(ctx, user.ID, "admin"))
+			assert.NoError(t, store.Disable(ctx, user.ID))
+
+			found, err = store.FindByID(ctx, user.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "hash2", found.PasswordHash)
+			assert.Equal(t, "admin", found.Role)
+			assert.True(t, found.Disabled)
+
+			_, err = store.FindByUsername(ctx, "bob")
+			assert.ErrorIs(t, err, access.ErrUserNotFound)
+			assert.ErrorIs(t, store.SetRole(ctx, 999, "admin"), access.ErrUserNotFound)
+		})
+	}
+}
+
+func TestSQLUserStore_MigrateIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	store := access.NewSQLUserStore(db, access.DialectSQLite)
+	assert.NoError(t, store.Migrate(ctx))
+	assert.NoError(t, store.Create(ctx, &access.User{Username: "alice", Role: "user", PasswordHash: "h"}))
+	assert.NoError(t, store.Migrate(ctx))
+
+	var versions int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM access_schema_migrations`).Scan(&versions))
+	assert.Equal(t, 1, versions)
+
+	_, err = store.FindByUsername(ctx, "alice")
+	assert.NoError(t, err)
+}
+
+func TestLoginWithUserStore(t *testing.T) {
+	f := newAuthFixture(t, "")
+	store := newSQLiteStore(t)
+
+	hash, err := f.auth.PasswordHasher.HashPassword("secret")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Create(context.Background(), &access.User{Username: "carol", Role: "admin", PasswordHash: hash}))
+	f.auth.UserLookup = access.StoreLookup(store)
+
+	rr, token := f.login(t, "carol", "secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusOK, f.do(http.MethodGet, "/api/admin/users", token, nil).Code)
+
+	rr, _ = f.login(t, "nobody", "secret")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,258 @@
+package access_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SerMoskvin/access"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const webauthnConfig = "webauthn:\n  rp_id: example.com\n  rp_name: Example\n"
+
+// Церемонии записаны программным аутентификатором для rp_id example.com
+type webauthnCeremony struct {
+	Challenge  string                     `json:"challenge"`
+	Credential access.PublicKeyCredential `json:"credential"`
+}
+
+type webauthnFixtures struct {
+	AttestationRoot string                        `json:"attestation_root"`
+	Registrations   map[string]webauthnCeremony   `json:"registrations"`
+	Logins          map[string][]webauthnCeremony `json:"logins"`
+}
+
+func loadWebAuthnFixtures(t *testing.T) *webauthnFixtures {
+	t.Helper()
+	data, err := os.ReadFile("webauthn_fixtures.json")
+	assert.NoError(t, err)
+	var fx webauthnFixtures
+	assert.NoError(t, json.Unmarshal(data, &fx))
+	return &fx
+}
+
+// seedSession подставляет записанный challenge вместо случайного из Begin*
+func seedSession(t *testing.T, auth *access.Authenticator, id, ceremony string, c webauthnCeremony, allowed ...[]byte) string {
+	t.Helper()
+	challenge, err := base64.RawURLEncoding.DecodeString(c.Challenge)
+	assert.NoError(t, err)
+	auth.WebAuthn.Sessions.Set(id, access.WebAuthnSession{
+		Ceremony:   ceremony,
+		Challenge:  challenge,
+		UserID:     1,
+		Username:   "admin",
+		AllowedIDs: allowed,
+	})
+	return id
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	fx := loadWebAuthnFixtures(t)
+	f := newAuthFixture(t, webauthnConfig)
+	f.auth.WebAuthnCredentials = access.NewMemoryCredentialStore()
+	_, token := f.login(t, "admin", "secret")
+
+	rr := f.do(http.MethodPost, "/auth/webauthn/register/begin", token, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var begin struct {
+		Session   string                           `json:"session"`
+		PublicKey access.CredentialCreationOptions `json:"publicKey"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &begin))
+	assert.NotEmpty(t, begin.Session)
+	assert.Equal(t, "example.com", begin.PublicKey.RP.ID)
+	assert.Equal(t, "1", string(begin.PublicKey.User.ID))
+	assert.Len(t, begin.PublicKey.Challenge, 32)
+
+	finish := func(session string, c webauthnCeremony) (int, map[string]string) {
+		rr := f.do(http.MethodPost, "/auth/webauthn/register/finish", token, map[string]interface{}{"session": session, "credential": c.Credential})
+		var body map[string]string
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return rr.Code, body
+	}
+
+	t.Run("ChallengeMismatch", func(t *testing.T) {
+		wrong := fx.Registrations["none"]
+		wrong.Challenge = fx.Registrations["packed_self"].Challenge
+		code, _ := finish(seedSession(t, f.auth, "mismatch", "webauthn.create", wrong), fx.Registrations["none"])
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("UntrustedAttestation", func(t *testing.T) {
+		f.auth.WebAuthn.AttestationRoots = x509.NewCertPool()
+		code, _ := finish(seedSession(t, f.auth, "untrusted", "webauthn.create", fx.Registrations["packed_x5c"]), fx.Registrations["packed_x5c"])
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM([]byte(fx.AttestationRoot)))
+	f.auth.WebAuthn.AttestationRoots = roots
+
+	for _, v := range []struct{ name, attestation string }{{"none", "none"}, {"packed_self", "self"}, {"packed_x5c", "basic"}} {
+		c := fx.Registrations[v.name]
+		code, body := finish(seedSession(t, f.auth, "reg-"+v.name, "webauthn.create", c), c)
+		assert.Equal(t, http.StatusCreated, code, v.name)
+		assert.Equal(t, v.attestation, body["attestation_type"], v.name)
+
+		// Сессия одноразовая
+		code, _ = finish("reg-"+v.name, c)
+		assert.Equal(t, http.StatusUnauthorized, code, v.name)
+
+		if v.name == "none" {
+			// Второй ключ после входа только по паролю не добавляется
+			rr := f.do(http.MethodPost, "/auth/webauthn/register/begin", token, nil)
+			assert.Equal(t, http.StatusUnauthorized, rr.Code)
+			assert.Equal(t, access.ReasonStepUpRequired, problemCode(t, rr))
+
+			stale, _ := f.auth.JwtService.GenerateJWTWithClaims(1, "admin", "admin", jwt.MapClaims{"mfa": true, "auth_time": time.Now().Add(-time.Hour).Unix()})
+			assert.Equal(t, http.StatusUnauthorized, f.do(http.MethodPost, "/auth/webauthn/register/begin", stale, nil).Code)
+
+			token, _ = f.auth.JwtService.GenerateJWTWithClaims(1, "admin", "admin", jwt.MapClaims{"mfa": true, "auth_time": time.Now().Unix()})
+			assert.Equal(t, http.StatusOK, f.do(http.MethodPost, "/auth/webauthn/register/begin", token, nil).Code)
+		}
+	}
+
+	// Повторная регистрация того же ключа
+	code, _ := finish(seedSession(t, f.auth, "again", "webauthn.create", fx.Registrations["none"]), fx.Registrations["none"])
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	creds, _ := f.auth.WebAuthnCredentials.Credentials(context.Background(), 1)
+	assert.Len(t, creds, 3)
+
+	t.Run("DelegatedToken", func(t *testing.T) {
+		delegated, _ := f.auth.JwtService.GenerateJWTWithClaims(1, "admin", "admin", jwt.MapClaims{"client_id": "app", "mfa": true, "auth_time": time.Now().Unix()})
+		rr := f.do(http.MethodPost, "/auth/webauthn/register/begin", delegated, nil)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	fx := loadWebAuthnFixtures(t)
+	f := newAuthFixture(t, webauthnConfig)
+	store := access.NewMemoryCredentialStore()
+	f.auth.WebAuthnCredentials = store
+
+	var ids [][]byte
+	for _, name := range []string{"none", "packed_self"} {
+		c := fx.Registrations[name]
+		_, err := f.auth.WebAuthn.FinishRegistration(context.Background(), store, seedSession(t, f.auth, "reg-"+name, "webauthn.create", c), &c.Credential)
+		assert.NoError(t, err)
+		ids = append(ids, c.Credential.RawID)
+	}
+
+	rr := f.do(http.MethodPost, "/auth/webauthn/login/begin", "", map[string]string{"username": "admin"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var begin struct {
+		Session   string                          `json:"session"`
+		PublicKey access.CredentialRequestOptions `json:"publicKey"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &begin))
+	assert.Equal(t, "example.com", begin.PublicKey.RPID)
+	assert.Len(t, begin.PublicKey.AllowCredentials, 2)
+
+	rr = f.do(http.MethodPost, "/auth/webauthn/login/begin", "", map[string]string{"username": "banned"})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	login := func(name string, i int) *httptest.ResponseRecorder {
+		c := fx.Logins[name][i]
+		return f.do(http.MethodPost, "/auth/webauthn/login/finish", "", map[string]interface{}{
+			"session":    seedSession(t, f.auth, name, "webauthn.get", c, ids...),
+			"credential": c.Credential,
+		})
+	}
+
+	rr = login("none", 0)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	claims, err := f.auth.JwtService.ParseJWT(decodeToken(t, rr))
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", claims["role"])
+	assert.Equal(t, []interface{}{access.AMRHardwareKey}, claims["amr"])
+	assert.Equal(t, true, claims["mfa"])
+
+	cred, _ := store.CredentialByID(context.Background(), ids[0])
+	assert.Equal(t, uint32(1), cred.SignCount)
+
+	t.Run("SignCountRegression", func(t *testing.T) {
+		c := fx.Logins["none"][0]
+		_, err := f.auth.WebAuthn.FinishLogin(context.Background(), store, seedSession(t, f.auth, "replay", "webauthn.get", c, ids...), &c.Credential)
+		assert.ErrorIs(t, err, access.ErrSignCountRegression)
+		assert.Equal(t, http.StatusUnauthorized, login("none", 0).Code)
+	})
+
+	t.Run("SessionIsSingleUse", func(t *testing.T) {
+		// Из параллельных завершений одной церемонии сессию получает только одно
+		c := fx.Logins["none"][1]
+		session := seedSession(t, f.auth, "concurrent", "webauthn.get", c, ids...)
+		var wg sync.WaitGroup
+		var lost atomic.Int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := f.auth.WebAuthn.FinishLogin(context.Background(), store, session, &c.Credential); errors.Is(err, access.ErrWebAuthnSession) {
+					lost.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(9), lost.Load())
+	})
+
+	t.Run("WithoutUserVerification", func(t *testing.T) {
+		rr := login("none", 2)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		claims, _ := f.auth.JwtService.ParseJWT(decodeToken(t, rr))
+		assert.Nil(t, claims["mfa"])
+	})
+
+	t.Run("ZeroSignCount", func(t *testing.T) {
+		// Аутентификатор без счётчика всегда присылает 0
+		assert.Equal(t, http.StatusOK, login("packed_self", 0).Code)
+		assert.Equal(t, http.StatusOK, login("packed_self", 0).Code)
+	})
+
+	t.Run("TamperedSignature", func(t *testing.T) {
+		c := fx.Logins["none"][1]
+		c.Credential.Response.Signature = append(access.Base64URL(nil), c.Credential.Response.Signature...)
+		c.Credential.Response.Signature[len(c.Credential.Response.Signature)-1] ^= 0xff
+		_, err := f.auth.WebAuthn.FinishLogin(context.Background(), store, seedSession(t, f.auth, "tampered", "webauthn.get", c, ids...), &c.Credential)
+		assert.ErrorIs(t, err, access.ErrWebAuthnVerification)
+	})
+
+	t.Run("CredentialNotAllowed", func(t *testing.T) {
+		c := fx.Logins["none"][1]
+		_, err := f.auth.WebAuthn.FinishLogin(context.Background(), store, seedSession(t, f.auth, "not-allowed", "webauthn.get", c, ids[1]), &c.Credential)
+		assert.ErrorIs(t, err, access.ErrWebAuthnVerification)
+	})
+
+	t.Run("SignCountCompareAndSet", func(t *testing.T) {
+		ctx := context.Background()
+		cred, err := store.CredentialByID(ctx, ids[0])
+		assert.NoError(t, err)
+		var wg sync.WaitGroup
+		var updated atomic.Int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if store.UpdateSignCount(ctx, ids[0], cred.SignCount, cred.SignCount+1) == nil {
+					updated.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), updated.Load())
+		assert.ErrorIs(t, store.UpdateSignCount(ctx, ids[0], cred.SignCount, cred.SignCount+1), access.ErrSignCountRegression)
+	})
+}
@@ -0,0 +1,392 @@
+package access
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/skip2/go-qrcode"
+)
+
+// Методы аутентификации для claim amr (RFC 8176)
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRRecovery = "kba"
+)
+
+const (
+	defaultTOTPDigits        = 6
+	defaultTOTPPeriod        = 30 * time.Second
+	defaultTOTPSkew          = 1
+	defaultTOTPAlgorithm     = "SHA1"
+	defaultRecoveryCodeCount = 10
+	defaultTOTPMaxAttempts   = 5
+	defaultTOTPAttemptWindow = 15 * time.Minute
+	totpSecretSize           = 20
+)
+
+var (
+	ErrMFANotConfigured = errors.New("mfa is not configured for user")
+	ErrInvalidOTP       = errors.New("invalid one-time code")
+	ErrMFALocked        = errors.New("too many failed one-time codes")
+)
+
+// TOTPStore хранит секреты TOTP и хэши кодов восстановления пользователей
+type TOTPStore interface {
+	TOTPSecret(ctx context.Context, userID int) (string, error) // "" - MFA не настроена
+	RecoveryCodes(ctx context.Context, userID int) ([]string, error)
+	ConsumeRecoveryCode(ctx context.Context, userID int, hash string) error
+}
+
+// TOTP - одноразовые пароли по RFC 6238
+type TOTP struct {
+	issuer    string
+	digits    int
+	period    time.Duration
+	skew      int
+	algorithm string
+	hasher    *PasswordHasher
+
+	// Последний принятый шаг времени по каждому аккаунту, для защиты от повтора кода.
+	// mu делает проверку и запись шага одной операцией
+	mu   sync.Mutex
+	used *memoryCache[string, int64]
+
+	// Попытки по аккаунту: после maxAttempts за окно коды не проверяются, в том числе
+	// дорогие bcrypt-проверки кодов восстановления. Попытка учитывается до проверки
+	// и снимается только успехом, поэтому параллельные догадки не превышают лимит
+	maxAttempts int
+	failures    *memoryCache[string, int]
+	// Принятые коды восстановления, пока хранилище их не удалило
+	recovered *memoryCache[string, bool]
+}
+
+func NewTOTP(cfg *Config, hasher *PasswordHasher) *TOTP {
+	c := cfg.MFA.TOTP
+	t := &TOTP{
+		issuer:    c.Issuer,
+		digits:    orDefault(c.Digits, defaultTOTPDigits),
+		period:    c.Period,
+		skew:      defaultTOTPSkew,
+		algorithm: strings.ToUpper(c.Algorithm),
+		hasher:    hasher,
+	}
+	if t.period <= 0 {
+		t.period = defaultTOTPPeriod
+	}
+	if c.Skew != nil {
+		t.skew = *c.Skew
+	}
+	if t.algorithm == "" {
+		t.algorithm = defaultTOTPAlgorithm
+	}
+	t.used = NewLRUCache[string, int64](t.period*time.Duration(2*t.skew+2), defaultPasswordCacheEntries)
+
+	t.maxAttempts = orDefault(c.MaxAttempts, defaultTOTPMaxAttempts)
+	window := c.AttemptWindow
+	if window <= 0 {
+		window = defaultTOTPAttemptWindow
+	}
+	t.failures = NewLRUCache[string, int](window, defaultPasswordCacheEntries)
+	t.recovered = NewLRUCache[string, bool](window, defaultPasswordCacheEntries)
+	return t
+}
+
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// ProvisioningURI - otpauth:// ссылка для приложений-аутентификаторов
+func (t *TOTP) ProvisioningURI(secret, account string) string {
+	label := url.PathEscape(account)
+	if t.issuer != "" {
+		label = url.PathEscape(t.issuer) + ":" + label
+	}
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	if t.issuer != "" {
+		q.Set("issuer", t.issuer)
+	}
+	q.Set("algorithm", t.algorithm)
+	q.Set("digits", fmt.Sprint(t.digits))
+	q.Set("period", fmt.Sprint(int(t.period/time.Second)))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// QRCodePNG рисует ссылку ProvisioningURI в виде QR-кода размером size×size
+func (t *TOTP) QRCodePNG(secret, account string, size int) ([]byte, error) {
+	return qrcode.Encode(t.ProvisioningURI(secret, account), qrcode.Medium, size)
+}
+
+// Code вычисляет код для момента at
+func (t *TOTP) Code(secret string, at time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return t.hotp(key, at.Unix()/int64(t.period/time.Second)), nil
+}
+
+// Validate проверяет код с допуском ±skew шагов. Каждый шаг принимается для
+// аккаунта только один раз, а коды старше уже принятого отклоняются.
+func (t *TOTP) Validate(account, secret, code string, at time.Time) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != t.digits {
+		return false
+	}
+
+	current := at.Unix() / int64(t.period/time.Second)
+	for offset := -t.skew; offset <= t.skew; offset++ {
+		step := current + int64(offset)
+		if !hmac.Equal([]byte(t.hotp(key, step)), []byte(code)) {
+			continue
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if last, ok := t.used.Get(account); ok && step <= last {
+			return false
+		}
+		t.used.Set(account, step)
+		return true
+	}
+	return false
+}
+
+// Locked - для аккаунта исчерпаны попытки ввода кодов
+func (t *TOTP) Locked(account string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count, _ := t.failures.Get(account)
+	return count >= t.maxAttempts
+}
+
+// reserveAttempt учитывает попытку, если лимит ещё не исчерпан. false - аккаунт заблокирован
+func (t *TOTP) reserveAttempt(account string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count, _ := t.failures.Get(account)
+	if count >= t.maxAttempts {
+		return false
+	}
+	t.failures.Set(account, count+1)
+	return true
+}
+
+func (t *TOTP) resetFailures(account string) {
+	t.failures.Delete(account)
+}
+
+// claimRecovery атомарно помечает код восстановления использованным:
+// из одновременных запросов с одним кодом проходит только один
+func (t *TOTP) claimRecovery(account, hash string) bool {
+	added, _ := t.recovered.Add(account+":"+hash, true, t.recovered.ttl)
+	return added
+}
+
+func (t *TOTP) hotp(key []byte, counter int64) string {
+	var newHash func() hash.Hash
+	switch t.algorithm {
+	case "SHA256":
+		newHash = sha256.New
+	case "SHA512":
+		newHash = sha512.New
+	default:
+		newHash = sha1.New
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(newHash, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Динамическое усечение, RFC 4226 раздел 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < t.digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", t.digits, value%mod)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// GenerateRecoveryCodes возвращает коды для показа пользователю и их bcrypt-хэши для хранения
+func (t *TOTP) GenerateRecoveryCodes(n int) (codes, hashes []string, err error) {
+	if n <= 0 {
+		n = defaultRecoveryCodeCount
+	}
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+
+		hash, err := t.hasher.HashPassword(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// MatchRecoveryCode ищет хэш, соответствующий коду; пустая строка - совпадений нет
+func (t *TOTP) MatchRecoveryCode(code string, hashes []string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for _, hash := range hashes {
+		if t.hasher.CheckPasswordHash(code, hash) {
+			return hash
+		}
+	}
+	return ""
+}
+
+type totpRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// TOTPHandler - второй фактор: принимает токен после входа по паролю и код TOTP
+// (или код восстановления) и выдаёт новый токен с amr/mfa.
+func (a *Authenticator) TOTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := a.extractToken(r)
+		if tokenString == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required"})
+			return
+		}
+		claims, err := a.JwtService.ParseJWT(tokenString)
+		if err != nil {
+			a.reject(w, r, "", tokenError(err))
+			return
+		}
+
+		var req totpRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Expected JSON with code or recovery_code", Err: err})
+			return
+		}
+
+		userID, _ := claims["user_id"].(float64)
+		username, _ := claims["username"].(string)
+		role, _ := claims["role"].(string)
+		event := AuthEvent{Action: "mfa", Username: username, UserID: int(userID)}
+		// Как и в RefreshHandler, токен клиента OAuth не меняется на сессию пользователя
+		if _, delegated := claims["client_id"]; delegated {
+			a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Delegated tokens cannot complete sign-in"})
+			return
+		}
+		if a.locked(username, true) {
+			a.audit(r, event, ReasonAccountLocked)
+			a.reject(w, r, role, &AuthError{Code: ReasonAccountLocked, Status: http.StatusTooManyRequests, Detail: "Too many failed attempts, try again later"})
+			return
+		}
+
+		method, err := a.verifySecondFactor(r.Context(), int(userID), req)
+		if err != nil {
+			authErr := &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: "Invalid one-time code", Err: err}
+			if errors.Is(err, ErrMFANotConfigured) {
+				authErr = &AuthError{Code: ReasonMFANotConfigured, Status: http.StatusForbidden, Detail: "Two-factor authentication is not configured", Err: err}
+			} else if errors.Is(err, ErrMFALocked) {
+				authErr = &AuthError{Code: ReasonAccountLocked, Status: http.StatusTooManyRequests, Detail: "Too many failed attempts, try again later", Err: err}
+			} else if !errors.Is(err, ErrInvalidOTP) {
+				authErr = &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Second factor check failed", Err: err}
+			}
+			a.audit(r, event, authErr.Code)
+			a.reject(w, r, role, authErr)
+			return
+		}
+
+		// Токен после пароля больше не нужен
+		a.JwtService.RevokeJWT(tokenString)
+		a.issueToken(w, r, event, int(userID), username, role, jwt.MapClaims{
+			"amr":       appendAMR(claims["amr"], method),
+			"mfa":       true,
+			"auth_time": time.Now().Unix(),
+		})
+	})
+}
+
+func (a *Authenticator) verifySecondFactor(ctx context.Context, userID int, req totpRequest) (string, error) {
+	if a.TOTPStore == nil {
+		return "", ErrMFANotConfigured
+	}
+	secret, err := a.TOTPStore.TOTPSecret(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", ErrMFANotConfigured
+	}
+
+	account := fmt.Sprint(userID)
+	if !a.TOTP.reserveAttempt(account) {
+		return "", ErrMFALocked
+	}
+
+	if req.Code != "" {
+		if !a.TOTP.Validate(account, secret, req.Code, time.Now()) {
+			return "", ErrInvalidOTP
+		}
+		a.TOTP.resetFailures(account)
+		return AMROTP, nil
+	}
+
+	hashes, err := a.TOTPStore.RecoveryCodes(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	hash := a.TOTP.MatchRecoveryCode(req.RecoveryCode, hashes)
+	if hash == "" || !a.TOTP.claimRecovery(account, hash) {
+		return "", ErrInvalidOTP
+	}
+	// Код восстановления одноразовый
+	if err := a.TOTPStore.ConsumeRecoveryCode(ctx, userID, hash); err != nil {
+		return "", err
+	}
+	a.TOTP.resetFailures(account)
+	return AMRRecovery, nil
+}
+
+// appendAMR добавляет метод к amr из старого токена, без повторов
+func appendAMR(existing interface{}, method string) []string {
+	var amr []string
+	if list, ok := existing.([]interface{}); ok {
+		for _, v := range list {
+			if s, ok := v.(string); ok && s != method {
+				amr = append(amr, s)
+			}
+		}
+	}
+	return append(amr, method)
+}
@@ -0,0 +1,113 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// UserStore - хранилище учётных записей, из которого берутся данные для GenerateJWT
+type UserStore interface {
+	FindByUsername(ctx context.Context, username string) (*User, error)
+	FindByID(ctx context.Context, id int) (*User, error)
+	Create(ctx context.Context, user *User) error // Заполняет user.ID
+	UpdatePasswordHash(ctx context.Context, id int, hash string) error
+	SetRole(ctx context.Context, id int, role string) error
+	Disable(ctx context.Context, id int) error
+}
+
+// StoreLookup превращает UserStore в UserLookup для обработчиков входа
+func StoreLookup(store UserStore) UserLookup {
+	return func(ctx context.Context, username string) (*User, error) {
+		user, err := store.FindByUsername(ctx, username)
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, nil
+		}
+		return user, err
+	}
+}
+
+// MemoryUserStore - UserStore в памяти процесса, для тестов и небольших сервисов
+type MemoryUserStore struct {
+	mu         sync.RWMutex
+	nextID     int
+	byID       map[int]*User
+	byUsername map[string]*User
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		nextID:     1,
+		byID:       make(map[int]*User),
+		byUsername: make(map[string]*User),
+	}
+}
+
+func (s *MemoryUserStore) FindByUsername(ctx context.Context, username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.byUsername[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *MemoryUserStore) FindByID(ctx context.Context, id int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.byID[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *MemoryUserStore) Create(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.byUsername[user.Username]; exists {
+		return ErrUserExists
+	}
+
+	user.ID = s.nextID
+	s.nextID++
+	stored := *user
+	s.byID[stored.ID] = &stored
+	s.byUsername[stored.Username] = &stored
+	return nil
+}
+
+func (s *MemoryUserStore) UpdatePasswordHash(ctx context.Context, id int, hash string) error {
+	return s.update(id, func(u *User) { u.PasswordHash = hash })
+}
+
+func (s *MemoryUserStore) SetRole(ctx context.Context, id int, role string) error {
+	return s.update(id, func(u *User) { u.Role = role })
+}
+
+func (s *MemoryUserStore) Disable(ctx context.Context, id int) error {
+	return s.update(id, func(u *User) { u.Disabled = true })
+}
+
+func (s *MemoryUserStore) update(id int, fn func(u *User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.byID[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	fn(user)
+	return nil
+}
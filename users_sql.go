@@ -0,0 +1,205 @@
+package access
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLDialect описывает различия СУБД, которые затрагивают SQLUserStore
+type SQLDialect struct {
+	Name          string
+	AutoIncrement string // Описание столбца-ключа с автоинкрементом
+	Returning     bool   // Новый ID возвращается через RETURNING, а не LastInsertId
+	Numbered      bool   // Плейсхолдеры $1, $2 вместо ?
+}
+
+var (
+	DialectSQLite = SQLDialect{
+		Name:          "sqlite",
+		AutoIncrement: "INTEGER PRIMARY KEY AUTOINCREMENT",
+	}
+	DialectPostgres = SQLDialect{
+		Name:          "postgres",
+		AutoIncrement: "SERIAL PRIMARY KEY",
+		Returning:     true,
+		Numbered:      true,
+	}
+	DialectMySQL = SQLDialect{
+		Name:          "mysql",
+		AutoIncrement: "INTEGER PRIMARY KEY AUTO_INCREMENT",
+	}
+)
+
+// Миграции применяются по порядку, номер версии - индекс + 1. Уже выпущенные не меняются.
+var userStoreMigrations = []func(d SQLDialect) []string{
+	func(d SQLDialect) []string {
+		return []string{
+			`CREATE TABLE access_users (
+				id ` + d.AutoIncrement + `,
+				username VARCHAR(255) NOT NULL UNIQUE,
+				password_hash VARCHAR(255) NOT NULL,
+				role VARCHAR(255) NOT NULL,
+				disabled BOOLEAN NOT NULL DEFAULT FALSE,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			)`,
+		}
+	},
+}
+
+// SQLUserStore - UserStore поверх database/sql, схема создаётся через Migrate
+type SQLUserStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+func NewSQLUserStore(db *sql.DB, dialect SQLDialect) *SQLUserStore {
+	return &SQLUserStore{db: db, dialect: dialect}
+}
+
+// Migrate применяет недостающие миграции схемы, каждую в своей транзакции
+func (s *SQLUserStore) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS access_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM access_schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := current; i < len(userStoreMigrations); i++ {
+		version := i + 1
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range userStoreMigrations[i](s.dialect) {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO access_schema_migrations (version, applied_at) VALUES (?, ?)`), version, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+const userColumns = `id, username, password_hash, role, disabled`
+
+func (s *SQLUserStore) FindByUsername(ctx context.Context, username string) (*User, error) {
+	return s.scanUser(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+userColumns+` FROM access_users WHERE username = ?`), username))
+}
+
+func (s *SQLUserStore) FindByID(ctx context.Context, id int) (*User, error) {
+	return s.scanUser(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+userColumns+` FROM access_users WHERE id = ?`), id))
+}
+
+func (s *SQLUserStore) Create(ctx context.Context, user *User) error {
+	if _, err := s.FindByUsername(ctx, user.Username); err == nil {
+		return ErrUserExists
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+
+	now := time.Now().UTC()
+	query := s.rebind(`INSERT INTO access_users (username, password_hash, role, disabled, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`)
+	args := []interface{}{user.Username, user.PasswordHash, user.Role, user.Disabled, now, now}
+
+	if s.dialect.Returning {
+		if err := s.db.QueryRowContext(ctx, query+` RETURNING id`, args...).Scan(&user.ID); err != nil {
+			return uniqueViolation(err)
+		}
+		return nil
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = int(id)
+	return nil
+}
+
+func (s *SQLUserStore) UpdatePasswordHash(ctx context.Context, id int, hash string) error {
+	return s.update(ctx, `password_hash = ?`, hash, id)
+}
+
+func (s *SQLUserStore) SetRole(ctx context.Context, id int, role string) error {
+	return s.update(ctx, `role = ?`, role, id)
+}
+
+func (s *SQLUserStore) Disable(ctx context.Context, id int) error {
+	return s.update(ctx, `disabled = ?`, true, id)
+}
+
+func (s *SQLUserStore) update(ctx context.Context, set string, value interface{}, id int) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE access_users SET `+set+`, updated_at = ? WHERE id = ?`), value, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *SQLUserStore) scanUser(row *sql.Row) (*User, error) {
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// rebind заменяет ? на $1, $2... для СУБД с нумерованными плейсхолдерами
+func (s *SQLUserStore) rebind(query string) string {
+	if !s.dialect.Numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// uniqueViolation распознаёт нарушение уникальности имени при одновременном создании
+func uniqueViolation(err error) error {
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "unique") || strings.Contains(msg, "duplicate") {
+		return ErrUserExists
+	}
+	return err
+}
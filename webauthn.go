@@ -0,0 +1,781 @@
+package access
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// AMRHardwareKey - вход по ключу WebAuthn (RFC 8176)
+const AMRHardwareKey = "hwk"
+
+const (
+	defaultWebAuthnTimeout  = 5 * time.Minute
+	defaultWebAuthnSessions = 10000
+	webauthnChallengeSize   = 32
+	// Насколько свежим должен быть вход с MFA, чтобы добавить ещё один ключ
+	webauthnRegisterMaxAge = 10 * time.Minute
+)
+
+// Флаги authenticatorData
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+var (
+	ErrWebAuthnVerification = errors.New("webauthn verification failed")
+	ErrWebAuthnSession      = errors.New("webauthn session expired or unknown")
+	ErrSignCountRegression  = errors.New("authenticator sign count did not increase, possible cloned authenticator")
+	ErrCredentialNotFound   = errors.New("webauthn credential not found")
+)
+
+// Base64URL - байты, которые в JSON передаются как base64url без выравнивания
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// WebAuthnCredential - зарегистрированный ключ пользователя
+type WebAuthnCredential struct {
+	ID              []byte
+	UserID          int
+	PublicKey       []byte // COSE_Key
+	SignCount       uint32
+	AAGUID          []byte
+	AttestationType string
+	CreatedAt       time.Time
+}
+
+// WebAuthnCredentialStore хранит ключи WebAuthn
+type WebAuthnCredentialStore interface {
+	Credentials(ctx context.Context, userID int) ([]WebAuthnCredential, error)
+	CredentialByID(ctx context.Context, id []byte) (*WebAuthnCredential, error) // ErrCredentialNotFound, если нет
+	SaveCredential(ctx context.Context, cred *WebAuthnCredential) error
+	// UpdateSignCount атомарно заменяет счётчик old на signCount (compare-and-set,
+	// в SQL - UPDATE ... WHERE sign_count = old). Если счётчик уже не old -
+	// ErrSignCountRegression: тот же ответ аутентификатора приняли параллельно
+	UpdateSignCount(ctx context.Context, id []byte, old, signCount uint32) error
+}
+
+// WebAuthnSession - незавершённая церемония: challenge и для кого он выдан
+type WebAuthnSession struct {
+	Ceremony   string // webauthn.create или webauthn.get
+	Challenge  []byte
+	UserID     int
+	Username   string
+	AllowedIDs [][]byte
+}
+
+type CredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialCreationOptions - JSON-форма PublicKeyCredentialCreationOptions
+type CredentialCreationOptions struct {
+	Challenge Base64URL `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          Base64URL `json:"id"`
+		Name        string    `json:"name"`
+		DisplayName string    `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// CredentialRequestOptions - JSON-форма PublicKeyCredentialRequestOptions
+type CredentialRequestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// PublicKeyCredential - ответ браузера (PublicKeyCredential.toJSON())
+type PublicKeyCredential struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AttestationObject Base64URL `json:"attestationObject,omitempty"`
+		AuthenticatorData Base64URL `json:"authenticatorData,omitempty"`
+		Signature         Base64URL `json:"signature,omitempty"`
+		UserHandle        Base64URL `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// WebAuthnLogin - результат успешной проверки assertion
+type WebAuthnLogin struct {
+	Credential   *WebAuthnCredential
+	UserID       int
+	Username     string
+	UserVerified bool
+}
+
+// WebAuthn - проверяющая сторона (relying party) WebAuthn Level 2
+type WebAuthn struct {
+	RPID             string
+	RPName           string
+	Origins          []string
+	Timeout          time.Duration
+	UserVerification string // required, preferred или discouraged
+	Attestation      string // none или direct
+
+	// Корни доверия для аттестации packed с x5c; nil - цепочка не проверяется
+	AttestationRoots *x509.CertPool
+
+	// Незавершённые церемонии по идентификатору сессии
+	Sessions Cache[string, WebAuthnSession]
+}
+
+func NewWebAuthn(cfg *Config) *WebAuthn {
+	c := cfg.WebAuthn
+	wa := &WebAuthn{
+		RPID:             c.RPID,
+		RPName:           c.RPName,
+		Origins:          c.Origins,
+		Timeout:          c.Timeout,
+		UserVerification: c.UserVerification,
+		Attestation:      c.Attestation,
+	}
+	if wa.Timeout <= 0 {
+		wa.Timeout = defaultWebAuthnTimeout
+	}
+	if wa.UserVerification == "" {
+		wa.UserVerification = "preferred"
+	}
+	if wa.Attestation == "" {
+		wa.Attestation = AttestationNone
+	}
+	if wa.RPName == "" {
+		wa.RPName = wa.RPID
+	}
+	if len(wa.Origins) == 0 && wa.RPID != "" {
+		wa.Origins = []string{"https://" + wa.RPID}
+	}
+	wa.Sessions = NewLRUCache[string, WebAuthnSession](wa.Timeout, defaultWebAuthnSessions)
+	return wa
+}
+
+// BeginRegistration создаёт challenge для регистрации нового ключа пользователя
+func (wa *WebAuthn) BeginRegistration(user *User, existing []WebAuthnCredential) (*CredentialCreationOptions, string, error) {
+	if wa.RPID == "" {
+		return nil, "", errors.New("webauthn: rp_id is not configured")
+	}
+	challenge, sessionID, err := wa.newSession(WebAuthnSession{Ceremony: "webauthn.create", UserID: user.ID, Username: user.Username})
+	if err != nil {
+		return nil, "", err
+	}
+
+	opts := &CredentialCreationOptions{
+		Challenge: challenge,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: COSEAlgES256},
+			{Type: "public-key", Alg: COSEAlgEdDSA},
+			{Type: "public-key", Alg: COSEAlgES384},
+			{Type: "public-key", Alg: COSEAlgRS256},
+		},
+		Timeout:     wa.Timeout.Milliseconds(),
+		Attestation: wa.Attestation,
+	}
+	opts.RP.ID = wa.RPID
+	opts.RP.Name = wa.RPName
+	opts.User.ID = Base64URL(strconv.Itoa(user.ID))
+	opts.User.Name = user.Username
+	opts.User.DisplayName = user.Username
+	opts.AuthenticatorSelection.ResidentKey = "preferred"
+	opts.AuthenticatorSelection.UserVerification = wa.UserVerification
+	for _, cred := range existing {
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, CredentialDescriptor{Type: "public-key", ID: cred.ID})
+	}
+	return opts, sessionID, nil
+}
+
+// FinishRegistration проверяет ответ регистрации (WebAuthn §7.1) и сохраняет ключ в store
+func (wa *WebAuthn) FinishRegistration(ctx context.Context, store WebAuthnCredentialStore, sessionID string, resp *PublicKeyCredential) (*WebAuthnCredential, error) {
+	session, err := wa.takeSession(sessionID, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	cred, err := wa.verifyRegistration(session, resp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWebAuthnVerification, err)
+	}
+
+	// Один ключ нельзя привязать повторно, в том числе к другому пользователю
+	if _, err := store.CredentialByID(ctx, cred.ID); err == nil {
+		return nil, fmt.Errorf("%w: credential is already registered", ErrWebAuthnVerification)
+	} else if !errors.Is(err, ErrCredentialNotFound) {
+		return nil, err
+	}
+	if err := store.SaveCredential(ctx, cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (wa *WebAuthn) verifyRegistration(session *WebAuthnSession, resp *PublicKeyCredential) (*WebAuthnCredential, error) {
+	clientDataHash, err := wa.verifyClientData(resp.Response.ClientDataJSON, session)
+	if err != nil {
+		return nil, err
+	}
+
+	v, _, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attObj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+	format, _ := attObj["fmt"].(string)
+	rawAuthData, _ := attObj["authData"].([]byte)
+	stmt, _ := attObj["attStmt"].(map[interface{}]interface{})
+
+	authData, err := wa.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedCredData == 0 {
+		return nil, errors.New("attested credential data missing")
+	}
+	if !bytes.Equal(authData.credentialID, resp.RawID) {
+		return nil, errors.New("credential id mismatch")
+	}
+
+	key, err := parseCOSEKey(authData.credentialKey)
+	if err != nil {
+		return nil, err
+	}
+	attestationType, err := wa.verifyAttestation(format, stmt, authData, rawAuthData, clientDataHash, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		ID:              authData.credentialID,
+		UserID:          session.UserID,
+		PublicKey:       authData.credentialKey,
+		SignCount:       authData.signCount,
+		AAGUID:          authData.aaguid,
+		AttestationType: attestationType,
+		CreatedAt:       time.Now(),
+	}, nil
+}
+
+// BeginLogin создаёт challenge для входа пользователя по одному из его ключей
+func (wa *WebAuthn) BeginLogin(user *User, creds []WebAuthnCredential) (*CredentialRequestOptions, string, error) {
+	if wa.RPID == "" {
+		return nil, "", errors.New("webauthn: rp_id is not configured")
+	}
+	session := WebAuthnSession{Ceremony: "webauthn.get", UserID: user.ID, Username: user.Username}
+	opts := &CredentialRequestOptions{
+		Timeout:          wa.Timeout.Milliseconds(),
+		RPID:             wa.RPID,
+		UserVerification: wa.UserVerification,
+	}
+	for _, cred := range creds {
+		session.AllowedIDs = append(session.AllowedIDs, cred.ID)
+		opts.AllowCredentials = append(opts.AllowCredentials, CredentialDescriptor{Type: "public-key", ID: cred.ID})
+	}
+
+	challenge, sessionID, err := wa.newSession(session)
+	if err != nil {
+		return nil, "", err
+	}
+	opts.Challenge = challenge
+	return opts, sessionID, nil
+}
+
+// FinishLogin проверяет assertion (WebAuthn §7.2) и обновляет счётчик подписей в store
+func (wa *WebAuthn) FinishLogin(ctx context.Context, store WebAuthnCredentialStore, sessionID string, resp *PublicKeyCredential) (*WebAuthnLogin, error) {
+	session, err := wa.takeSession(sessionID, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := false
+	for _, id := range session.AllowedIDs {
+		allowed = allowed || bytes.Equal(id, resp.RawID)
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: credential is not allowed for this session", ErrWebAuthnVerification)
+	}
+	cred, err := store.CredentialByID(ctx, resp.RawID)
+	if errors.Is(err, ErrCredentialNotFound) {
+		return nil, fmt.Errorf("%w: %w", ErrWebAuthnVerification, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cred.UserID != session.UserID {
+		return nil, fmt.Errorf("%w: credential belongs to another user", ErrWebAuthnVerification)
+	}
+
+	authData, err := wa.verifyAssertion(session, cred, resp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWebAuthnVerification, err)
+	}
+
+	// Счётчик 0 у обеих сторон означает, что аутентификатор его не ведёт
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return nil, fmt.Errorf("%w: %w", ErrWebAuthnVerification, ErrSignCountRegression)
+	}
+	if err := store.UpdateSignCount(ctx, cred.ID, cred.SignCount, authData.signCount); err != nil {
+		if errors.Is(err, ErrSignCountRegression) {
+			return nil, fmt.Errorf("%w: %w", ErrWebAuthnVerification, err)
+		}
+		return nil, err
+	}
+	cred.SignCount = authData.signCount
+
+	return &WebAuthnLogin{
+		Credential:   cred,
+		UserID:       session.UserID,
+		Username:     session.Username,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+func (wa *WebAuthn) verifyAssertion(session *WebAuthnSession, cred *WebAuthnCredential, resp *PublicKeyCredential) (*authenticatorData, error) {
+	clientDataHash, err := wa.verifyClientData(resp.Response.ClientDataJSON, session)
+	if err != nil {
+		return nil, err
+	}
+	rawAuthData := resp.Response.AuthenticatorData
+	authData, err := wa.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Response.UserHandle) > 0 && string(resp.Response.UserHandle) != strconv.Itoa(session.UserID) {
+		return nil, errors.New("user handle mismatch")
+	}
+
+	key, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash...)
+	if err := verifySignature(key.pub, key.alg, signed, resp.Response.Signature); err != nil {
+		return nil, err
+	}
+	return authData, nil
+}
+
+// verifyClientData проверяет type, challenge и origin и возвращает SHA-256 от clientDataJSON
+func (wa *WebAuthn) verifyClientData(raw []byte, session *WebAuthnSession) ([]byte, error) {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return nil, fmt.Errorf("malformed client data: %w", err)
+	}
+	if clientData.Type != session.Ceremony {
+		return nil, fmt.Errorf("unexpected client data type %q", clientData.Type)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(clientData.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(challenge, session.Challenge) != 1 {
+		return nil, errors.New("challenge mismatch")
+	}
+
+	originOK := false
+	for _, origin := range wa.Origins {
+		originOK = originOK || origin == clientData.Origin
+	}
+	if !originOK {
+		return nil, fmt.Errorf("origin %q is not allowed", clientData.Origin)
+	}
+
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+type authenticatorData struct {
+	rpIDHash      []byte
+	flags         byte
+	signCount     uint32
+	aaguid        []byte
+	credentialID  []byte
+	credentialKey []byte
+}
+
+// verifyAuthData разбирает authenticatorData и проверяет rpIdHash и флаги UP/UV
+func (wa *WebAuthn) verifyAuthData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	d := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if d.flags&flagAttestedCredData != 0 {
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		d.aaguid = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("credential id truncated")
+		}
+		d.credentialID = rest[:idLen]
+		_, n, err := decodeCBOR(rest[idLen:])
+		if err != nil {
+			return nil, fmt.Errorf("credential public key: %w", err)
+		}
+		d.credentialKey = rest[idLen : idLen+n]
+	}
+
+	rpIDHash := sha256.Sum256([]byte(wa.RPID))
+	if !bytes.Equal(d.rpIDHash, rpIDHash[:]) {
+		return nil, errors.New("rp id hash mismatch")
+	}
+	if d.flags&flagUserPresent == 0 {
+		return nil, errors.New("user presence flag not set")
+	}
+	if wa.UserVerification == "required" && d.flags&flagUserVerified == 0 {
+		return nil, errors.New("user verification required")
+	}
+	return d, nil
+}
+
+func (wa *WebAuthn) newSession(session WebAuthnSession) (Base64URL, string, error) {
+	challenge := make([]byte, webauthnChallengeSize)
+	id := make([]byte, webauthnChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	session.Challenge = challenge
+	sessionID := base64.RawURLEncoding.EncodeToString(id)
+	wa.Sessions.Set(sessionID, session)
+	return challenge, sessionID, nil
+}
+
+// takeSession достаёт сессию однократно: challenge нельзя использовать повторно
+func (wa *WebAuthn) takeSession(sessionID, ceremony string) (*WebAuthnSession, error) {
+	session, ok := Take(wa.Sessions, sessionID)
+	if !ok || session.Ceremony != ceremony {
+		return nil, ErrWebAuthnSession
+	}
+	return &session, nil
+}
+
+// MemoryCredentialStore - WebAuthnCredentialStore в памяти процесса
+type MemoryCredentialStore struct {
+	mu    sync.RWMutex
+	creds map[string]*WebAuthnCredential
+}
+
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{creds: make(map[string]*WebAuthnCredential)}
+}
+
+func (s *MemoryCredentialStore) Credentials(ctx context.Context, userID int) ([]WebAuthnCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var creds []WebAuthnCredential
+	for _, cred := range s.creds {
+		if cred.UserID == userID {
+			creds = append(creds, *cred)
+		}
+	}
+	return creds, nil
+}
+
+func (s *MemoryCredentialStore) CredentialByID(ctx context.Context, id []byte) (*WebAuthnCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cred, ok := s.creds[string(id)]
+	if !ok {
+		return nil, ErrCredentialNotFound
+	}
+	copied := *cred
+	return &copied, nil
+}
+
+func (s *MemoryCredentialStore) SaveCredential(ctx context.Context, cred *WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *cred
+	s.creds[string(cred.ID)] = &copied
+	return nil
+}
+
+func (s *MemoryCredentialStore) UpdateSignCount(ctx context.Context, id []byte, old, signCount uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cred, ok := s.creds[string(id)]
+	if !ok {
+		return ErrCredentialNotFound
+	}
+	if cred.SignCount != old {
+		return ErrSignCountRegression
+	}
+	cred.SignCount = signCount
+	return nil
+}
+
+type webauthnBeginRequest struct {
+	Username string `json:"username"`
+}
+
+type webauthnFinishRequest struct {
+	Session    string              `json:"session"`
+	Credential PublicKeyCredential `json:"credential"`
+}
+
+// WebAuthnOptions - ответ begin-обработчиков: параметры для navigator.credentials и сессия
+type WebAuthnOptions struct {
+	Session   string      `json:"session"`
+	PublicKey interface{} `json:"publicKey"`
+}
+
+// WebAuthnRegisterBeginHandler выдаёт параметры регистрации ключа для владельца токена
+func (a *Authenticator) WebAuthnRegisterBeginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, existing, ok := a.webauthnClaims(w, r)
+		if !ok {
+			return
+		}
+		userID, _ := claims["user_id"].(float64)
+		username, _ := claims["username"].(string)
+		role, _ := claims["role"].(string)
+
+		opts, sessionID, err := a.WebAuthn.BeginRegistration(&User{ID: int(userID), Username: username}, existing)
+		if err != nil {
+			a.reject(w, r, role, &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "WebAuthn is not available", Err: err})
+			return
+		}
+		writeJSON(w, http.StatusOK, WebAuthnOptions{Session: sessionID, PublicKey: opts})
+	})
+}
+
+// WebAuthnRegisterFinishHandler проверяет ответ аутентификатора и сохраняет ключ
+func (a *Authenticator) WebAuthnRegisterFinishHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _, ok := a.webauthnClaims(w, r)
+		if !ok {
+			return
+		}
+		userID, _ := claims["user_id"].(float64)
+		role, _ := claims["role"].(string)
+
+		var req webauthnFinishRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Session == "" {
+			a.reject(w, r, role, &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Expected JSON with session and credential", Err: err})
+			return
+		}
+
+		// Сессия должна принадлежать владельцу токена
+		if session, ok := a.WebAuthn.Sessions.Get(req.Session); ok && session.UserID != int(userID) {
+			a.reject(w, r, role, &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: "WebAuthn registration failed", Err: ErrWebAuthnSession})
+			return
+		}
+
+		cred, err := a.WebAuthn.FinishRegistration(r.Context(), a.WebAuthnCredentials, req.Session, &req.Credential)
+		if err != nil {
+			a.reject(w, r, role, webauthnError(err, "WebAuthn registration failed"))
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"id":               Base64URL(cred.ID),
+			"attestation_type": cred.AttestationType,
+		})
+	})
+}
+
+// WebAuthnLoginBeginHandler принимает JSON {"username"} и выдаёт параметры входа по ключу
+func (a *Authenticator) WebAuthnLoginBeginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webauthnBeginRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Username == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Expected JSON with username", Err: err})
+			return
+		}
+		if a.UserLookup == nil || a.WebAuthnCredentials == nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "WebAuthn is not available", Err: errors.New("user lookup or credential store is not configured")})
+			return
+		}
+
+		event := AuthEvent{Action: "webauthn", Username: req.Username}
+		user, err := a.UserLookup(r.Context(), req.Username)
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "User lookup failed", Err: err})
+			return
+		}
+		var creds []WebAuthnCredential
+		if user != nil && !user.Disabled {
+			if creds, err = a.WebAuthnCredentials.Credentials(r.Context(), user.ID); err != nil {
+				a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Credential lookup failed", Err: err})
+				return
+			}
+		}
+		if len(creds) == 0 {
+			a.audit(r, event, ReasonBadCredentials)
+			a.reject(w, r, "", &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: "No security keys registered for this user"})
+			return
+		}
+
+		opts, sessionID, err := a.WebAuthn.BeginLogin(user, creds)
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "WebAuthn is not available", Err: err})
+			return
+		}
+		writeJSON(w, http.StatusOK, WebAuthnOptions{Session: sessionID, PublicKey: opts})
+	})
+}
+
+// WebAuthnLoginFinishHandler проверяет assertion и выдаёт токен
+func (a *Authenticator) WebAuthnLoginFinishHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webauthnFinishRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Session == "" {
+			a.reject(w, r, "", &AuthError{Code: ReasonBadRequest, Status: http.StatusBadRequest, Detail: "Expected JSON with session and credential", Err: err})
+			return
+		}
+		if a.UserLookup == nil || a.WebAuthnCredentials == nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "WebAuthn is not available", Err: errors.New("user lookup or credential store is not configured")})
+			return
+		}
+
+		login, err := a.WebAuthn.FinishLogin(r.Context(), a.WebAuthnCredentials, req.Session, &req.Credential)
+		if err != nil {
+			authErr := webauthnError(err, "WebAuthn login failed")
+			a.audit(r, AuthEvent{Action: "webauthn"}, authErr.Code)
+			a.reject(w, r, "", authErr)
+			return
+		}
+
+		event := AuthEvent{Action: "webauthn", Username: login.Username, UserID: login.UserID}
+		user, err := a.UserLookup(r.Context(), login.Username)
+		if err != nil {
+			a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "User lookup failed", Err: err})
+			return
+		}
+		if user == nil || user.Disabled || user.ID != login.UserID {
+			a.audit(r, event, ReasonBadCredentials)
+			a.reject(w, r, "", &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: "WebAuthn login failed"})
+			return
+		}
+
+		extra := jwt.MapClaims{
+			"amr":       []string{AMRHardwareKey},
+			"auth_time": time.Now().Unix(),
+		}
+		// Ключ с проверкой пользователя (PIN, биометрия) - уже два фактора
+		if login.UserVerified {
+			extra["mfa"] = true
+		}
+		a.issueToken(w, r, event, user.ID, user.Username, user.Role, extra)
+	})
+}
+
+// webauthnClaims достаёт claims из токена для регистрации ключа и уже
+// зарегистрированные ключи пользователя. Первый ключ можно добавить после входа
+// по паролю, следующие - только после свежего входа с MFA: иначе украденный
+// токен позволил бы закрепить в аккаунте собственный ключ
+func (a *Authenticator) webauthnClaims(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, []WebAuthnCredential, bool) {
+	if a.WebAuthnCredentials == nil {
+		a.reject(w, r, "", &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "WebAuthn is not available", Err: errors.New("credential store is not configured")})
+		return nil, nil, false
+	}
+	tokenString := a.extractToken(r)
+	if tokenString == "" {
+		a.reject(w, r, "", &AuthError{Code: ReasonTokenMissing, Status: http.StatusUnauthorized, Detail: "Authorization required"})
+		return nil, nil, false
+	}
+	claims, err := a.JwtService.ParseJWT(tokenString)
+	if err != nil {
+		a.reject(w, r, "", tokenError(err))
+		return nil, nil, false
+	}
+	role, _ := claims["role"].(string)
+
+	// Токены, выданные сторонним клиентам OAuth, не управляют ключами пользователя
+	if _, delegated := claims["client_id"]; delegated {
+		a.reject(w, r, role, &AuthError{Code: ReasonAccessDenied, Status: http.StatusForbidden, Detail: "Delegated tokens cannot register security keys"})
+		return nil, nil, false
+	}
+
+	userID, _ := claims["user_id"].(float64)
+	existing, err := a.WebAuthnCredentials.Credentials(r.Context(), int(userID))
+	if err != nil {
+		a.reject(w, r, role, &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: "Credential lookup failed", Err: err})
+		return nil, nil, false
+	}
+	if len(existing) > 0 {
+		stepUp := &Section{RequireMFA: true, MaxAuthAge: webauthnRegisterMaxAge}
+		if err := checkStepUp(stepUp, claims, time.Now()); err != nil {
+			a.reject(w, r, role, err)
+			return nil, nil, false
+		}
+	}
+	return claims, existing, true
+}
+
+func webauthnError(err error, detail string) *AuthError {
+	if errors.Is(err, ErrWebAuthnVerification) || errors.Is(err, ErrWebAuthnSession) {
+		return &AuthError{Code: ReasonBadCredentials, Status: http.StatusUnauthorized, Detail: detail, Err: err}
+	}
+	return &AuthError{Code: ReasonConfigError, Status: http.StatusInternalServerError, Detail: detail, Err: err}
+}
@@ -0,0 +1,215 @@
+package access
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Алгоритмы COSE (RFC 9053), которые принимает проверяющая сторона
+const (
+	COSEAlgES256 = -7
+	COSEAlgES384 = -35
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+// Тип аттестации сохранённого ключа
+const (
+	AttestationNone  = "none"
+	AttestationSelf  = "self"
+	AttestationBasic = "basic"
+)
+
+var oidFIDOGenCEAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+type coseKey struct {
+	alg int64
+	pub crypto.PublicKey
+}
+
+// parseCOSEKey разбирает открытый ключ COSE_Key из authenticatorData
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: credential public key is not a map")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+
+	key := &coseKey{alg: alg}
+	switch {
+	case kty == 2 && (alg == COSEAlgES256 || alg == COSEAlgES384):
+		curve := elliptic.P256()
+		if crv == 2 {
+			curve = elliptic.P384()
+		} else if crv != 1 {
+			return nil, fmt.Errorf("webauthn: unsupported EC curve %d", crv)
+		}
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("webauthn: EC point is not on curve")
+		}
+		key.pub = pub
+	case kty == 3 && alg == COSEAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("webauthn: malformed RSA key")
+		}
+		key.pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case kty == 1 && alg == COSEAlgEdDSA && crv == 6:
+		x, _ := m[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("webauthn: malformed Ed25519 key")
+		}
+		key.pub = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("webauthn: unsupported key type %d with algorithm %d", kty, alg)
+	}
+	return key, nil
+}
+
+// verifySignature проверяет подпись алгоритмом alg ключом pub
+func verifySignature(pub crypto.PublicKey, alg int64, data, sig []byte) error {
+	var ok bool
+	switch alg {
+	case COSEAlgES256, COSEAlgES384:
+		ecPub, isEC := pub.(*ecdsa.PublicKey)
+		if !isEC {
+			return errors.New("webauthn: key does not match algorithm")
+		}
+		var digest []byte
+		if alg == COSEAlgES256 {
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		}
+		ok = ecdsa.VerifyASN1(ecPub, digest, sig)
+	case COSEAlgRS256:
+		rsaPub, isRSA := pub.(*rsa.PublicKey)
+		if !isRSA {
+			return errors.New("webauthn: key does not match algorithm")
+		}
+		sum := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, sum[:], sig) == nil
+	case COSEAlgEdDSA:
+		edPub, isEd := pub.(ed25519.PublicKey)
+		if !isEd {
+			return errors.New("webauthn: key does not match algorithm")
+		}
+		ok = ed25519.Verify(edPub, data, sig)
+	default:
+		return fmt.Errorf("webauthn: unsupported algorithm %d", alg)
+	}
+	if !ok {
+		return errors.New("webauthn: signature verification failed")
+	}
+	return nil
+}
+
+// verifyAttestation проверяет attStmt форматов none и packed и возвращает тип аттестации
+func (wa *WebAuthn) verifyAttestation(format string, stmt map[interface{}]interface{}, authData *authenticatorData, rawAuthData, clientDataHash []byte, key *coseKey) (string, error) {
+	switch format {
+	case "none":
+		if len(stmt) != 0 {
+			return "", errors.New("webauthn: none attestation must have an empty statement")
+		}
+		return AttestationNone, nil
+	case "packed":
+		return wa.verifyPacked(stmt, authData, append(append([]byte(nil), rawAuthData...), clientDataHash...), key)
+	}
+	return "", fmt.Errorf("webauthn: unsupported attestation format %q", format)
+}
+
+// verifyPacked - формат packed (WebAuthn §8.2): самоаттестация или цепочка x5c
+func (wa *WebAuthn) verifyPacked(stmt map[interface{}]interface{}, authData *authenticatorData, signed []byte, key *coseKey) (string, error) {
+	alg, _ := stmt["alg"].(int64)
+	sig, _ := stmt["sig"].([]byte)
+	if len(sig) == 0 {
+		return "", errors.New("webauthn: packed attestation without signature")
+	}
+
+	x5c, hasX5C := stmt["x5c"].([]interface{})
+	if !hasX5C {
+		// Самоаттестация: подписано ключом самого credential
+		if alg != key.alg {
+			return "", errors.New("webauthn: self attestation algorithm mismatch")
+		}
+		if err := verifySignature(key.pub, alg, signed, sig); err != nil {
+			return "", err
+		}
+		return AttestationSelf, nil
+	}
+
+	var certs []*x509.Certificate
+	for _, raw := range x5c {
+		der, ok := raw.([]byte)
+		if !ok {
+			return "", errors.New("webauthn: malformed x5c")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", fmt.Errorf("webauthn: parse attestation certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return "", errors.New("webauthn: empty x5c")
+	}
+	leaf := certs[0]
+
+	if err := verifySignature(leaf.PublicKey, alg, signed, sig); err != nil {
+		return "", err
+	}
+
+	// Требования к сертификату аттестации, §8.2.1
+	if leaf.Version != 3 || leaf.IsCA ||
+		len(leaf.Subject.Country) == 0 || len(leaf.Subject.Organization) == 0 || leaf.Subject.CommonName == "" ||
+		len(leaf.Subject.OrganizationalUnit) != 1 || leaf.Subject.OrganizationalUnit[0] != "Authenticator Attestation" {
+		return "", errors.New("webauthn: attestation certificate does not meet packed requirements")
+	}
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidFIDOGenCEAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, authData.aaguid) {
+			return "", errors.New("webauthn: attestation certificate AAGUID mismatch")
+		}
+	}
+
+	if wa.AttestationRoots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         wa.AttestationRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return "", fmt.Errorf("webauthn: untrusted attestation: %w", err)
+		}
+	}
+	return AttestationBasic, nil
+}